@@ -0,0 +1,335 @@
+// Package arbortest provides an in-process Arbor server for testing clients without
+// a network. The Server speaks the arbor protocol over in-memory pipes: it welcomes
+// each client, answers queries from its history, broadcasts new messages, and relays
+// META messages between clients. Faults such as delays, dropped messages, garbage, and
+// disconnections can be injected to exercise a client's error handling.
+package arbortest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+)
+
+// RecentCount is the number of recent message IDs sent in each WELCOME message.
+const RecentCount = 10
+
+// outboxSize is the number of messages that may be waiting to be written to a client.
+const outboxSize = 1000
+
+// Faults controls the misbehavior of a Server. The zero value is a well-behaved
+// server.
+type Faults struct {
+	// Delay is how long the server waits before writing each message to a client.
+	Delay time.Duration
+	// Drop, if set, is called for each message about to be written to a client. The
+	// message is silently discarded if it returns true.
+	Drop func(*arbor.ProtocolMessage) bool
+	// Refuse, if set, is returned by Connect instead of connecting.
+	Refuse error
+}
+
+// Server is a fake Arbor server. It is safe for concurrent use.
+type Server struct {
+	// History holds every message known to the server.
+	History *archive.Archive
+	// Root is the ID of the root message of the server's history.
+	Root string
+
+	lock     sync.Mutex
+	faults   Faults
+	clients  map[*client]struct{}
+	received []*arbor.ProtocolMessage
+	closed   bool
+}
+
+// NewServer creates a Server whose history contains only a root message.
+func NewServer() (*Server, error) {
+	root, err := newMessage("", "root", "Welcome to the test server")
+	if err != nil {
+		return nil, err
+	}
+	history := archive.New()
+	if err := history.Add(root); err != nil {
+		return nil, err
+	}
+	return &Server{
+		History: history,
+		Root:    root.UUID,
+		clients: make(map[*client]struct{}),
+	}, nil
+}
+
+// Seed adds messages to the server's history without announcing them to clients.
+// Clients learn about them through WELCOME messages and queries.
+func (s *Server) Seed(messages ...*arbor.ChatMessage) error {
+	for _, message := range messages {
+		if err := s.History.Add(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reply creates a message from the given user replying to the parent, adds it to the
+// server's history, and broadcasts it to every client.
+func (s *Server) Reply(parent, username, content string) (*arbor.ChatMessage, error) {
+	message, err := newMessage(parent, username, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.History.Add(message); err != nil {
+		return nil, err
+	}
+	s.Broadcast(&arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: message})
+	return message, nil
+}
+
+// newMessage creates a chat message with a new ID.
+func newMessage(parent, username, content string) (*arbor.ChatMessage, error) {
+	message, err := arbor.NewChatMessage(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := message.AssignID(); err != nil {
+		return nil, err
+	}
+	message.Parent = parent
+	message.Username = username
+	return message, nil
+}
+
+// SetFaults changes the misbehavior of the server. It affects messages that have not
+// been written to clients yet.
+func (s *Server) SetFaults(faults Faults) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = faults
+}
+
+// Connect creates a new client connection to the server. Its signature matches the
+// Connector type used by muscadine's NetClient, and the address is ignored.
+func (s *Server) Connect(address string) (io.ReadWriteCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("Server is closed")
+	} else if s.faults.Refuse != nil {
+		return nil, s.faults.Refuse
+	}
+	local, remote := net.Pipe()
+	c := &client{
+		conn:   remote,
+		outbox: make(chan []byte, outboxSize),
+		done:   make(chan struct{}),
+	}
+	s.clients[c] = struct{}{}
+	recent := s.History.Last(RecentCount)
+	welcome := &arbor.ProtocolMessage{
+		Type:   arbor.WelcomeType,
+		Root:   s.Root,
+		Recent: make([]string, 0, len(recent)),
+		Major:  0,
+		Minor:  1,
+	}
+	for _, message := range recent {
+		welcome.Recent = append(welcome.Recent, message.UUID)
+	}
+	s.sendLocked(c, welcome)
+	go s.write(c)
+	go s.read(c)
+	return local, nil
+}
+
+// Clients returns the number of clients connected to the server.
+func (s *Server) Clients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.clients)
+}
+
+// Received returns every message that clients have sent to the server, in the order
+// that they arrived.
+func (s *Server) Received() []*arbor.ProtocolMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*arbor.ProtocolMessage{}, s.received...)
+}
+
+// Broadcast sends the message to every client.
+func (s *Server) Broadcast(message *arbor.ProtocolMessage) {
+	s.broadcast(message, nil)
+}
+
+// broadcast sends the message to every client except the one given, which may be nil.
+func (s *Server) broadcast(message *arbor.ProtocolMessage, except *client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.clients {
+		if c != except {
+			s.sendLocked(c, message)
+		}
+	}
+}
+
+// SendGarbage writes data that is not a valid arbor protocol message to every client.
+func (s *Server) SendGarbage() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.clients {
+		c.enqueue([]byte("}this is not an arbor message{\n"))
+	}
+}
+
+// Disconnect closes the connection of every client. They may connect again.
+func (s *Server) Disconnect() {
+	s.lock.Lock()
+	clients := s.clients
+	s.clients = make(map[*client]struct{})
+	s.lock.Unlock()
+	for c := range clients {
+		c.close()
+	}
+}
+
+// Close disconnects every client and refuses any further connections.
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	s.Disconnect()
+}
+
+// sendLocked queues the message to be written to the client, unless the faults drop
+// it. The caller must hold the server's lock.
+func (s *Server) sendLocked(c *client, message *arbor.ProtocolMessage) {
+	if s.faults.Drop != nil && s.faults.Drop(message) {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	c.enqueue(append(data, '\n'))
+}
+
+// delay returns how long to wait before writing each message.
+func (s *Server) delay() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.faults.Delay
+}
+
+// remove forgets the client and closes its connection.
+func (s *Server) remove(c *client) {
+	s.lock.Lock()
+	delete(s.clients, c)
+	s.lock.Unlock()
+	c.close()
+}
+
+// write writes the queued messages to the client until its connection closes.
+func (s *Server) write(c *client) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.outbox:
+			if delay := s.delay(); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-c.done:
+					return
+				}
+			}
+			if _, err := c.conn.Write(data); err != nil {
+				s.remove(c)
+				return
+			}
+		}
+	}
+}
+
+// read handles the messages that the client sends until its connection closes.
+func (s *Server) read(c *client) {
+	defer s.remove(c)
+	decoder := json.NewDecoder(c.conn)
+	for {
+		message := new(arbor.ProtocolMessage)
+		if err := decoder.Decode(message); err != nil {
+			return
+		}
+		s.handle(c, message)
+	}
+}
+
+// handle responds to a message sent by the client.
+func (s *Server) handle(c *client, message *arbor.ProtocolMessage) {
+	s.lock.Lock()
+	s.received = append(s.received, message)
+	s.lock.Unlock()
+	switch message.Type {
+	case arbor.QueryType:
+		if message.ChatMessage == nil {
+			return
+		}
+		if found := s.History.Get(message.UUID); found != nil {
+			s.lock.Lock()
+			s.sendLocked(c, &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: found})
+			s.lock.Unlock()
+		}
+	case arbor.NewMessageType:
+		if message.ChatMessage == nil {
+			return
+		}
+		chat := *message.ChatMessage
+		// the server chooses the ID of each new message
+		if err := chat.AssignID(); err != nil {
+			return
+		}
+		if chat.Timestamp == 0 {
+			chat.Timestamp = time.Now().Unix()
+		}
+		announcement := &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: &chat}
+		if !announcement.IsValidNew() {
+			return
+		}
+		if err := s.History.Add(&chat); err != nil {
+			return
+		}
+		s.broadcast(announcement, nil)
+	case arbor.MetaType:
+		s.broadcast(message, c)
+	}
+}
+
+// client is the server's end of a connection.
+type client struct {
+	conn      net.Conn
+	outbox    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// enqueue queues data to be written to the client. If too much is already waiting,
+// the client is too slow to keep up and the data is discarded.
+func (c *client) enqueue(data []byte) {
+	select {
+	case c.outbox <- data:
+	default:
+	}
+}
+
+// close closes the client's connection. It is safe to call more than once.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
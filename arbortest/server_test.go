@@ -0,0 +1,142 @@
+package arbortest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/arbortest"
+	"github.com/onsi/gomega"
+)
+
+// serverOrSkip creates a Server with a short history beneath its root.
+func serverOrSkip(t *testing.T) *arbortest.Server {
+	server, err := arbortest.NewServer()
+	if err != nil {
+		t.Skip(err)
+	}
+	child := &arbor.ChatMessage{UUID: "child", Parent: server.Root, Username: "seed", Content: "hi", Timestamp: 2}
+	if err := server.Seed(child); err != nil {
+		t.Skip(err)
+	}
+	return server
+}
+
+// connection is a raw client connection to a Server.
+type connection struct {
+	io.ReadWriteCloser
+	messages chan *arbor.ProtocolMessage
+	errs     chan error
+}
+
+// connectOrSkip connects to the server and decodes everything that it sends.
+func connectOrSkip(t *testing.T, server *arbortest.Server) *connection {
+	conn, err := server.Connect("")
+	if err != nil {
+		t.Skip(err)
+	}
+	c := &connection{
+		ReadWriteCloser: conn,
+		messages:        make(chan *arbor.ProtocolMessage, 100),
+		errs:            make(chan error, 1),
+	}
+	go func() {
+		decoder := json.NewDecoder(conn)
+		for {
+			m := new(arbor.ProtocolMessage)
+			if err := decoder.Decode(m); err != nil {
+				c.errs <- err
+				return
+			}
+			c.messages <- m
+		}
+	}()
+	return c
+}
+
+// send writes the message to the server.
+func (c *connection) send(g *gomega.GomegaWithT, m *arbor.ProtocolMessage) {
+	g.Expect(json.NewEncoder(c).Encode(m)).To(gomega.BeNil())
+}
+
+// TestProtocol checks that the server welcomes clients, answers their queries, and
+// broadcasts their messages.
+func TestProtocol(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server := serverOrSkip(t)
+	defer server.Close()
+	alice := connectOrSkip(t, server)
+	bob := connectOrSkip(t, server)
+	g.Eventually(server.Clients).Should(gomega.Equal(2))
+
+	var m *arbor.ProtocolMessage
+	g.Eventually(alice.messages).Should(gomega.Receive(&m))
+	g.Expect(m.IsValidWelcome()).To(gomega.BeTrue())
+	g.Expect(m.Root).To(gomega.Equal(server.Root))
+	g.Expect(m.Recent).To(gomega.ContainElement("child"))
+	g.Eventually(bob.messages).Should(gomega.Receive())
+
+	alice.send(g, &arbor.ProtocolMessage{Type: arbor.QueryType, ChatMessage: &arbor.ChatMessage{UUID: "child"}})
+	g.Eventually(alice.messages).Should(gomega.Receive(&m))
+	g.Expect(m.Type).To(gomega.BeEquivalentTo(arbor.NewMessageType))
+	g.Expect(m.UUID).To(gomega.Equal("child"))
+	alice.send(g, &arbor.ProtocolMessage{Type: arbor.QueryType, ChatMessage: &arbor.ChatMessage{UUID: "missing"}})
+	g.Consistently(alice.messages, 20*time.Millisecond).ShouldNot(gomega.Receive())
+
+	reply := &arbor.ChatMessage{UUID: "reply", Parent: "child", Username: "alice", Content: "hello", Timestamp: 3}
+	alice.send(g, &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: reply})
+	for _, c := range []*connection{alice, bob} {
+		g.Eventually(c.messages).Should(gomega.Receive(&m))
+		g.Expect(m.Content).To(gomega.Equal("hello"))
+		g.Expect(m.UUID).ToNot(gomega.Equal("reply"))
+	}
+	g.Expect(server.History.Has(m.UUID)).To(gomega.BeTrue())
+
+	alice.send(g, &arbor.ProtocolMessage{Type: arbor.MetaType, Meta: map[string]string{"presence/who": ""}})
+	g.Eventually(bob.messages).Should(gomega.Receive(&m))
+	g.Expect(m.Meta).To(gomega.HaveKey("presence/who"))
+	g.Consistently(alice.messages, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	g.Expect(server.Received()).To(gomega.HaveLen(4))
+}
+
+// TestFaults checks that the server misbehaves as instructed.
+func TestFaults(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server := serverOrSkip(t)
+	defer server.Close()
+
+	server.SetFaults(arbortest.Faults{Refuse: fmt.Errorf("refused")})
+	_, err := server.Connect("")
+	g.Expect(err).ToNot(gomega.BeNil())
+
+	server.SetFaults(arbortest.Faults{Drop: func(m *arbor.ProtocolMessage) bool {
+		return m.Type == arbor.WelcomeType
+	}})
+	c := connectOrSkip(t, server)
+	g.Consistently(c.messages, 20*time.Millisecond).ShouldNot(gomega.Receive())
+
+	const delay = 100 * time.Millisecond
+	server.SetFaults(arbortest.Faults{Delay: delay})
+	start := time.Now()
+	_, err = server.Reply(server.Root, "server", "slow")
+	g.Expect(err).To(gomega.BeNil())
+	g.Eventually(c.messages).Should(gomega.Receive())
+	g.Expect(time.Since(start)).To(gomega.BeNumerically(">=", delay))
+
+	server.SetFaults(arbortest.Faults{})
+	server.SendGarbage()
+	g.Eventually(c.errs).Should(gomega.Receive())
+
+	c = connectOrSkip(t, server)
+	g.Eventually(c.messages).Should(gomega.Receive())
+	server.Disconnect()
+	g.Eventually(c.errs).Should(gomega.Receive(gomega.Equal(io.EOF)))
+	g.Expect(server.Clients()).To(gomega.Equal(0))
+
+	server.Close()
+	_, err = server.Connect("")
+	g.Expect(err).ToNot(gomega.BeNil())
+}
@@ -1,57 +1,190 @@
 package archive
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"sort"
+	"sync"
+	"time"
 
 	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/types"
 )
 
 // Archive stores the chat history of conversations had over Arbor.
 // It provides mechanisms to persist history to and load history from disk.
+// It is safe for concurrent use.
 type Archive struct {
+	lock          sync.RWMutex
 	chronological []*arbor.ChatMessage
-	childCache    map[string][]string
-	root          string
+	// byID indexes the messages by their IDs
+	byID       map[string]*arbor.ChatMessage
+	childCache map[string][]string
+	root       string
+	// queries records the attempts to retrieve each missing message
+	queries map[string]*QueryRecord
+	// revisions holds the changes that authors made to their messages
+	revisions map[string][]types.Revision
+	// reactions holds the reactions of users to messages
+	reactions      reactionStore
+	giveUpAttempts int
+	giveUpAfter    time.Duration
 }
 
-const defaultCapacity = 1024
+// QueryRecord describes the attempts that have been made to retrieve a message that
+// is missing from the archive.
+type QueryRecord struct {
+	// Attempts is the number of times that the message was requested.
+	Attempts int `json:"attempts"`
+	// First and Last are the times of the earliest and latest attempts.
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// metadata is persisted after the messages in the archive. Older versions stop reading
+// after the messages, so everything in it must be optional.
+type metadata struct {
+	Queries   map[string]*QueryRecord     `json:"queries,omitempty"`
+	Revisions map[string][]types.Revision `json:"revisions,omitempty"`
+	Reactions reactionStore               `json:"reactions,omitempty"`
+}
+
+const (
+	defaultCapacity = 1024
+	// DefaultGiveUpAttempts is the default number of unanswered queries after which
+	// a message is considered unavailable.
+	DefaultGiveUpAttempts = 3
+	// DefaultGiveUpAfter is the default minimum time between the first and latest
+	// unanswered queries for a message before it is considered unavailable.
+	DefaultGiveUpAfter = time.Minute
+)
 
 // New creates an empty archive. Use Load() or Add() to populate with data.
 func New() *Archive {
 	return &Archive{
-		chronological: make([]*arbor.ChatMessage, 0, defaultCapacity),
-		childCache:    make(map[string][]string),
+		chronological:  make([]*arbor.ChatMessage, 0, defaultCapacity),
+		byID:           make(map[string]*arbor.ChatMessage, defaultCapacity),
+		childCache:     make(map[string][]string),
+		queries:        make(map[string]*QueryRecord),
+		revisions:      make(map[string][]types.Revision),
+		reactions:      make(reactionStore),
+		giveUpAttempts: DefaultGiveUpAttempts,
+		giveUpAfter:    DefaultGiveUpAfter,
+	}
+}
+
+// SetGiveUp changes the thresholds after which a missing message is considered
+// unavailable. A message is unavailable once it has been queried at least `attempts`
+// times, and at least `after` has passed between the first and latest of them.
+func (a *Archive) SetGiveUp(attempts int, after time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.giveUpAttempts = attempts
+	a.giveUpAfter = after
+}
+
+// RecordQuery notes that the message with the given id was requested at the given
+// time. It does nothing if the message is already in the archive.
+func (a *Archive) RecordQuery(id string, at time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.has(id) {
+		return
+	}
+	record, ok := a.queries[id]
+	if !ok {
+		record = &QueryRecord{First: at}
+		a.queries[id] = record
+	}
+	record.Attempts++
+	record.Last = at
+}
+
+// QueryStatus returns the attempts made to retrieve the message with the given id.
+// The final return value is false if no attempts have been recorded.
+func (a *Archive) QueryStatus(id string) (QueryRecord, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	record, ok := a.queries[id]
+	if !ok {
+		return QueryRecord{}, false
+	}
+	return *record, true
+}
+
+// Queried returns whether any attempt to retrieve the message with the given id has
+// been recorded since it went missing.
+func (a *Archive) Queried(id string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	_, ok := a.queries[id]
+	return ok
+}
+
+// IsUnavailable returns whether the message with the given id is missing from the
+// archive and has gone unanswered too many times to be worth requesting again.
+func (a *Archive) IsUnavailable(id string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.isUnavailable(id)
+}
+
+// isUnavailable implements IsUnavailable. The caller must hold the archive's lock.
+func (a *Archive) isUnavailable(id string) bool {
+	record, ok := a.queries[id]
+	return ok && record.Attempts >= a.giveUpAttempts && record.Last.Sub(record.First) >= a.giveUpAfter
+}
+
+// Unavailable returns the sorted IDs of every message that is referenced within the
+// archive but has been given up on.
+func (a *Archive) Unavailable() []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	unavailable := make([]string, 0)
+	for id := range a.queries {
+		if a.isUnavailable(id) {
+			unavailable = append(unavailable, id)
+		}
 	}
+	sort.Strings(unavailable)
+	return unavailable
 }
 
 // Last returns the most chronologically "recent" `n` messages known to the
 // archive. The length of the returned slice may be shorter than `n` if `n`
 // is greater than the number of known messages.
 func (a *Archive) Last(n int) []*arbor.ChatMessage {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
 	if n <= 0 {
 		return make([]*arbor.ChatMessage, 0)
 	}
-	if n >= len(a.chronological) {
-		return a.chronological
+	if n > len(a.chronological) {
+		n = len(a.chronological)
 	}
-	return a.chronological[len(a.chronological)-n:]
+	// copy the messages so that later additions can't reorder the result
+	last := make([]*arbor.ChatMessage, n)
+	copy(last, a.chronological[len(a.chronological)-n:])
+	return last
 }
 
 // Needed returns at most `n` message IDs that are referenced as parents within
 // the archive but are not present within the archive. These IDs should be sorted
-// such that the most-recently-referenced parents are returned first. If an empty
-// slice is returned, all messages within the archive have a complete ancestry.
+// such that the most-recently-referenced parents are returned first. Messages that
+// are unavailable are omitted. If an empty slice is returned, all messages within
+// the archive have a complete ancestry or are missing unavailable ancestors.
 func (a *Archive) Needed(n int) []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
 	if n <= 0 {
 		return make([]string, 0)
 	}
 	needed := make([]string, 0)
 	for _, m := range a.chronological {
-		if m.Parent != "" && !a.Has(m.Parent) {
+		if m.Parent != "" && !a.has(m.Parent) && !a.isUnavailable(m.Parent) {
 			needed = append(needed, m.Parent)
 		}
 	}
@@ -63,27 +196,45 @@ func (a *Archive) Needed(n int) []string {
 
 // Has returns whether the archive contains a message with the given ID.
 func (a *Archive) Has(id string) bool {
-	for _, message := range a.chronological {
-		if message.UUID == id {
-			return true
-		}
-	}
-	return false
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.has(id)
+}
+
+// has implements Has. The caller must hold the archive's lock.
+func (a *Archive) has(id string) bool {
+	_, ok := a.byID[id]
+	return ok
 }
 
 // Get returns the message with the given id, or nil if the message is
 // not in the archive.
 func (a *Archive) Get(id string) *arbor.ChatMessage {
-	for _, message := range a.chronological {
-		if message.UUID == id {
-			return message
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.get(id)
+}
+
+// get implements Get. The caller must hold the archive's lock.
+func (a *Archive) get(id string) *arbor.ChatMessage {
+	return a.byID[id]
+}
+
+// setMessages replaces every message in the archive and sorts them. The caller must
+// hold the archive's write lock.
+func (a *Archive) setMessages(messages []*arbor.ChatMessage) {
+	a.chronological = messages
+	a.byID = make(map[string]*arbor.ChatMessage, len(messages))
+	for _, message := range messages {
+		if _, ok := a.byID[message.UUID]; !ok {
+			a.byID[message.UUID] = message
 		}
 	}
-	return nil
+	a.sort()
 }
 
 // sort updates the internal representation to ensure that messages are ordered
-// correctly.
+// correctly. The caller must hold the archive's write lock.
 func (a *Archive) sort() {
 	sort.SliceStable(a.chronological, func(i, j int) bool {
 		return a.chronological[i].Timestamp < a.chronological[j].Timestamp
@@ -92,16 +243,25 @@ func (a *Archive) sort() {
 
 // Add adds the provided message to the archive.
 func (a *Archive) Add(message *arbor.ChatMessage) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.add(message)
+}
+
+// add implements Add. The caller must hold the archive's write lock.
+func (a *Archive) add(message *arbor.ChatMessage) error {
 	if message == nil {
 		return fmt.Errorf("Unable to add nil message")
 	}
-	if a.Has(message.UUID) {
+	if a.has(message.UUID) {
 		// don't attempt to add messages that are already present.
 		// has the nice side-effect of preventing collisions.
 		return nil
 	}
 	messageCopy := *message
 	a.chronological = append(a.chronological, &messageCopy)
+	a.byID[messageCopy.UUID] = &messageCopy
+	delete(a.queries, message.UUID)
 	a.sort()
 	if a.root == "" && message.Parent == "" {
 		a.root = message.UUID
@@ -116,6 +276,8 @@ func (a *Archive) Add(message *arbor.ChatMessage) error {
 // Root returns the root message within the archive. If no root message is known,
 // it instead returns the oldest message within the archive.
 func (a *Archive) Root() (string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
 	if a.root != "" {
 		return a.root, nil
 	} else if len(a.chronological) > 0 {
@@ -134,7 +296,10 @@ func dupSlice(in []string) []string {
 // If there is no known post with the provided id or if the provided post has no children,
 // an empty slice is returned.
 func (a *Archive) ChildrenOf(id string) []string {
-	if !a.Has(id) {
+	// populating the cache modifies the archive
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.has(id) {
 		return []string{}
 	}
 	children, inCache := a.childCache[id]
@@ -158,8 +323,13 @@ func (a *Archive) Persist(storage io.Writer) error {
 	if storage == nil {
 		return fmt.Errorf("Unable to persist to nil")
 	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
 	encoder := json.NewEncoder(storage)
-	return encoder.Encode(a.chronological)
+	if err := encoder.Encode(a.chronological); err != nil {
+		return err
+	}
+	return encoder.Encode(metadata{Queries: a.queries, Revisions: a.revisions, Reactions: a.reactions})
 }
 
 // OldArchivePrefix is the sequence of bytes that go-multicodec used to
@@ -182,33 +352,68 @@ func (a *Archive) Populate(storage io.Reader) error {
 	if storage == nil {
 		return fmt.Errorf("Unable to load from nil")
 	}
-	// check for old history format
-	prefix := make([]byte, len(OldArchivePrefix))
-	// read the prefix to prevent it from causing a misparse. If it's not there, we'll put the
-	// bytes that we read back.
-	n, err := storage.Read(prefix)
+	newMessages, meta, err := decode(storage)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.chronological) < 1 {
+		a.setMessages(newMessages)
+	} else {
+		// we need to merge the contents with what's already in a.chronological
+		if err := a.merge(newMessages); err != nil {
+			return err
+		}
+	}
+	a.mergeQueries(meta.Queries)
+	a.mergeRevisions(meta.Revisions)
+	a.mergeReactions(meta.Reactions)
+	return nil
+}
+
+// stripPrefix returns a reader for the contents of storage that skips the prefix
+// used by the old archive format, if it is present. Compressed contents are
+// decompressed before checking for the prefix.
+func stripPrefix(storage io.Reader) (io.Reader, error) {
+	storage, err := decompress(storage)
 	if err != nil {
-		return fmt.Errorf("Unable to complete history prefix check: %s", err)
+		return nil, err
 	}
-	// if the file didn't have the prefix, put the read bytes back
-	if !(n == len(OldArchivePrefix) && bytes.Equal(prefix, OldArchivePrefix)) {
-		prefixBuf := bytes.NewBuffer(prefix)
-		// make a reader that will read like the original reader by returning the bytes that
-		// we already processed first
-		storage = io.MultiReader(prefixBuf, storage)
+	// check for old history format, skipping the prefix to prevent it from causing a
+	// misparse
+	buffered := bufio.NewReader(storage)
+	if prefix, _ := buffered.Peek(len(OldArchivePrefix)); bytes.Equal(prefix, OldArchivePrefix) {
+		buffered.Discard(len(OldArchivePrefix))
+	}
+	return buffered, nil
+}
+
+// decode reads the messages and metadata written by Persist from storage.
+func decode(storage io.Reader) ([]*arbor.ChatMessage, metadata, error) {
+	var meta metadata
+	storage, err := stripPrefix(storage)
+	if err != nil {
+		return nil, meta, err
 	}
 	decoder := json.NewDecoder(storage)
-	if len(a.chronological) < 1 {
-		return decoder.Decode(&a.chronological)
+	messages := make([]*arbor.ChatMessage, 0, defaultCapacity)
+	if err := decoder.Decode(&messages); err != nil {
+		return nil, meta, err
 	}
-	// otherwise, we need to merge the contents with what's already in a.chronological
-	newMessages := make([]*arbor.ChatMessage, 0, defaultCapacity)
-	if err := decoder.Decode(&newMessages); err != nil {
-		return err
+	// archives written by older versions end after the messages
+	if err := decoder.Decode(&meta); err != nil && err != io.EOF {
+		return nil, meta, fmt.Errorf("Unable to decode archive metadata: %s", err)
 	}
+	return messages, meta, nil
+}
+
+// merge adds the provided messages to the archive if none of them conflict with
+// those already present. The caller must hold the archive's write lock.
+func (a *Archive) merge(newMessages []*arbor.ChatMessage) error {
 	// ensure no bad data
 	for _, message := range newMessages {
-		if msg := a.Get(message.UUID); msg != nil {
+		if msg := a.get(message.UUID); msg != nil {
 			if !msg.Equals(message) {
 				// we have discovered two messages with the same ID but
 				// different contents. Reject all messages from the current
@@ -219,9 +424,32 @@ func (a *Archive) Populate(storage io.Reader) error {
 	}
 	// if we get here, no ID conflicts were discovered
 	for _, message := range newMessages {
-		if err := a.Add(message); err != nil {
+		if err := a.add(message); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// mergeQueries combines the provided query records with those already known,
+// discarding records of messages that are present. The caller must hold the archive's
+// write lock.
+func (a *Archive) mergeQueries(queries map[string]*QueryRecord) {
+	for id, record := range queries {
+		if record == nil || a.has(id) {
+			continue
+		}
+		existing, ok := a.queries[id]
+		if !ok {
+			a.queries[id] = record
+			continue
+		}
+		existing.Attempts += record.Attempts
+		if record.First.Before(existing.First) {
+			existing.First = record.First
+		}
+		if record.Last.After(existing.Last) {
+			existing.Last = record.Last
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -242,3 +243,191 @@ func TestOpenFileWrite(t *testing.T) {
 	err = os.Remove(tmpPath)
 	g.Expect(err).To(gomega.BeNil())
 }
+
+// tempManagerOrSkip creates a Manager for a history file in a new temporary directory,
+// which should be removed by the caller.
+func tempManagerOrSkip(t *testing.T) (*archive.Manager, string) {
+	dir, err := ioutil.TempDir("", "muscadine-archive")
+	if err != nil {
+		t.Skip(err)
+	}
+	return mgrOrSkip(t, path.Join(dir, "history.arborhist")), dir
+}
+
+// TestSaveFile checks that saving to a file replaces it completely, keeps the
+// configured number of backups, and leaves no temporary files behind.
+func TestSaveFile(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	mgr, dir := tempManagerOrSkip(t)
+	defer os.RemoveAll(dir)
+	histPath := path.Join(dir, "history.arborhist")
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("message-%d", i)
+		if err := mgr.Add(&arbor.ChatMessage{UUID: id, Username: "bar", Content: "bin", Timestamp: int64(i)}); err != nil {
+			t.Skip(err)
+		}
+		g.Expect(mgr.Save()).To(gomega.BeNil())
+	}
+	files, err := ioutil.ReadDir(dir)
+	g.Expect(err).To(gomega.BeNil())
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	g.Expect(names).To(gomega.ConsistOf("history.arborhist", "history.arborhist.bak.1", "history.arborhist.bak.2"))
+
+	for backup, expected := range map[string]int{histPath: 4, histPath + ".bak.1": 3, histPath + ".bak.2": 2} {
+		loaded := mgrOrSkip(t, backup)
+		g.Expect(loaded.Load()).To(gomega.BeNil())
+		g.Expect(loaded.Last(10)).To(gomega.HaveLen(expected))
+	}
+
+	for _, reply := range []*arbor.ChatMessage{
+		{UUID: "old-reply", Parent: "message-0", Username: "bar", Content: "bin", Timestamp: 5},
+		{UUID: "new-reply", Parent: "message-3", Username: "bar", Content: "bin", Timestamp: 10},
+	} {
+		if err := mgr.Add(reply); err != nil {
+			t.Skip(err)
+		}
+	}
+	mgr.SetRetention(archive.Retention{MaxCount: 1})
+	g.Expect(mgr.Save()).To(gomega.BeNil())
+	loaded := mgrOrSkip(t, histPath)
+	g.Expect(loaded.Load()).To(gomega.BeNil())
+	g.Expect(loaded.Has("old-reply")).To(gomega.BeFalse())
+	g.Expect(loaded.Has("new-reply")).To(gomega.BeTrue())
+	g.Expect(loaded.Last(10)).To(gomega.HaveLen(5))
+
+	// saves made soon after a prune don't prune again
+	if err := mgr.Add(&arbor.ChatMessage{UUID: "newest-reply", Parent: "message-3", Username: "bar", Content: "bin", Timestamp: 11}); err != nil {
+		t.Skip(err)
+	}
+	g.Expect(mgr.Save()).To(gomega.BeNil())
+	g.Expect(mgr.Has("new-reply")).To(gomega.BeTrue())
+}
+
+// TestLock checks that only one Manager at a time can lock a history file, and that
+// read-only Managers refuse to save.
+func TestLock(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	first, dir := tempManagerOrSkip(t)
+	defer os.RemoveAll(dir)
+	second := mgrOrSkip(t, path.Join(dir, "history.arborhist"))
+
+	g.Expect(first.Lock()).To(gomega.BeNil())
+	g.Expect(first.Lock()).To(gomega.BeNil())
+	err := second.Lock()
+	g.Expect(archive.IsLocked(err)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring(fmt.Sprintf("pid %d", os.Getpid())))
+
+	second.SetReadOnly(true)
+	g.Expect(second.ReadOnly()).To(gomega.BeTrue())
+	g.Expect(second.Save()).To(gomega.Equal(archive.ErrReadOnly))
+
+	g.Expect(first.Unlock()).To(gomega.BeNil())
+	g.Expect(second.Lock()).To(gomega.BeNil())
+	g.Expect(second.Unlock()).To(gomega.BeNil())
+}
+
+// TestCompression checks that history is only compressed when saved if compression was
+// chosen or the history was already compressed, and that uncompressed history in the
+// old format is migrated.
+func TestCompression(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	mgr, dir := tempManagerOrSkip(t)
+	defer os.RemoveAll(dir)
+	histPath := path.Join(dir, "history.arborhist")
+	old := new(bytes.Buffer)
+	old.Write(archive.OldArchivePrefix)
+	if _, err := io.Copy(old, memoryArchiveOrSkip(t, "foo")); err != nil {
+		t.Skip(err)
+	}
+	if err := ioutil.WriteFile(histPath, old.Bytes(), 0600); err != nil {
+		t.Skip(err)
+	}
+	g.Expect(mgr.Load()).To(gomega.BeNil())
+	g.Expect(mgr.Has("foo")).To(gomega.BeTrue())
+	g.Expect(mgr.Save()).To(gomega.BeNil())
+	contents, err := ioutil.ReadFile(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(contents[0]).To(gomega.Equal(byte('[')))
+
+	mgr.SetCompression(true)
+	g.Expect(mgr.Save()).To(gomega.BeNil())
+	contents, err = ioutil.ReadFile(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(contents[:len(archive.GzipMagic)]).To(gomega.Equal(archive.GzipMagic))
+
+	// compressed history stays compressed unless told otherwise
+	loaded := mgrOrSkip(t, histPath)
+	g.Expect(loaded.Load()).To(gomega.BeNil())
+	g.Expect(loaded.Has("foo")).To(gomega.BeTrue())
+	g.Expect(loaded.Save()).To(gomega.BeNil())
+	contents, err = ioutil.ReadFile(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(contents[:len(archive.GzipMagic)]).To(gomega.Equal(archive.GzipMagic))
+
+	plain := mgrOrSkip(t, histPath)
+	plain.SetCompression(false)
+	g.Expect(plain.Load()).To(gomega.BeNil())
+	g.Expect(plain.Save()).To(gomega.BeNil())
+	contents, err = ioutil.ReadFile(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(contents[0]).To(gomega.Equal(byte('[')))
+}
+
+// TestEncryption checks that history saved with a passphrase is encrypted, and that it
+// can only be loaded with the same passphrase.
+func TestEncryption(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	mgr, dir := tempManagerOrSkip(t)
+	defer os.RemoveAll(dir)
+	histPath := path.Join(dir, "history.arborhist")
+	mgr.SetCompression(false)
+	mgr.SetPassphrase([]byte("correct horse"))
+	if err := mgr.Add(&arbor.ChatMessage{UUID: "foo", Username: "bar", Content: "secret", Timestamp: 1}); err != nil {
+		t.Skip(err)
+	}
+	g.Expect(mgr.Save()).To(gomega.BeNil())
+	g.Expect(mgr.Save()).To(gomega.BeNil())
+	contents, err := ioutil.ReadFile(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(bytes.HasPrefix(contents, archive.EncryptedMagic)).To(gomega.BeTrue())
+	g.Expect(bytes.Contains(contents, []byte("secret"))).To(gomega.BeFalse())
+
+	loaded := mgrOrSkip(t, histPath)
+	encrypted, err := loaded.Encrypted()
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(encrypted).To(gomega.BeTrue())
+	g.Expect(loaded.Load()).To(gomega.Equal(archive.ErrPassphraseRequired))
+	loaded.SetPassphrase([]byte("wrong horse"))
+	g.Expect(loaded.Load()).To(gomega.Equal(archive.ErrWrongPassphrase))
+	loaded.SetPassphrase([]byte("correct horse"))
+	g.Expect(loaded.Load()).To(gomega.BeNil())
+	g.Expect(loaded.Get("foo").Content).To(gomega.Equal("secret"))
+
+	// excessive key derivation parameters are rejected before deriving a key
+	tampered := append([]byte{}, contents...)
+	tampered[len(archive.EncryptedMagic)+1] = 64
+	tamperedPath := path.Join(dir, "tampered.arborhist")
+	g.Expect(ioutil.WriteFile(tamperedPath, tampered, 0600)).To(gomega.BeNil())
+	tamperedMgr := mgrOrSkip(t, tamperedPath)
+	tamperedMgr.SetPassphrase([]byte("correct horse"))
+	err = tamperedMgr.Load()
+	g.Expect(err).ToNot(gomega.BeNil())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("Unsupported key derivation parameters"))
+
+	report, err := loaded.Check()
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(report.Messages).To(gomega.Equal(1))
+
+	loaded.SetPassphrase(nil)
+	g.Expect(loaded.Save()).To(gomega.BeNil())
+	encrypted, err = loaded.Encrypted()
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(encrypted).To(gomega.BeFalse())
+	g.Expect(loaded.RemoveBackups()).To(gomega.BeNil())
+	backups, err := filepath.Glob(histPath + ".bak.*")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(backups).To(gomega.BeEmpty())
+}
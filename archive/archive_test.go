@@ -5,9 +5,11 @@ import (
 	"io"
 	"sort"
 	"testing"
+	"time"
 
 	arbor "github.com/arborchat/arbor-go"
 	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/types"
 	"github.com/onsi/gomega"
 )
 
@@ -354,6 +356,126 @@ func TestNeeded(t *testing.T) {
 	}
 }
 
+// TestUnavailable checks that query attempts are recorded, that messages are given up
+// on after enough attempts, and that the records survive being persisted.
+func TestUnavailable(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := newOrSkip(t)
+	addOrSkip(t, a, &arbor.ChatMessage{UUID: "orphan", Parent: "gone", Username: "test", Content: "a", Timestamp: 1})
+	addOrSkip(t, a, &arbor.ChatMessage{UUID: "child", Parent: "late", Username: "test", Content: "b", Timestamp: 2})
+	a.SetGiveUp(2, time.Hour)
+	start := time.Unix(1000, 0)
+
+	g.Expect(a.Queried("gone")).To(gomega.BeFalse())
+	a.RecordQuery("gone", start)
+	g.Expect(a.Queried("gone")).To(gomega.BeTrue())
+	a.RecordQuery("gone", start.Add(time.Minute))
+	g.Expect(a.IsUnavailable("gone")).To(gomega.BeFalse())
+	a.RecordQuery("gone", start.Add(time.Hour))
+	g.Expect(a.IsUnavailable("gone")).To(gomega.BeTrue())
+	record, ok := a.QueryStatus("gone")
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(record).To(gomega.Equal(archive.QueryRecord{Attempts: 3, First: start, Last: start.Add(time.Hour)}))
+	g.Expect(a.Needed(10)).To(gomega.Equal([]string{"late"}))
+	g.Expect(a.Unavailable()).To(gomega.Equal([]string{"gone"}))
+
+	// records for messages already present are meaningless
+	a.RecordQuery("orphan", start)
+	_, ok = a.QueryStatus("orphan")
+	g.Expect(ok).To(gomega.BeFalse())
+
+	a.RecordQuery("late", start)
+	buf := new(bytes.Buffer)
+	g.Expect(a.Persist(buf)).To(gomega.BeNil())
+	loaded := newOrSkip(t)
+	loaded.SetGiveUp(2, time.Hour)
+	g.Expect(loaded.Populate(buf)).To(gomega.BeNil())
+	g.Expect(loaded.Unavailable()).To(gomega.Equal([]string{"gone"}))
+	_, ok = loaded.QueryStatus("late")
+	g.Expect(ok).To(gomega.BeTrue())
+
+	// the record is discarded once the message arrives
+	addOrSkip(t, loaded, &arbor.ChatMessage{UUID: "gone", Username: "test", Content: "c", Timestamp: 0})
+	g.Expect(loaded.IsUnavailable("gone")).To(gomega.BeFalse())
+	g.Expect(loaded.Unavailable()).To(gomega.BeEmpty())
+}
+
+// TestRevisions ensures that the revisions of messages are kept in order, persisted,
+// and merged.
+func TestRevisions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := newOrSkip(t)
+	addOrSkip(t, a, &arbor.ChatMessage{UUID: "typo", Username: "test", Content: "helo", Timestamp: 1})
+	edit := types.Revision{Content: "hello", Timestamp: 2}
+	retraction := types.Revision{Retracted: true, Timestamp: 3}
+
+	g.Expect(a.Revisions("typo")).To(gomega.BeEmpty())
+	g.Expect(a.Revise("missing", edit)).ToNot(gomega.BeNil())
+	g.Expect(a.Revise("typo", retraction)).To(gomega.BeNil())
+	g.Expect(a.Revise("typo", edit)).To(gomega.BeNil())
+	g.Expect(a.Revise("typo", edit)).To(gomega.BeNil())
+	g.Expect(a.Revisions("typo")).To(gomega.Equal([]types.Revision{edit, retraction}))
+
+	buf := new(bytes.Buffer)
+	g.Expect(a.Persist(buf)).To(gomega.BeNil())
+	loaded := newOrSkip(t)
+	g.Expect(loaded.Populate(buf)).To(gomega.BeNil())
+	g.Expect(loaded.Revisions("typo")).To(gomega.Equal([]types.Revision{edit, retraction}))
+
+	// revisions from another source are combined with those already known
+	other := newOrSkip(t)
+	addOrSkip(t, other, &arbor.ChatMessage{UUID: "typo", Username: "test", Content: "helo", Timestamp: 1})
+	later := types.Revision{Content: "hello!", Timestamp: 4}
+	g.Expect(other.Revise("typo", later)).To(gomega.BeNil())
+	buf.Reset()
+	g.Expect(other.Persist(buf)).To(gomega.BeNil())
+	_, err := loaded.Merge(buf, false)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(loaded.Revisions("typo")).To(gomega.Equal([]types.Revision{edit, retraction, later}))
+}
+
+// TestReactions ensures that reactions are aggregated by tag, persisted, and merged.
+func TestReactions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := newOrSkip(t)
+	addOrSkip(t, a, &arbor.ChatMessage{UUID: "news", Username: "test", Content: "we shipped", Timestamp: 1})
+
+	g.Expect(a.Reactions("news")).To(gomega.BeEmpty())
+	g.Expect(a.AddReaction("missing", "alice", "+1")).ToNot(gomega.BeNil())
+	g.Expect(a.AddReaction("news", "", "+1")).ToNot(gomega.BeNil())
+	g.Expect(a.AddReaction("news", "bob", "+1")).To(gomega.BeNil())
+	g.Expect(a.AddReaction("news", "alice", "+1")).To(gomega.BeNil())
+	g.Expect(a.AddReaction("news", "alice", "+1")).To(gomega.BeNil())
+	g.Expect(a.AddReaction("news", "carol", "🎉")).To(gomega.BeNil())
+	g.Expect(a.Reactions("news")).To(gomega.Equal([]types.Reaction{
+		{Tag: "+1", Usernames: []string{"alice", "bob"}},
+		{Tag: "🎉", Usernames: []string{"carol"}},
+	}))
+	a.RemoveReaction("news", "carol", "🎉")
+	a.RemoveReaction("news", "carol", "+1")
+	g.Expect(a.Reactions("news")).To(gomega.Equal([]types.Reaction{
+		{Tag: "+1", Usernames: []string{"alice", "bob"}},
+	}))
+
+	buf := new(bytes.Buffer)
+	g.Expect(a.Persist(buf)).To(gomega.BeNil())
+	loaded := newOrSkip(t)
+	g.Expect(loaded.Populate(buf)).To(gomega.BeNil())
+	g.Expect(loaded.Reactions("news")).To(gomega.Equal(a.Reactions("news")))
+
+	// reactions from another source are combined with those already known
+	other := newOrSkip(t)
+	addOrSkip(t, other, &arbor.ChatMessage{UUID: "news", Username: "test", Content: "we shipped", Timestamp: 1})
+	g.Expect(other.AddReaction("news", "carol", "+1")).To(gomega.BeNil())
+	buf.Reset()
+	g.Expect(other.Persist(buf)).To(gomega.BeNil())
+	_, err := loaded.Merge(buf, false)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(loaded.Reactions("news")).To(gomega.Equal([]types.Reaction{
+		{Tag: "+1", Usernames: []string{"alice", "bob", "carol"}},
+	}))
+}
+
 // TestLongHistNeeded is a regression test that ensures that a very long message history with many unknown
 // parents doesn't crash the client. (github.com/arborchat/muscadine/issues/61)
 func TestLongHistNeeded(t *testing.T) {
@@ -0,0 +1,257 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+)
+
+// FutureTolerance is how far in the future a message's timestamp may be before
+// Check reports it. It allows for clocks that disagree slightly.
+const FutureTolerance = 24 * time.Hour
+
+// Severity indicates how serious a Problem is.
+type Severity int
+
+const (
+	// Warning problems are unusual but may occur in a healthy history.
+	Warning Severity = iota
+	// Error problems indicate that the history is corrupt.
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Problem is an issue discovered while checking a persisted archive.
+type Problem struct {
+	Severity
+	// Kind is a short name for the type of problem, such as "duplicate" or "cycle".
+	Kind string
+	// ID is the UUID of the message that has the problem, if there is one.
+	ID     string
+	Detail string
+}
+
+func (p Problem) String() string {
+	if p.ID == "" {
+		return fmt.Sprintf("%s: %s: %s", p.Severity, p.Kind, p.Detail)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", p.Severity, p.Kind, p.ID, p.Detail)
+}
+
+// CheckReport describes the health of a persisted archive.
+type CheckReport struct {
+	// Messages is the number of messages that could be read.
+	Messages int
+	Problems []Problem
+	// Salvaged is a new archive containing every valid message that could be read
+	// from the tree of the oldest root message, which is its root. Duplicates are
+	// omitted, keeping the first copy of each message.
+	Salvaged *Archive
+	// SalvagedMessages is the number of messages in Salvaged.
+	SalvagedMessages int
+	// Quarantined holds the messages that were left out of Salvaged because they
+	// conflict with an earlier message that has the same UUID, are in or descend from
+	// a loop of parent links, or belong to the tree of another root.
+	Quarantined *Quarantine
+}
+
+// Errors returns the number of problems that indicate corruption.
+func (r *CheckReport) Errors() int {
+	errors := 0
+	for _, problem := range r.Problems {
+		if problem.Severity == Error {
+			errors++
+		}
+	}
+	return errors
+}
+
+func (r *CheckReport) add(severity Severity, kind, id, detail string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{Severity: severity, Kind: kind, ID: id, Detail: fmt.Sprintf(detail, args...)})
+}
+
+// Check reads a persisted archive from storage and reports any problems with it. Unlike
+// Populate, it reads as many messages as it can from storage that is invalid, such
+// as a file that was truncated while it was being written. Timestamps are compared
+// to now to detect those that are far in the future.
+func Check(storage io.Reader, now time.Time) (*CheckReport, error) {
+	if storage == nil {
+		return nil, fmt.Errorf("Unable to check nil")
+	}
+	report := &CheckReport{Problems: []Problem{}, Salvaged: New(), Quarantined: &Quarantine{}}
+	messages, meta := checkDecode(storage, report)
+	report.Messages = len(messages)
+
+	byID := make(map[string]*arbor.ChatMessage)
+	valid := make([]*arbor.ChatMessage, 0, len(messages))
+	roots := make([]*arbor.ChatMessage, 0)
+	for i, message := range messages {
+		if message == nil || message.UUID == "" {
+			report.add(Error, "invalid", "", "message %d has no UUID", i)
+			continue
+		}
+		if existing, ok := byID[message.UUID]; ok {
+			if existing.Equals(message) {
+				report.add(Warning, "duplicate", message.UUID, "message appears more than once")
+			} else {
+				report.add(Error, "duplicate", message.UUID, "different messages share this UUID")
+				report.Quarantined.Add(message)
+			}
+			continue
+		}
+		byID[message.UUID] = message
+		if message.Parent == "" {
+			roots = append(roots, message)
+		}
+		if sent := time.Unix(message.Timestamp, 0); sent.After(now.Add(FutureTolerance)) {
+			report.add(Warning, "future", message.UUID, "timestamp %s is in the future", sent.UTC().Format(time.RFC3339))
+		}
+		valid = append(valid, message)
+	}
+	root := ""
+	if len(roots) > 0 {
+		ids := make([]string, 0, len(roots))
+		oldest := roots[0]
+		for _, candidate := range roots {
+			ids = append(ids, candidate.UUID)
+			if candidate.Timestamp < oldest.Timestamp {
+				oldest = candidate
+			}
+		}
+		root = oldest.UUID
+		if len(roots) > 1 {
+			sort.Strings(ids)
+			report.add(Error, "roots", "", "found %d root messages: %s", len(roots), strings.Join(ids, ", "))
+		}
+	}
+	trees, looped := checkParents(byID, report)
+	salvaged := make([]*arbor.ChatMessage, 0, len(valid))
+	for _, message := range valid {
+		if tree := trees[message.UUID]; looped[message.UUID] || (tree != "" && tree != root) {
+			report.Quarantined.Add(message)
+		} else {
+			salvaged = append(salvaged, message)
+		}
+	}
+	report.Salvaged.setMessages(salvaged)
+	report.SalvagedMessages = len(salvaged)
+	report.Salvaged.root = root
+	report.Salvaged.mergeQueries(meta.Queries)
+	return report, nil
+}
+
+// checkDecode reads as many messages as possible from storage, recording a problem if
+// it cannot read all of them.
+func checkDecode(storage io.Reader, report *CheckReport) ([]*arbor.ChatMessage, metadata) {
+	var meta metadata
+	messages := make([]*arbor.ChatMessage, 0, defaultCapacity)
+	storage, err := stripPrefix(storage)
+	if err != nil {
+		report.add(Error, "json", "", "%s", err)
+		return messages, meta
+	}
+	decoder := json.NewDecoder(storage)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		report.add(Error, "json", "", "history does not begin with a list of messages")
+		return messages, meta
+	}
+	for decoder.More() {
+		var message *arbor.ChatMessage
+		if err := decoder.Decode(&message); err != nil {
+			report.add(Error, "json", "", "unable to read message %d (the file may be truncated): %s", len(messages), err)
+			return messages, meta
+		}
+		messages = append(messages, message)
+	}
+	if _, err := decoder.Token(); err != nil {
+		report.add(Error, "json", "", "list of messages is incomplete: %s", err)
+		return messages, meta
+	}
+	if err := decoder.Decode(&meta); err != nil && err != io.EOF {
+		report.add(Warning, "json", "", "unable to read metadata after the messages: %s", err)
+	}
+	return messages, meta
+}
+
+// checkParents reports cycles in the parent links among the messages, as well as
+// parents that are missing. It returns the root of the tree that each message belongs
+// to, which is empty if a parent is missing, and the messages that are in or descend
+// from a cycle.
+func checkParents(byID map[string]*arbor.ChatMessage, report *CheckReport) (map[string]string, map[string]bool) {
+	// messages are unvisited (the zero value) until they are reached
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	trees := make(map[string]string)
+	looped := make(map[string]bool)
+	missing := make(map[string]struct{})
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	// visit messages in a consistent order so that reports are reproducible
+	sort.Strings(ids)
+	for _, id := range ids {
+		path := make([]string, 0)
+		current := id
+		tree, loop := "", false
+		for {
+			if state[current] == visited {
+				tree, loop = trees[current], looped[current]
+				break
+			} else if state[current] == visiting {
+				// we've looped back to a message on the current path
+				start := 0
+				for path[start] != current {
+					start++
+				}
+				report.add(Error, "cycle", current, "parent links form a loop: %s", strings.Join(path[start:], " -> "))
+				loop = true
+				break
+			}
+			state[current] = visiting
+			path = append(path, current)
+			parent := byID[current].Parent
+			if parent == "" {
+				tree = current
+				break
+			} else if _, ok := byID[parent]; !ok {
+				missing[parent] = struct{}{}
+				break
+			}
+			current = parent
+		}
+		for _, step := range path {
+			state[step] = visited
+			trees[step], looped[step] = tree, loop
+		}
+	}
+	if len(missing) > 0 {
+		report.add(Warning, "missing", "", "%d parent messages are not in the history", len(missing))
+	}
+	return trees, looped
+}
+
+// Check reads the manager's persistent storage and reports any problems with it. Encrypted
+// storage is decrypted first, so the Manager needs the passphrase for it.
+func (m *Manager) Check() (*CheckReport, error) {
+	file, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Check(file, time.Now())
+}
@@ -0,0 +1,90 @@
+package archive_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arborchat/muscadine/archive"
+	"github.com/onsi/gomega"
+)
+
+// problemKinds returns the kinds of the problems in the report, in order.
+func problemKinds(report *archive.CheckReport) []string {
+	kinds := []string{}
+	for _, problem := range report.Problems {
+		kinds = append(kinds, problem.Kind)
+	}
+	return kinds
+}
+
+// TestCheckHealthy checks that a normal archive has no problems.
+func TestCheckHealthy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := exportArchiveOrSkip(t)
+	buf := new(bytes.Buffer)
+	g.Expect(a.Persist(buf)).To(gomega.BeNil())
+	report, err := archive.Check(buf, time.Now())
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(report.Problems).To(gomega.BeEmpty())
+	g.Expect(report.Messages).To(gomega.Equal(4))
+	g.Expect(report.Salvaged.Last(10)).To(gomega.HaveLen(4))
+	_, err = archive.Check(nil, time.Now())
+	g.Expect(err).ToNot(gomega.BeNil())
+}
+
+// TestCheckProblems checks that each kind of corruption is detected.
+func TestCheckProblems(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	now := time.Unix(1000000, 0)
+	history := `[
+		{"UUID":"root","Parent":"","Content":"a","Username":"x","Timestamp":1},
+		{"UUID":"root2","Parent":"","Content":"b","Username":"x","Timestamp":2},
+		{"UUID":"dup","Parent":"root","Content":"c","Username":"x","Timestamp":3},
+		{"UUID":"dup","Parent":"root","Content":"c","Username":"x","Timestamp":3},
+		{"UUID":"loop1","Parent":"loop2","Content":"d","Username":"x","Timestamp":4},
+		{"UUID":"loop2","Parent":"loop1","Content":"e","Username":"x","Timestamp":5},
+		{"UUID":"orphan","Parent":"gone","Content":"f","Username":"x","Timestamp":6},
+		{"UUID":"future","Parent":"root","Content":"g","Username":"x","Timestamp":9000000},
+		null
+	]`
+	report, err := archive.Check(strings.NewReader(history), now)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(problemKinds(report)).To(gomega.Equal([]string{"duplicate", "future", "invalid", "roots", "cycle", "missing"}))
+	g.Expect(report.Errors()).To(gomega.Equal(3))
+	g.Expect(report.Problems[4].Detail).To(gomega.ContainSubstring("loop1 -> loop2"))
+	// the loop and the tree of the newer root are set aside
+	g.Expect(report.Salvaged.Last(100)).To(gomega.HaveLen(4))
+	g.Expect(report.SalvagedMessages).To(gomega.Equal(4))
+	g.Expect(report.Salvaged.Root()).To(gomega.Equal("root"))
+	quarantined := []string{}
+	for _, message := range report.Quarantined.Messages {
+		quarantined = append(quarantined, message.UUID)
+	}
+	g.Expect(quarantined).To(gomega.Equal([]string{"root2", "loop1", "loop2"}))
+}
+
+// TestCheckTruncated checks that the messages before the point at which a file was
+// truncated can be salvaged.
+func TestCheckTruncated(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := exportArchiveOrSkip(t)
+	buf := new(bytes.Buffer)
+	g.Expect(a.Persist(buf)).To(gomega.BeNil())
+	persisted := buf.Bytes()
+	// cut the file off in the middle of the final message
+	truncated := persisted[:bytes.LastIndex(persisted, []byte(`"UUID"`))+3]
+	report, err := archive.Check(bytes.NewReader(truncated), time.Now())
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(problemKinds(report)).To(gomega.ContainElement("json"))
+	g.Expect(report.Errors()).To(gomega.BeNumerically(">", 0))
+	g.Expect(report.Messages).To(gomega.Equal(3))
+
+	salvaged := new(bytes.Buffer)
+	g.Expect(report.Salvaged.Persist(salvaged)).To(gomega.BeNil())
+	restored := newOrSkip(t)
+	g.Expect(restored.Populate(salvaged)).To(gomega.BeNil())
+	g.Expect(restored.Last(10)).To(gomega.HaveLen(3))
+	g.Expect(restored.Has("root")).To(gomega.BeTrue())
+}
@@ -0,0 +1,44 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// GzipMagic is the sequence of bytes that begins every gzip stream. History that
+// begins with it is decompressed transparently when it is read.
+var GzipMagic = []byte{0x1f, 0x8b}
+
+// decompress returns a reader for the contents of storage, decompressing them if they
+// are compressed with gzip.
+func decompress(storage io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(storage)
+	magic, err := buffered.Peek(len(GzipMagic))
+	if len(magic) == 0 && err != nil {
+		return nil, fmt.Errorf("Unable to complete history prefix check: %s", err)
+	}
+	if !bytes.Equal(magic, GzipMagic) {
+		return buffered, nil
+	}
+	decompressed, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress history: %s", err)
+	}
+	return decompressed, nil
+}
+
+// persistCompressed writes the archive to storage, compressed with gzip.
+func (a *Archive) persistCompressed(storage io.Writer) error {
+	if storage == nil {
+		return fmt.Errorf("Unable to persist to nil")
+	}
+	compressor := gzip.NewWriter(storage)
+	if err := a.Persist(compressor); err != nil {
+		compressor.Close()
+		return err
+	}
+	return compressor.Close()
+}
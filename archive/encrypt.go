@@ -0,0 +1,226 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptedMagic is the sequence of bytes that begins every encrypted history file.
+// It is followed by the parameters used to derive the key from the passphrase, then
+// by the history, sealed with AES-256-GCM.
+var EncryptedMagic = []byte("muscadine-encrypted\x00")
+
+// ErrPassphraseRequired is returned when loading encrypted history without a passphrase.
+var ErrPassphraseRequired = errors.New("history file is encrypted and requires a passphrase")
+
+// ErrWrongPassphrase is returned when encrypted history cannot be decrypted with the
+// passphrase that was provided.
+var ErrWrongPassphrase = errors.New("incorrect passphrase for history file (or the file is corrupt)")
+
+const (
+	encryptionVersion = 1
+	saltSize          = 16
+	keySize           = 32
+	// these scrypt parameters are those recommended for interactive use
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+	// history encrypted with parameters above these limits is rejected, so that a
+	// corrupt or malicious header can't demand an enormous amount of memory and time
+	maxScryptLogN = scryptLogN + 3
+	maxScryptR    = scryptR * 2
+	maxScryptP    = scryptP * 4
+)
+
+// keyParams are the parameters used to derive an encryption key from a passphrase.
+// They are stored in the header of each encrypted history file.
+type keyParams struct {
+	logN, r, p byte
+	salt       [saltSize]byte
+}
+
+// header returns the beginning of an encrypted history file that uses the parameters.
+func (k keyParams) header() []byte {
+	header := append([]byte{}, EncryptedMagic...)
+	header = append(header, encryptionVersion, k.logN, k.r, k.p)
+	return append(header, k.salt[:]...)
+}
+
+// encryptionKey is a key derived from a passphrase, along with the parameters that
+// derived it.
+type encryptionKey struct {
+	keyParams
+	key []byte
+}
+
+// newKey derives a key from the passphrase with a new random salt.
+func newKey(passphrase []byte) (*encryptionKey, error) {
+	params := keyParams{logN: scryptLogN, r: scryptR, p: scryptP}
+	if _, err := io.ReadFull(rand.Reader, params.salt[:]); err != nil {
+		return nil, err
+	}
+	return deriveKey(passphrase, params)
+}
+
+// deriveKey derives a key from the passphrase with the given parameters.
+func deriveKey(passphrase []byte, params keyParams) (*encryptionKey, error) {
+	key, err := scrypt.Key(passphrase, params.salt[:], 1<<params.logN, int(params.r), int(params.p), keySize)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKey{keyParams: params, key: key}, nil
+}
+
+// aead returns the cipher that seals history with the key.
+func (k *encryptionKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext, returning the contents of an encrypted history file.
+// The header is authenticated along with the plaintext.
+func (k *encryptionKey) seal(plaintext []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	header := k.header()
+	sealed := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(sealed, nonce, plaintext, header), nil
+}
+
+// parseHeader reads the key parameters from the contents of an encrypted history file.
+// It returns them along with the length of the header.
+func parseHeader(data []byte) (keyParams, int, error) {
+	var params keyParams
+	size := len(EncryptedMagic) + 4 + saltSize
+	if len(data) < size || !bytes.HasPrefix(data, EncryptedMagic) {
+		return params, 0, fmt.Errorf("Encrypted history header is incomplete")
+	}
+	fields := data[len(EncryptedMagic):]
+	if version := fields[0]; version != encryptionVersion {
+		return params, 0, fmt.Errorf("Unsupported encrypted history version %d", version)
+	}
+	params.logN, params.r, params.p = fields[1], fields[2], fields[3]
+	if params.logN < 1 || params.logN > maxScryptLogN || params.r < 1 || params.r > maxScryptR || params.p < 1 || params.p > maxScryptP {
+		return params, 0, fmt.Errorf("Unsupported key derivation parameters in encrypted history (N=2^%d, r=%d, p=%d)", params.logN, params.r, params.p)
+	}
+	copy(params.salt[:], fields[4:])
+	return params, size, nil
+}
+
+// SetPassphrase configures the Manager to encrypt history with a key derived from the
+// passphrase each time it is saved, and to decrypt encrypted history when it is loaded.
+// A nil passphrase saves history without encryption.
+func (m *Manager) SetPassphrase(passphrase []byte) {
+	m.passphrase = passphrase
+	m.key = nil
+}
+
+// Encrypted returns whether the manager's persistent storage holds encrypted history.
+func (m *Manager) Encrypted() (bool, error) {
+	file, err := m.opener(m.path)
+	if err != nil {
+		return false, err
+	}
+	if file == nil {
+		return false, fmt.Errorf("Opener returned no error but nil file")
+	}
+	defer file.Close()
+	magic := make([]byte, len(EncryptedMagic))
+	if _, err := io.ReadFull(file, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, EncryptedMagic), nil
+}
+
+// open returns the contents of the manager's persistent storage, decrypting them if
+// they are encrypted. The caller must close it.
+func (m *Manager) open() (io.ReadCloser, error) {
+	file, err := m.opener(m.path)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("Opener returned no error but nil file")
+	}
+	buffered := bufio.NewReader(file)
+	if magic, _ := buffered.Peek(len(EncryptedMagic)); !bytes.Equal(magic, EncryptedMagic) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{buffered, file}, nil
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(buffered)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := m.decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(plaintext)), nil
+}
+
+// decrypt returns the plaintext of an encrypted history file. The key that decrypts
+// it is kept so that it can encrypt the history when it is saved.
+func (m *Manager) decrypt(data []byte) ([]byte, error) {
+	if m.passphrase == nil {
+		return nil, ErrPassphraseRequired
+	}
+	params, headerSize, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	key := m.key
+	if key == nil || key.keyParams != params {
+		if key, err = deriveKey(m.passphrase, params); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize+aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted history is truncated")
+	}
+	nonce := data[headerSize : headerSize+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[headerSize+aead.NonceSize():], data[:headerSize])
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	m.key = key
+	return plaintext, nil
+}
+
+// encrypt returns the contents of an encrypted history file holding the plaintext.
+func (m *Manager) encrypt(plaintext []byte) ([]byte, error) {
+	if m.key == nil {
+		key, err := newKey(m.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		m.key = key
+	}
+	return m.key.seal(plaintext)
+}
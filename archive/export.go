@@ -0,0 +1,235 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/signing"
+)
+
+// Format is a kind of human-readable transcript that an Archive can be exported as.
+type Format int
+
+const (
+	// Markdown transcripts show threads as nested lists.
+	Markdown Format = iota
+	// HTML transcripts are standalone pages in which each reply tree can be collapsed.
+	HTML
+	// Text transcripts show threads as indented plain text.
+	Text
+)
+
+// formatNames maps the name of each Format to its value.
+var formatNames = map[string]Format{
+	"markdown": Markdown,
+	"md":       Markdown,
+	"html":     HTML,
+	"text":     Text,
+	"txt":      Text,
+}
+
+// ParseFormat returns the Format with the given name, such as "markdown", "html", or "text".
+func ParseFormat(name string) (Format, error) {
+	format, ok := formatNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown export format \"%s\"", name)
+	}
+	return format, nil
+}
+
+// ExportFilter selects the messages that are included in an export. The zero value
+// includes every message.
+type ExportFilter struct {
+	// Root is the id of the message whose subtree is exported. If it is empty, every
+	// thread is exported.
+	Root string
+	// Since and Until bound the timestamps of exported messages. Zero values leave
+	// the range unbounded.
+	Since, Until time.Time
+	// Users restricts the export to messages sent by these users. If it is empty,
+	// messages from everyone are exported.
+	Users []string
+}
+
+// matches returns whether the message should be exported.
+func (f ExportFilter) matches(message *arbor.ChatMessage) bool {
+	sent := time.Unix(message.Timestamp, 0)
+	if !f.Since.IsZero() && sent.Before(f.Since) {
+		return false
+	} else if !f.Until.IsZero() && sent.After(f.Until) {
+		return false
+	}
+	if len(f.Users) == 0 {
+		return true
+	}
+	for _, user := range f.Users {
+		if user == message.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// exportNode is a message within the reply tree of an export.
+type exportNode struct {
+	*arbor.ChatMessage
+	// Content is the content of the message without its signature.
+	Content  string
+	Children []*exportNode
+}
+
+// Time returns the time at which the message was sent, in UTC so that transcripts
+// don't depend upon where they were exported.
+func (n *exportNode) Time() string {
+	return time.Unix(n.Timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+// exportTree arranges the messages selected by the filter into reply trees, ordered
+// chronologically. A message whose parent is not selected is attached to its nearest
+// selected ancestor, or becomes the top of a tree if it has none.
+func (a *Archive) exportTree(filter ExportFilter) ([]*exportNode, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	children := make(map[string][]*arbor.ChatMessage)
+	tops := make([]*arbor.ChatMessage, 0)
+	for _, message := range a.chronological {
+		if message.Parent == "" || !a.has(message.Parent) {
+			tops = append(tops, message)
+		} else {
+			children[message.Parent] = append(children[message.Parent], message)
+		}
+	}
+	if filter.Root != "" {
+		root := a.get(filter.Root)
+		if root == nil {
+			return nil, fmt.Errorf("No known message with id \"%s\"", filter.Root)
+		}
+		tops = []*arbor.ChatMessage{root}
+	}
+	// visited guards against cycles in corrupt archives
+	visited := make(map[string]struct{})
+	var build func(messages []*arbor.ChatMessage) []*exportNode
+	build = func(messages []*arbor.ChatMessage) []*exportNode {
+		nodes := make([]*exportNode, 0, len(messages))
+		for _, message := range messages {
+			if _, ok := visited[message.UUID]; ok {
+				continue
+			}
+			visited[message.UUID] = struct{}{}
+			descendants := build(children[message.UUID])
+			if filter.matches(message) {
+				nodes = append(nodes, &exportNode{ChatMessage: message, Content: signing.Strip(message.Content), Children: descendants})
+			} else {
+				nodes = append(nodes, descendants...)
+			}
+		}
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].Timestamp < nodes[j].Timestamp
+		})
+		return nodes
+	}
+	return build(tops), nil
+}
+
+// Export writes the messages selected by the filter to the provided io.Writer as a
+// threaded transcript in the given format.
+func (a *Archive) Export(w io.Writer, format Format, filter ExportFilter) error {
+	if w == nil {
+		return fmt.Errorf("Unable to export to nil")
+	}
+	nodes, err := a.exportTree(filter)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case Markdown:
+		return writeIndented(w, nodes, markdownLine, escapeMarkdown)
+	case Text:
+		return writeIndented(w, nodes, textLine, func(content string) string { return content })
+	case HTML:
+		return htmlTranscript.Execute(w, nodes)
+	}
+	return fmt.Errorf("Unknown export format %d", format)
+}
+
+// markdownLine formats a message as a Markdown list item nested to the given depth.
+// It returns the prefix of the first line, and the prefix of any subsequent lines.
+func markdownLine(node *exportNode, depth int) (string, string) {
+	indent := strings.Repeat("  ", depth)
+	return fmt.Sprintf("%s- **%s** (%s): ", indent, escapeMarkdown(node.Username), node.Time()), indent + "  "
+}
+
+// markdownSpecial holds the characters that Markdown may interpret as formatting.
+const markdownSpecial = "\\`*_{}[]()#+-.!|<>~"
+
+// escapeMarkdown escapes every character of the text that Markdown may interpret as
+// formatting, so that messages can't inject headings, links, or markup.
+func escapeMarkdown(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(markdownSpecial, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// textLine formats a message as plain text nested to the given depth. It returns the
+// prefix of the first line, and the prefix of any subsequent lines.
+func textLine(node *exportNode, depth int) (string, string) {
+	indent := strings.Repeat("    ", depth)
+	first := fmt.Sprintf("%s[%s] %s: ", indent, node.Time(), node.Username)
+	return first, indent + strings.Repeat(" ", len(first)-len(indent))
+}
+
+// writeIndented writes each message in the trees on its own line, with replies nested
+// beneath their parents. The prefix function determines how each message's lines begin,
+// and the escape function prepares each line of content for the format.
+func writeIndented(w io.Writer, nodes []*exportNode, prefix func(*exportNode, int) (string, string), escape func(string) string) error {
+	buf := bufio.NewWriter(w)
+	var write func(nodes []*exportNode, depth int)
+	write = func(nodes []*exportNode, depth int) {
+		for _, node := range nodes {
+			first, rest := prefix(node, depth)
+			lines := strings.Split(node.Content, "\n")
+			buf.WriteString(first + escape(lines[0]) + "\n")
+			for _, line := range lines[1:] {
+				buf.WriteString(rest + escape(line) + "\n")
+			}
+			write(node.Children, depth+1)
+		}
+	}
+	write(nodes, 0)
+	return buf.Flush()
+}
+
+// htmlTranscript renders reply trees as a standalone HTML page.
+var htmlTranscript = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Arbor transcript</title>
+<style>
+body { font-family: sans-serif; }
+details { margin-left: 1.5em; }
+summary { cursor: pointer; }
+.time { color: #777; font-size: smaller; }
+.content { white-space: pre-wrap; margin: 0.2em 0 0.2em 1.5em; }
+</style>
+</head>
+<body>
+{{range .}}{{template "message" .}}{{end}}
+</body>
+</html>
+{{define "message"}}<details open id="{{.UUID}}">
+<summary><strong>{{.Username}}</strong> <span class="time">{{.Time}}</span></summary>
+<div class="content">{{.Content}}</div>
+{{range .Children}}{{template "message" .}}{{end}}</details>
+{{end}}`))
@@ -0,0 +1,120 @@
+package archive_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/signing"
+	"github.com/onsi/gomega"
+)
+
+// exportArchiveOrSkip creates an archive containing a small conversation:
+//
+//	root (alice)
+//	├── reply (bob)
+//	│   └── nested (alice)
+//	└── other (carol)
+func exportArchiveOrSkip(t *testing.T) *archive.Archive {
+	a := newOrSkip(t)
+	for _, m := range []*arbor.ChatMessage{
+		{UUID: "root", Username: "alice", Content: "hello", Timestamp: 100},
+		{UUID: "reply", Parent: "root", Username: "bob", Content: "hi\nthere", Timestamp: 200},
+		{UUID: "nested", Parent: "reply", Username: "alice", Content: "<b>bold</b>", Timestamp: 300},
+		{UUID: "other", Parent: "root", Username: "carol", Content: "hey", Timestamp: 250},
+	} {
+		addOrSkip(t, a, m)
+	}
+	return a
+}
+
+func exportString(t *testing.T, a *archive.Archive, format archive.Format, filter archive.ExportFilter) string {
+	buf := new(bytes.Buffer)
+	if err := a.Export(buf, format, filter); err != nil {
+		t.Fatal("Export failed", err)
+	}
+	return buf.String()
+}
+
+// TestParseFormat checks that export formats can be chosen by name.
+func TestParseFormat(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for name, expected := range map[string]archive.Format{"markdown": archive.Markdown, "HTML": archive.HTML, "txt": archive.Text} {
+		format, err := archive.ParseFormat(name)
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(format).To(gomega.Equal(expected))
+	}
+	_, err := archive.ParseFormat("pdf")
+	g.Expect(err).ToNot(gomega.BeNil())
+}
+
+// TestExport checks that each format nests replies beneath their parents in
+// chronological order.
+func TestExport(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := exportArchiveOrSkip(t)
+	g.Expect(exportString(t, a, archive.Markdown, archive.ExportFilter{})).To(gomega.Equal(
+		"- **alice** (1970-01-01T00:01:40Z): hello\n" +
+			"  - **bob** (1970-01-01T00:03:20Z): hi\n" +
+			"    there\n" +
+			"    - **alice** (1970-01-01T00:05:00Z): \\<b\\>bold\\</b\\>\n" +
+			"  - **carol** (1970-01-01T00:04:10Z): hey\n"))
+	g.Expect(exportString(t, a, archive.Text, archive.ExportFilter{})).To(gomega.Equal(
+		"[1970-01-01T00:01:40Z] alice: hello\n" +
+			"    [1970-01-01T00:03:20Z] bob: hi\n" +
+			strings.Repeat(" ", 32) + "there\n" +
+			"        [1970-01-01T00:05:00Z] alice: <b>bold</b>\n" +
+			"    [1970-01-01T00:04:10Z] carol: hey\n"))
+	page := exportString(t, a, archive.HTML, archive.ExportFilter{})
+	g.Expect(page).To(gomega.HavePrefix("<!DOCTYPE html>"))
+	g.Expect(strings.Count(page, "<details")).To(gomega.Equal(4))
+	g.Expect(page).To(gomega.ContainSubstring("&lt;b&gt;bold&lt;/b&gt;"))
+	g.Expect(strings.Index(page, `id="nested"`)).To(gomega.BeNumerically("<", strings.Index(page, `id="other"`)))
+}
+
+// TestExportMarkdownEscaping checks that message content can't add formatting to a
+// Markdown transcript.
+func TestExportMarkdownEscaping(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := newOrSkip(t)
+	addOrSkip(t, a, &arbor.ChatMessage{UUID: "root", Username: "*mallory*", Content: "# Title\n[link](http://example.com) 1. item", Timestamp: 100})
+	g.Expect(exportString(t, a, archive.Markdown, archive.ExportFilter{})).To(gomega.Equal(
+		"- **\\*mallory\\*** (1970-01-01T00:01:40Z): \\# Title\n" +
+			"  \\[link\\]\\(http://example\\.com\\) 1\\. item\n"))
+}
+
+// TestExportSigned checks that signatures are left out of every format.
+func TestExportSigned(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := newOrSkip(t)
+	signed := "hello" + signing.SignaturePrefix + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=:c2lnbmF0dXJl"
+	addOrSkip(t, a, &arbor.ChatMessage{UUID: "root", Username: "alice", Content: signed, Timestamp: 100})
+	for _, format := range []archive.Format{archive.Markdown, archive.HTML, archive.Text} {
+		transcript := exportString(t, a, format, archive.ExportFilter{})
+		g.Expect(transcript).To(gomega.ContainSubstring("hello"))
+		g.Expect(transcript).ToNot(gomega.ContainSubstring("ed25519"))
+	}
+}
+
+// TestExportFilter checks that exports can be limited to a subtree, a time range,
+// and particular users.
+func TestExportFilter(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := exportArchiveOrSkip(t)
+	g.Expect(exportString(t, a, archive.Markdown, archive.ExportFilter{Root: "reply"})).To(gomega.Equal(
+		"- **bob** (1970-01-01T00:03:20Z): hi\n" +
+			"  there\n" +
+			"  - **alice** (1970-01-01T00:05:00Z): \\<b\\>bold\\</b\\>\n"))
+	g.Expect(exportString(t, a, archive.Markdown, archive.ExportFilter{Users: []string{"alice"}})).To(gomega.Equal(
+		"- **alice** (1970-01-01T00:01:40Z): hello\n" +
+			"  - **alice** (1970-01-01T00:05:00Z): \\<b\\>bold\\</b\\>\n"))
+	g.Expect(exportString(t, a, archive.Markdown, archive.ExportFilter{Since: time.Unix(200, 0), Until: time.Unix(260, 0)})).To(gomega.Equal(
+		"- **bob** (1970-01-01T00:03:20Z): hi\n" +
+			"  there\n" +
+			"- **carol** (1970-01-01T00:04:10Z): hey\n"))
+	g.Expect(a.Export(new(bytes.Buffer), archive.Markdown, archive.ExportFilter{Root: "unknown"})).ToNot(gomega.BeNil())
+	g.Expect(a.Export(nil, archive.Markdown, archive.ExportFilter{})).ToNot(gomega.BeNil())
+}
@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned when another process is using a history file.
+var ErrLocked = errors.New("history file is in use by another process")
+
+// ErrReadOnly is returned when saving a history file that was opened read-only.
+var ErrReadOnly = errors.New("history file was opened read-only")
+
+// lockPath returns the path of the file used to lock the history file at the given path.
+// The history file itself can't be locked, since it is replaced each time it is saved.
+func lockPath(histPath string) string {
+	return histPath + ".lock"
+}
+
+// Lock takes an advisory lock on the manager's history file so that other instances
+// of the program do not overwrite it. It returns an error wrapping ErrLocked if
+// another process holds the lock. Call Unlock to release it. Locking a history file
+// that is already locked by this Manager does nothing.
+func (m *Manager) Lock() error {
+	if m.lock != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+	file, err := openLockFile(lockPath(m.path))
+	if err == nil {
+		err = lockFile(file)
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err == ErrLocked {
+		return &LockedError{Path: m.path, PID: lockHolder(lockPath(m.path))}
+	} else if err != nil {
+		return err
+	}
+	// record who holds the lock for the benefit of anyone else who wants it
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	m.lock = file
+	return nil
+}
+
+// Unlock releases the lock taken by Lock.
+func (m *Manager) Unlock() error {
+	if m.lock == nil {
+		return nil
+	}
+	err := m.lock.Close()
+	m.lock = nil
+	return err
+}
+
+// LockedError describes a history file that is locked by another process.
+type LockedError struct {
+	Path string
+	// PID is the process ID of the lock holder, or 0 if it is unknown.
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, ErrLocked)
+	}
+	return fmt.Sprintf("%s: %s (pid %d)", e.Path, ErrLocked, e.PID)
+}
+
+// IsLocked returns whether the error indicates that a history file is locked.
+func IsLocked(err error) bool {
+	if err == ErrLocked {
+		return true
+	}
+	_, ok := err.(*LockedError)
+	return ok
+}
+
+// lockHolder returns the process ID recorded in a lock file, or 0 if it can't be read.
+func lockHolder(lockPath string) int {
+	contents, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// SetReadOnly configures whether the manager may save its history. A read-only
+// manager can be used alongside another process that holds the lock.
+func (m *Manager) SetReadOnly(readOnly bool) {
+	m.readOnly = readOnly
+}
+
+// ReadOnly returns whether the manager refuses to save its history.
+func (m *Manager) ReadOnly() bool {
+	return m.readOnly
+}
@@ -0,0 +1,15 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package archive
+
+import "os"
+
+// lockFile does nothing, since advisory locks are not supported on this platform.
+func lockFile(file *os.File) error {
+	return nil
+}
+
+// openLockFile opens the file used to hold a lock.
+func openLockFile(lockPath string) (*os.File, error) {
+	return os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+}
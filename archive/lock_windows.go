@@ -0,0 +1,31 @@
+package archive
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is the Windows error code for a file that is open elsewhere
+// in a way that prevents it from being opened again.
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile does nothing, since the file was locked when it was opened.
+func lockFile(file *os.File) error {
+	return nil
+}
+
+// openLockFile opens the file used to hold a lock without allowing it to be opened
+// by anyone else until it is closed. It returns ErrLocked if it is already open.
+func openLockFile(lockPath string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), lockPath), nil
+}
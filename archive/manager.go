@@ -1,10 +1,15 @@
 package archive
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 )
 
 // Manager facilitates populating an Archive from a persistent data store and
@@ -13,8 +18,34 @@ type Manager struct {
 	*Archive
 	path   string
 	opener Opener
+	// fileBacked is true unless a custom Opener has been set. Saves to files are
+	// atomic and keep backups.
+	fileBacked bool
+	// backups is the number of previous versions of the file that are kept.
+	backups  int
+	readOnly bool
+	// retention limits the history that is kept when it is saved, and lastPrune is
+	// when it was last applied
+	retention Retention
+	lastPrune time.Time
+	// compress is whether history is compressed with gzip when it is saved, and
+	// compressSet is whether SetCompression chose it
+	compress, compressSet bool
+	// passphrase encrypts the history if it is not nil, using a key derived from it
+	passphrase []byte
+	key        *encryptionKey
+	// lock is the open lock file, if the Manager holds the lock
+	lock *os.File
 }
 
+// DefaultBackups is the number of previous versions of a history file that are kept
+// by default.
+const DefaultBackups = 2
+
+// PruneInterval is the minimum time between the prunes done by Save. Pruning examines
+// every message, so it is skipped by saves made soon after the last one.
+const PruneInterval = 10 * time.Minute
+
 // Opener transforms a path into a readable, writable, closable file-like entity.
 type Opener func(string) (io.ReadWriteCloser, error)
 
@@ -42,37 +73,105 @@ func NewManager(path string) (*Manager, error) {
 		return nil, fmt.Errorf("Path may not be the empty string")
 	}
 	return &Manager{
-		Archive: New(),
-		path:    path,
-		opener:  OpenFile,
+		Archive:    New(),
+		path:       path,
+		opener:     OpenFile,
+		fileBacked: true,
+		backups:    DefaultBackups,
 	}, nil
 }
 
-// SetOpener configures the Manager to open its path with the given Opener function
+// SetOpener configures the Manager to open its path with the given Opener function.
+// Saves made with a custom Opener are neither atomic nor backed up.
 func (m *Manager) SetOpener(o Opener) error {
 	if o == nil {
 		return fmt.Errorf("Cannot set nil opener")
 	}
 	m.opener = o
+	m.fileBacked = false
 	return nil
 }
 
+// SetBackups changes the number of previous versions of the history file that are kept
+// when it is saved. The most recent is named like the history file with ".bak.1"
+// appended, the next ".bak.2", and so on.
+func (m *Manager) SetBackups(n int) {
+	m.backups = n
+}
+
+// SetCompression configures whether the Manager compresses history with gzip when it
+// saves it. By default, history is only compressed if it was compressed when it was
+// loaded, since older versions of Muscadine can't read compressed history. History is
+// read correctly whether or not it is compressed, so changing this converts the
+// existing history the next time that it is saved.
+func (m *Manager) SetCompression(compress bool) {
+	m.compress = compress
+	m.compressSet = true
+}
+
+// persist writes the archive to storage, compressing and encrypting it if configured to.
+func (m *Manager) persist(storage io.Writer) error {
+	if m.passphrase == nil {
+		return m.encode(storage)
+	}
+	plaintext := new(bytes.Buffer)
+	if err := m.encode(plaintext); err != nil {
+		return err
+	}
+	sealed, err := m.encrypt(plaintext.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = storage.Write(sealed)
+	return err
+}
+
+// encode writes the archive to storage, compressing it if configured to.
+func (m *Manager) encode(storage io.Writer) error {
+	if m.compress {
+		return m.Archive.persistCompressed(storage)
+	}
+	return m.Archive.Persist(storage)
+}
+
+// SetRetention configures the Manager to prune the archive according to the policy
+// when it is saved, at most once every PruneInterval. The zero Retention, which is the
+// default, keeps everything.
+func (m *Manager) SetRetention(policy Retention) {
+	m.retention = policy
+}
+
 // Load loads the managed archive with content from the manager's configured
 // persistent storage.
 func (m *Manager) Load() error {
-	file, err := m.opener(m.path)
+	file, err := m.open()
 	if err != nil {
 		return err
 	}
-	if file == nil {
-		return fmt.Errorf("Opener returned no error but nil file")
-	}
 	defer file.Close()
-	return m.Archive.Populate(file)
+	buffered := bufio.NewReader(file)
+	if magic, _ := buffered.Peek(len(GzipMagic)); !m.compressSet && bytes.Equal(magic, GzipMagic) {
+		m.compress = true
+	}
+	return m.Archive.Populate(buffered)
 }
 
 // Save stores the managed archive's state into the configured persistent storage.
+// A history file is never left partially written: the new history is written to a
+// temporary file that replaces the old one only once it is complete. If a retention
+// policy is set, the archive is pruned before it is saved, unless it was pruned within
+// the last PruneInterval.
 func (m *Manager) Save() error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if now := time.Now(); !m.retention.IsZero() && now.Sub(m.lastPrune) >= PruneInterval {
+		m.Archive.Prune(m.retention, now, false)
+		m.lastPrune = now
+	}
+	if m.fileBacked {
+		return m.saveFile()
+	}
 	file, err := m.opener(m.path)
 	if err != nil {
 		return err
@@ -81,5 +180,98 @@ func (m *Manager) Save() error {
 		return fmt.Errorf("Opener returned no error but nil file")
 	}
 	defer file.Close()
-	return m.Archive.Persist(file)
+	return m.persist(file)
+}
+
+// backupPath returns the path of the nth most recent backup of the history file.
+func (m *Manager) backupPath(n int) string {
+	return fmt.Sprintf("%s.bak.%d", m.path, n)
+}
+
+// saveFile atomically replaces the history file with the archive's current contents.
+func (m *Manager) saveFile() error {
+	dir := filepath.Dir(m.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(dir, filepath.Base(m.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// this fails harmlessly once the temporary file has been renamed
+	defer os.Remove(temp.Name())
+	if err := m.persist(temp); err != nil {
+		temp.Close()
+		return err
+	}
+	// ensure the data is on disk before it replaces the old history
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := m.rotateBackups(); err != nil {
+		return fmt.Errorf("Unable to back up %s: %s", m.path, err)
+	}
+	return os.Rename(temp.Name(), m.path)
+}
+
+// rotateBackups shifts each backup of the history file back by one, then makes the
+// current history file the most recent backup.
+func (m *Manager) rotateBackups() error {
+	if m.backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(m.path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Remove(m.backupPath(m.backups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := m.backups - 1; i >= 1; i-- {
+		if err := os.Rename(m.backupPath(i), m.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// a hard link preserves the current file without copying it, even once the
+	// history file is replaced
+	if err := os.Link(m.path, m.backupPath(1)); err == nil {
+		return nil
+	}
+	return copyFile(m.path, m.backupPath(1))
+}
+
+// RemoveBackups deletes the backups of the history file, such as when they hold
+// history that should no longer be readable.
+func (m *Manager) RemoveBackups() error {
+	backups, err := filepath.Glob(m.path + ".bak.*")
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file at src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
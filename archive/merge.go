@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	arbor "github.com/arborchat/arbor-go"
+)
+
+// Conflict is a pair of different messages that claim the same ID.
+type Conflict struct {
+	// Existing is the message that was already in the archive, and Incoming is the
+	// one that was being merged into it.
+	Existing, Incoming *arbor.ChatMessage
+}
+
+// MergeReport describes the outcome of merging messages from another source into
+// an archive.
+type MergeReport struct {
+	// Added holds the IDs of the messages that were added to the archive.
+	Added []string
+	// Duplicates is the number of incoming messages that were already in the archive.
+	Duplicates int
+	// Conflicts holds the incoming messages whose IDs were already used by different
+	// messages. They are never added to the archive.
+	Conflicts []Conflict
+}
+
+// Merge adds the messages from storage, which must be in the format written by Persist,
+// to the archive and reports what happened to each of them. If quarantine is false,
+// a single conflicting message causes every message from storage to be rejected,
+// just as in Populate. Otherwise the conflicting messages are set aside in the report
+// and the rest are added. The revisions of and reactions to messages in storage are
+// merged as well.
+// Unlike Populate, Merge ignores the query records in storage, since they describe the
+// attempts of another client.
+func (a *Archive) Merge(storage io.Reader, quarantine bool) (*MergeReport, error) {
+	if storage == nil {
+		return nil, fmt.Errorf("Unable to merge from nil")
+	}
+	incoming, meta, err := decode(storage)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	report := &MergeReport{Added: []string{}, Conflicts: []Conflict{}}
+	// pending holds the messages that will be added, so that the source cannot
+	// conflict with itself unnoticed
+	pending := make(map[string]*arbor.ChatMessage)
+	toAdd := make([]*arbor.ChatMessage, 0, len(incoming))
+	for _, message := range incoming {
+		if message == nil {
+			continue
+		}
+		existing := a.get(message.UUID)
+		if existing == nil {
+			existing = pending[message.UUID]
+		}
+		if existing == nil {
+			pending[message.UUID] = message
+			toAdd = append(toAdd, message)
+		} else if existing.Equals(message) {
+			report.Duplicates++
+		} else {
+			report.Conflicts = append(report.Conflicts, Conflict{Existing: existing, Incoming: message})
+		}
+	}
+	if len(report.Conflicts) > 0 && !quarantine {
+		return report, fmt.Errorf("Rejected all messages because of %d ID collisions, first with UUID \"%s\"", len(report.Conflicts), report.Conflicts[0].Incoming.UUID)
+	}
+	// adding the messages one by one would sort the archive after each of them
+	messages := make([]*arbor.ChatMessage, 0, len(a.chronological)+len(toAdd))
+	messages = append(messages, a.chronological...)
+	for _, message := range toAdd {
+		messageCopy := *message
+		messages = append(messages, &messageCopy)
+		delete(a.queries, message.UUID)
+		if a.root == "" && message.Parent == "" {
+			a.root = message.UUID
+		}
+		report.Added = append(report.Added, message.UUID)
+	}
+	a.setMessages(messages)
+	a.childCache = make(map[string][]string)
+	a.mergeRevisions(meta.Revisions)
+	a.mergeReactions(meta.Reactions)
+	return report, nil
+}
+
+// Quarantine holds messages that were set aside because they conflict with others.
+// Unlike an Archive, it keeps every distinct version of a message, even when several
+// share the same ID. Since such files can't be loaded as history, the messages are only
+// meant to be inspected.
+type Quarantine struct {
+	Messages []*arbor.ChatMessage
+}
+
+// Add adds the message to the quarantine unless an identical message is already there.
+func (q *Quarantine) Add(message *arbor.ChatMessage) {
+	for _, existing := range q.Messages {
+		if existing.Equals(message) {
+			return
+		}
+	}
+	messageCopy := *message
+	q.Messages = append(q.Messages, &messageCopy)
+}
+
+// Load adds the messages from storage, which may have been written by Persist or by
+// Archive.Persist, to the quarantine.
+func (q *Quarantine) Load(storage io.Reader) error {
+	messages, _, err := decode(storage)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if message != nil {
+			q.Add(message)
+		}
+	}
+	return nil
+}
+
+// Persist writes the quarantined messages to storage as a JSON array.
+func (q *Quarantine) Persist(storage io.Writer) error {
+	messages := q.Messages
+	if messages == nil {
+		messages = []*arbor.ChatMessage{}
+	}
+	return json.NewEncoder(storage).Encode(messages)
+}
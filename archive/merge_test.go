@@ -0,0 +1,90 @@
+package archive_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/onsi/gomega"
+)
+
+// TestMerge checks that merging reports added, duplicate, and conflicting messages,
+// and that conflicts reject the source unless they are quarantined.
+func TestMerge(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ours := &arbor.ChatMessage{UUID: "shared", Username: "alice", Content: "hello", Timestamp: 1}
+	theirs := *ours
+	theirs.Content = "goodbye"
+	newMessage := &arbor.ChatMessage{UUID: "new", Parent: "shared", Username: "bob", Content: "hi", Timestamp: 2}
+	duplicate := *ours
+
+	a := newOrSkip(t)
+	addOrSkip(t, a, ours)
+	_, err := a.Merge(nil, false)
+	g.Expect(err).ToNot(gomega.BeNil())
+
+	report, err := a.Merge(persistOrSkip(t, newMessage), false)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(report.Added).To(gomega.Equal([]string{"new"}))
+	g.Expect(report.Conflicts).To(gomega.BeEmpty())
+	g.Expect(a.Has("new")).To(gomega.BeTrue())
+
+	conflicting := newOrSkip(t)
+	addOrSkip(t, conflicting, &theirs)
+	addOrSkip(t, conflicting, &arbor.ChatMessage{UUID: "other", Username: "carol", Content: "hey", Timestamp: 3})
+	addOrSkip(t, conflicting, newMessage)
+	source := func() io.Reader {
+		buf := new(bytes.Buffer)
+		if err := conflicting.Persist(buf); err != nil {
+			t.Skip("Unable to persist into buffer", err)
+		}
+		return buf
+	}
+
+	report, err = a.Merge(source(), false)
+	g.Expect(err).ToNot(gomega.BeNil())
+	g.Expect(report.Conflicts).To(gomega.HaveLen(1))
+	g.Expect(a.Has("other")).To(gomega.BeFalse())
+
+	report, err = a.Merge(source(), true)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(report.Added).To(gomega.Equal([]string{"other"}))
+	g.Expect(report.Duplicates).To(gomega.Equal(1))
+	g.Expect(report.Conflicts).To(gomega.HaveLen(1))
+	g.Expect(report.Conflicts[0].Existing.Content).To(gomega.Equal("hello"))
+	g.Expect(report.Conflicts[0].Incoming.Content).To(gomega.Equal("goodbye"))
+	g.Expect(a.Get("shared").Content).To(gomega.Equal("hello"))
+	g.Expect(a.Has("other")).To(gomega.BeTrue())
+
+	report, err = a.Merge(persistOrSkip(t, &duplicate), false)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(report.Added).To(gomega.BeEmpty())
+	g.Expect(report.Duplicates).To(gomega.Equal(1))
+}
+
+// TestQuarantine checks that a Quarantine keeps every distinct version of a message and
+// reads back what it writes.
+func TestQuarantine(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	first := &arbor.ChatMessage{UUID: "shared", Username: "mallory", Content: "forged", Timestamp: 1}
+	second := *first
+	second.Content = "forged again"
+	q := &archive.Quarantine{}
+	q.Add(first)
+	q.Add(&second)
+	q.Add(first)
+	g.Expect(q.Messages).To(gomega.HaveLen(2))
+
+	buf := new(bytes.Buffer)
+	g.Expect(q.Persist(buf)).To(gomega.BeNil())
+	loaded := &archive.Quarantine{}
+	g.Expect(loaded.Load(buf)).To(gomega.BeNil())
+	g.Expect(loaded.Messages).To(gomega.HaveLen(2))
+	g.Expect(loaded.Messages[1].Content).To(gomega.Equal("forged again"))
+
+	// quarantine files written as archives are still readable
+	g.Expect(loaded.Load(persistOrSkip(t, first))).To(gomega.BeNil())
+	g.Expect(loaded.Messages).To(gomega.HaveLen(2))
+}
@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/arborchat/muscadine/types"
+)
+
+// reactionStore maps the ID of each message to the tags that users reacted to it with,
+// and each tag to the sorted names of those users.
+type reactionStore map[string]map[string][]string
+
+// add records the user's reaction, unless it is already known.
+func (s reactionStore) add(id, username, tag string) {
+	tags, ok := s[id]
+	if !ok {
+		tags = make(map[string][]string)
+		s[id] = tags
+	}
+	usernames := tags[tag]
+	i := sort.SearchStrings(usernames, username)
+	if i < len(usernames) && usernames[i] == username {
+		return
+	}
+	usernames = append(usernames, "")
+	copy(usernames[i+1:], usernames[i:])
+	usernames[i] = username
+	tags[tag] = usernames
+}
+
+// remove forgets the user's reaction, if it is known.
+func (s reactionStore) remove(id, username, tag string) {
+	usernames := s[id][tag]
+	i := sort.SearchStrings(usernames, username)
+	if i >= len(usernames) || usernames[i] != username {
+		return
+	}
+	usernames = append(usernames[:i:i], usernames[i+1:]...)
+	if len(usernames) > 0 {
+		s[id][tag] = usernames
+		return
+	}
+	delete(s[id], tag)
+	if len(s[id]) == 0 {
+		delete(s, id)
+	}
+}
+
+// summary returns the reactions to the message, most popular first. Tags with the same
+// number of users are sorted by name.
+func (s reactionStore) summary(id string) []types.Reaction {
+	tags := s[id]
+	if len(tags) == 0 {
+		return nil
+	}
+	reactions := make([]types.Reaction, 0, len(tags))
+	for tag, usernames := range tags {
+		reactions = append(reactions, types.Reaction{Tag: tag, Usernames: append([]string{}, usernames...)})
+	}
+	sort.Slice(reactions, func(i, j int) bool {
+		if len(reactions[i].Usernames) != len(reactions[j].Usernames) {
+			return len(reactions[i].Usernames) > len(reactions[j].Usernames)
+		}
+		return reactions[i].Tag < reactions[j].Tag
+	})
+	return reactions
+}
+
+// AddReaction records that the user reacted to the message with the given ID using the
+// tag. It is an error to react to a message that isn't in the archive.
+func (a *Archive) AddReaction(id, username, tag string) error {
+	if username == "" || tag == "" {
+		return fmt.Errorf("Invalid username (%s) or reaction (%s)", username, tag)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.has(id) {
+		return fmt.Errorf("Unable to react to missing message %s", id)
+	}
+	a.reactions.add(id, username, tag)
+	return nil
+}
+
+// RemoveReaction forgets that the user reacted to the message with the given ID using
+// the tag. Removing an unknown reaction has no effect.
+func (a *Archive) RemoveReaction(id, username, tag string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.reactions.remove(id, username, tag)
+}
+
+// Reactions returns the reactions to the message with the given ID, most popular first.
+func (a *Archive) Reactions(id string) []types.Reaction {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.reactions.summary(id)
+}
+
+// mergeReactions combines the provided reactions with those already known, discarding
+// reactions to messages that are missing. The caller must hold the archive's write
+// lock.
+func (a *Archive) mergeReactions(reactions reactionStore) {
+	for id, tags := range reactions {
+		if !a.has(id) {
+			continue
+		}
+		for tag, usernames := range tags {
+			for _, username := range usernames {
+				if username != "" && tag != "" {
+					a.reactions.add(id, username, tag)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package archive
+
+import (
+	"encoding/json"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+)
+
+// Retention is a policy that limits how much history is kept. Each limit that is zero
+// is ignored. The limits choose which messages are retained, but the ancestors of those
+// messages and the root message are always kept as well so that every thread remains
+// intact. As a result, the history may exceed the limits slightly.
+type Retention struct {
+	// MaxAge is how long messages are retained after they are sent.
+	MaxAge time.Duration
+	// MaxCount is the number of most recent messages to retain.
+	MaxCount int
+	// MaxSize is the approximate number of bytes of persisted messages to retain. The
+	// most recent messages are retained first.
+	MaxSize int64
+}
+
+// IsZero returns whether the policy retains everything.
+func (r Retention) IsZero() bool {
+	return r.MaxAge <= 0 && r.MaxCount <= 0 && r.MaxSize <= 0
+}
+
+// PruneReport describes the messages removed by pruning.
+type PruneReport struct {
+	// Removed holds the messages that were (or would be) removed, in chronological order.
+	Removed []*arbor.ChatMessage
+	// Kept is the number of messages that remain.
+	Kept int
+}
+
+// Prune removes the messages that the policy does not retain, comparing their ages to
+// now. Messages are only ever removed along with all of their replies. If dryRun is
+// true, the report describes what would be removed without changing the archive.
+func (a *Archive) Prune(policy Retention, now time.Time, dryRun bool) *PruneReport {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	report := &PruneReport{Removed: []*arbor.ChatMessage{}, Kept: len(a.chronological)}
+	if policy.IsZero() {
+		return report
+	}
+	keep := a.retained(policy, now)
+	kept := make([]*arbor.ChatMessage, 0, len(keep))
+	for _, message := range a.chronological {
+		if _, ok := keep[message.UUID]; ok {
+			kept = append(kept, message)
+		} else {
+			report.Removed = append(report.Removed, message)
+		}
+	}
+	report.Kept = len(kept)
+	if dryRun || len(report.Removed) == 0 {
+		return report
+	}
+	a.setMessages(kept)
+	a.childCache = make(map[string][]string)
+	if _, ok := keep[a.root]; !ok {
+		a.root = ""
+	}
+	// forget the queries for messages that are no longer referenced
+	referenced := make(map[string]struct{})
+	for _, message := range kept {
+		referenced[message.Parent] = struct{}{}
+	}
+	for id := range a.queries {
+		if _, ok := referenced[id]; !ok {
+			delete(a.queries, id)
+		}
+	}
+	for id := range a.revisions {
+		if _, ok := keep[id]; !ok {
+			delete(a.revisions, id)
+		}
+	}
+	for id := range a.reactions {
+		if _, ok := keep[id]; !ok {
+			delete(a.reactions, id)
+		}
+	}
+	return report
+}
+
+// retained returns the IDs of the messages that the policy retains, together with their
+// ancestors and any root messages. The caller must hold the archive's lock.
+func (a *Archive) retained(policy Retention, now time.Time) map[string]struct{} {
+	byID := make(map[string]*arbor.ChatMessage, len(a.chronological))
+	for _, message := range a.chronological {
+		byID[message.UUID] = message
+	}
+	keep := make(map[string]struct{})
+	// keepWithAncestors retains the message and every ancestor of it that is present
+	keepWithAncestors := func(message *arbor.ChatMessage) {
+		for message != nil {
+			if _, ok := keep[message.UUID]; ok {
+				return
+			}
+			keep[message.UUID] = struct{}{}
+			message = byID[message.Parent]
+		}
+	}
+	var (
+		count int
+		size  int64
+	)
+	// walk backward from the most recent message until a limit is reached
+	for i := len(a.chronological) - 1; i >= 0; i-- {
+		message := a.chronological[i]
+		if policy.MaxAge > 0 && now.Sub(time.Unix(message.Timestamp, 0)) > policy.MaxAge {
+			break
+		}
+		if policy.MaxCount > 0 && count >= policy.MaxCount {
+			break
+		}
+		if policy.MaxSize > 0 {
+			encoded, _ := json.Marshal(message)
+			size += int64(len(encoded)) + 1
+			if size > policy.MaxSize {
+				break
+			}
+		}
+		count++
+		keepWithAncestors(message)
+	}
+	for _, message := range a.chronological {
+		if message.Parent == "" {
+			keepWithAncestors(message)
+		}
+	}
+	return keep
+}
@@ -0,0 +1,66 @@
+package archive_test
+
+import (
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/onsi/gomega"
+)
+
+// pruneArchiveOrSkip creates an archive with two threads beneath a root. The old
+// thread has a recent reply deep within it, and the other thread is entirely old.
+func pruneArchiveOrSkip(t *testing.T) *archive.Archive {
+	a := newOrSkip(t)
+	for _, message := range []*arbor.ChatMessage{
+		{UUID: "root", Username: "alice", Content: "hello", Timestamp: 100},
+		{UUID: "old", Parent: "root", Username: "bob", Content: "old thread", Timestamp: 200},
+		{UUID: "stale", Parent: "root", Username: "carol", Content: "stale thread", Timestamp: 300},
+		{UUID: "stale-reply", Parent: "stale", Username: "alice", Content: "stale reply", Timestamp: 400},
+		{UUID: "old-reply", Parent: "old", Username: "carol", Content: "old reply", Timestamp: 500},
+		{UUID: "recent", Parent: "old-reply", Username: "bob", Content: "recent reply", Timestamp: 1000},
+	} {
+		addOrSkip(t, a, message)
+	}
+	return a
+}
+
+// removedIDs returns the ids of the messages removed by pruning.
+func removedIDs(report *archive.PruneReport) []string {
+	ids := make([]string, 0, len(report.Removed))
+	for _, message := range report.Removed {
+		ids = append(ids, message.UUID)
+	}
+	return ids
+}
+
+// TestPrune checks that pruning keeps the root and the ancestors of retained messages
+// and removes whole subtrees.
+func TestPrune(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	now := time.Unix(1100, 0)
+	a := pruneArchiveOrSkip(t)
+	report := a.Prune(archive.Retention{}, now, false)
+	g.Expect(report.Removed).To(gomega.BeEmpty())
+	g.Expect(report.Kept).To(gomega.Equal(6))
+
+	report = a.Prune(archive.Retention{MaxAge: 200 * time.Second}, now, true)
+	g.Expect(removedIDs(report)).To(gomega.Equal([]string{"stale", "stale-reply"}))
+	g.Expect(report.Kept).To(gomega.Equal(4))
+	g.Expect(a.Has("stale")).To(gomega.BeTrue(), "dry runs should not remove messages")
+
+	a.RecordQuery("missing-parent-of-stale", now)
+	addOrSkip(t, a, &arbor.ChatMessage{UUID: "orphan", Parent: "missing-parent-of-stale", Username: "dave", Content: "orphan", Timestamp: 50})
+	report = a.Prune(archive.Retention{MaxCount: 1}, now, false)
+	g.Expect(removedIDs(report)).To(gomega.Equal([]string{"orphan", "stale", "stale-reply"}))
+	g.Expect(a.Has("stale")).To(gomega.BeFalse())
+	g.Expect(a.Has("old")).To(gomega.BeTrue())
+	g.Expect(a.Has("recent")).To(gomega.BeTrue())
+	g.Expect(a.Queried("missing-parent-of-stale")).To(gomega.BeFalse())
+	g.Expect(a.ChildrenOf("root")).To(gomega.Equal([]string{"old"}))
+
+	report = a.Prune(archive.Retention{MaxSize: 1}, now, false)
+	g.Expect(removedIDs(report)).To(gomega.Equal([]string{"old", "old-reply", "recent"}))
+	g.Expect(a.Has("root")).To(gomega.BeTrue(), "the root should always be kept")
+}
@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"fmt"
+
+	"github.com/arborchat/muscadine/types"
+)
+
+// Revise records a change that the author made to the message with the given ID.
+// Revisions are kept in the order of their timestamps, and recording the same revision
+// twice has no effect. It is an error to revise a message that isn't in the archive.
+func (a *Archive) Revise(id string, revision types.Revision) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.has(id) {
+		return fmt.Errorf("Unable to revise missing message %s", id)
+	}
+	a.revise(id, revision)
+	return nil
+}
+
+// revise records the revision of the message, unless it is already known. The caller
+// must hold the archive's write lock.
+func (a *Archive) revise(id string, revision types.Revision) {
+	existing := a.revisions[id]
+	i := len(existing)
+	for i > 0 && existing[i-1].Timestamp > revision.Timestamp {
+		i--
+	}
+	for j := i - 1; j >= 0 && existing[j].Timestamp == revision.Timestamp; j-- {
+		if existing[j] == revision {
+			return
+		}
+	}
+	revised := make([]types.Revision, 0, len(existing)+1)
+	revised = append(revised, existing[:i]...)
+	revised = append(revised, revision)
+	a.revisions[id] = append(revised, existing[i:]...)
+}
+
+// Revisions returns the changes made to the message with the given ID, oldest first.
+func (a *Archive) Revisions(id string) []types.Revision {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	existing := a.revisions[id]
+	if len(existing) == 0 {
+		return nil
+	}
+	return append([]types.Revision{}, existing...)
+}
+
+// mergeRevisions combines the provided revisions with those already known, discarding
+// revisions of messages that are missing. The caller must hold the archive's write
+// lock.
+func (a *Archive) mergeRevisions(revisions map[string][]types.Revision) {
+	for id, changes := range revisions {
+		if !a.has(id) {
+			continue
+		}
+		for _, revision := range changes {
+			a.revise(id, revision)
+		}
+	}
+}
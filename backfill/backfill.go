@@ -0,0 +1,154 @@
+// Package backfill implements a crawler that fills gaps in the chat history by
+// repeatedly asking the server for messages that are referenced but missing.
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/arborchat/muscadine/types"
+)
+
+const (
+	// DefaultConcurrency is the default limit on unanswered queries.
+	DefaultConcurrency = 5
+	// DefaultInterval is the default minimum time between queries.
+	DefaultInterval = 200 * time.Millisecond
+	// DefaultTimeout is how long to wait for an answer to a query by default.
+	DefaultTimeout = 30 * time.Second
+	// scanLimit bounds the number of missing messages considered at once.
+	scanLimit = 1000
+)
+
+// Archive is the part of a history that the Engine needs in order to find and
+// recognize missing messages. The archive decides when a message is unavailable
+// based on the queries recorded for it.
+type Archive interface {
+	Needed(n int) []string
+	Has(id string) bool
+	RecordQuery(id string, at time.Time)
+	IsUnavailable(id string) bool
+	Unavailable() []string
+}
+
+// Config controls the pace of an Engine. Zero values are replaced by defaults.
+type Config struct {
+	// Concurrency is the maximum number of queries that may be unanswered at once.
+	Concurrency int
+	// Interval is the minimum time between two queries.
+	Interval time.Duration
+	// Timeout is how long to wait for the answer to a query before trying again.
+	Timeout time.Duration
+}
+
+// Engine tracks queries for missing messages. Its state is kept across calls to
+// Run, so a single Engine can be used for many consecutive connections. It is
+// safe for concurrent use.
+type Engine struct {
+	archive Archive
+	config  Config
+
+	lock sync.Mutex
+	// inFlight maps the IDs of unanswered queries to when they were sent
+	inFlight map[string]time.Time
+	fetched  int
+	missing  int
+}
+
+// New creates an Engine that searches for messages missing from the archive.
+func New(archive Archive, config Config) (*Engine, error) {
+	if archive == nil {
+		return nil, fmt.Errorf("Cannot create Engine with nil archive")
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = DefaultConcurrency
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &Engine{
+		archive:  archive,
+		config:   config,
+		inFlight: make(map[string]time.Time),
+	}, nil
+}
+
+// Run requests missing messages by invoking query with their IDs until ctx is done.
+// The answers are expected to be added to the archive by someone else. Queries still
+// unanswered when Run begins are forgotten, since they were presumably sent over a
+// connection that no longer exists.
+func (e *Engine) Run(ctx context.Context, query func(id string)) {
+	e.lock.Lock()
+	e.inFlight = make(map[string]time.Time)
+	e.lock.Unlock()
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if id := e.step(now); id != "" {
+				query(id)
+			}
+		}
+	}
+}
+
+// step updates the state of every query and returns the ID of the next message to
+// request, or the empty string if no query should be sent yet.
+func (e *Engine) step(now time.Time) string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for id, sent := range e.inFlight {
+		if e.archive.Has(id) {
+			delete(e.inFlight, id)
+			e.fetched++
+		} else if now.Sub(sent) >= e.config.Timeout {
+			delete(e.inFlight, id)
+			if e.archive.IsUnavailable(id) {
+				log.Printf("Giving up on message %s\n", id)
+			}
+		}
+	}
+	// unavailable messages are never needed
+	needed := e.archive.Needed(scanLimit)
+	seen := make(map[string]struct{})
+	next := ""
+	// the most recently referenced messages are last, and should be requested first
+	for i := len(needed) - 1; i >= 0; i-- {
+		id := needed[i]
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if _, ok := e.inFlight[id]; !ok && next == "" {
+			next = id
+		}
+	}
+	e.missing = len(seen)
+	if next == "" || len(e.inFlight) >= e.config.Concurrency {
+		return ""
+	}
+	e.inFlight[next] = now
+	e.archive.RecordQuery(next, now)
+	return next
+}
+
+// Progress reports the current state of the Engine.
+func (e *Engine) Progress() types.BackfillProgress {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return types.BackfillProgress{
+		Missing:     e.missing,
+		InFlight:    len(e.inFlight),
+		Fetched:     e.fetched,
+		Unavailable: len(e.archive.Unavailable()),
+	}
+}
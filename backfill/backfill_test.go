@@ -0,0 +1,82 @@
+package backfill_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/backfill"
+	"github.com/arborchat/muscadine/types"
+	"github.com/onsi/gomega"
+)
+
+// chain returns a message with the given id and parent.
+func chain(id, parent string, timestamp int64) *arbor.ChatMessage {
+	return &arbor.ChatMessage{UUID: id, Parent: parent, Username: "test", Content: id, Timestamp: timestamp}
+}
+
+// TestNewInvalid checks that the Engine constructor rejects a nil archive.
+func TestNewInvalid(t *testing.T) {
+	if _, err := backfill.New(nil, backfill.Config{}); err == nil {
+		t.Error("Should fail to create Engine without an archive")
+	}
+}
+
+// TestBackfill checks that the Engine walks up a thread by requesting each missing
+// ancestor in turn, and that it never has more than the configured number of
+// queries in flight.
+func TestBackfill(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := archive.New()
+	g.Expect(a.Add(chain("4", "3", 4))).To(gomega.BeNil())
+	g.Expect(a.Add(chain("b", "a", 5))).To(gomega.BeNil())
+	server := map[string]*arbor.ChatMessage{
+		"1": chain("1", "", 1),
+		"2": chain("2", "1", 2),
+		"3": chain("3", "2", 3),
+		"a": chain("a", "1", 1),
+	}
+	e, err := backfill.New(a, backfill.Config{Concurrency: 1, Interval: time.Millisecond, Timeout: time.Hour})
+	g.Expect(err).To(gomega.BeNil())
+	queries := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx, func(id string) {
+		queries <- id
+	})
+	var requested []string
+	for len(requested) < 4 {
+		var id string
+		g.Eventually(queries).Should(gomega.Receive(&id))
+		g.Consistently(queries, 10*time.Millisecond).ShouldNot(gomega.Receive())
+		requested = append(requested, id)
+		g.Expect(a.Add(server[id])).To(gomega.BeNil())
+	}
+	g.Expect(requested).To(gomega.Equal([]string{"a", "3", "2", "1"}))
+	g.Eventually(e.Progress).Should(gomega.Equal(types.BackfillProgress{Fetched: 4}))
+}
+
+// TestUnavailable checks that the Engine retries unanswered queries until the archive
+// considers the message unavailable.
+func TestUnavailable(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	a := archive.New()
+	g.Expect(a.Add(chain("orphan", "gone", 1))).To(gomega.BeNil())
+	a.SetGiveUp(3, 0)
+	e, err := backfill.New(a, backfill.Config{Interval: time.Millisecond, Timeout: 5 * time.Millisecond})
+	g.Expect(err).To(gomega.BeNil())
+	queries := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx, func(id string) {
+		queries <- id
+	})
+	for i := 0; i < 3; i++ {
+		g.Eventually(queries).Should(gomega.Receive(gomega.Equal("gone")))
+	}
+	g.Eventually(func() bool { return a.IsUnavailable("gone") }).Should(gomega.BeTrue())
+	g.Consistently(queries, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	g.Expect(e.Progress()).To(gomega.Equal(types.BackfillProgress{Unavailable: 1}))
+}
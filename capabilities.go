@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The capability extension lets clients learn which protocol extensions the sessions
+// of others support, so that optional features are only used when someone can make
+// sense of them. Capabilities are announced with a META message whose value takes the
+// form "username\nsessionID\ntimestamp\nkey version\nkey version...", where each of
+// the trailing lines names the key of a supported extension and the version of it that
+// is implemented. They accompany every "presence/here" announcement.
+const capabilitiesKey = "capabilities/announce"
+
+// capabilities lists the META keys that this client understands, mapped to the
+// versions that it implements. Versions are assumed to be backward compatible, so a
+// session supports an extension if it announced the same version or a newer one.
+var capabilities = map[string]int{
+	"presence/who":    1,
+	"presence/here":   1,
+	"presence/leave":  1,
+	"presence/typing": 1,
+	"presence/seen":   1,
+	editKey:           2, // edits are replies rather than META messages since version 2
+	retractKey:        1,
+	reactKey:          1,
+	unreactKey:        1,
+	capabilitiesKey:   1,
+}
+
+// capabilitiesValue creates the value of a "capabilities/announce" META message for
+// the user's session. The extensions are sorted by key so that announcements are
+// stable.
+func capabilitiesValue(username, sessionID string) string {
+	lines := []string{username, sessionID, fmt.Sprintf("%d", time.Now().Unix())}
+	keys := make([]string, 0, len(capabilities))
+	for key := range capabilities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s %d", key, capabilities[key]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseCapabilities processes "capabilities/announce" META values into the session
+// that announced them and the extensions that it supports.
+func parseCapabilities(value string) (username, sessionID string, supported map[string]int, err error) {
+	username, sessionID, _, err = parsePresence(value)
+	if err != nil {
+		return
+	}
+	supported = make(map[string]int)
+	for _, line := range strings.Split(value, "\n")[3:] {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			err = fmt.Errorf("invalid capability in %s message: %s", capabilitiesKey, line)
+			return
+		}
+		version, convErr := strconv.Atoi(fields[1])
+		if convErr != nil || version < 1 {
+			err = fmt.Errorf("invalid version of %s in %s message: %s", fields[0], capabilitiesKey, fields[1])
+			return
+		}
+		supported[fields[0]] = version
+	}
+	return
+}
+
+// peersSupport returns whether any other session that is connected supports the
+// extension with the given key.
+func (nc *NetClient) peersSupport(key string) bool {
+	return nc.List.Supports(key, capabilities[key])
+}
+
+// handleCapabilities records the extensions supported by the session that announced
+// them.
+func (nc *NetClient) handleCapabilities(value string) error {
+	username, sessionID, supported, err := parseCapabilities(value)
+	if err != nil {
+		return err
+	} else if sessionID == nc.Session.ID {
+		// don't track our own session
+		return nil
+	}
+	if err := nc.List.SetCapabilities(sessionID, supported); err != nil {
+		return err
+	}
+	log.Printf("Session (id=%s) of %s supports %d extensions\n", sessionID, username, len(supported))
+	return nil
+}
+
+// logUnknownMeta logs that a META message with the given key was ignored. Each key is
+// only logged the first time it is seen, since clients that support extensions that
+// this one doesn't will keep sending them.
+func (nc *NetClient) logUnknownMeta(key string) {
+	nc.unknownLock.Lock()
+	defer nc.unknownLock.Unlock()
+	if nc.unknownKeys[key] {
+		return
+	}
+	nc.unknownKeys[key] = true
+	log.Printf("Ignoring META messages with unsupported key %s\n", key)
+}
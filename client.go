@@ -1,24 +1,45 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	arbor "github.com/arborchat/arbor-go"
 	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/backfill"
+	"github.com/arborchat/muscadine/e2e"
+	"github.com/arborchat/muscadine/hook"
+	"github.com/arborchat/muscadine/profile"
 	"github.com/arborchat/muscadine/session"
+	"github.com/arborchat/muscadine/signing"
 	"github.com/arborchat/muscadine/types"
 	uuid "github.com/nu7hatch/gouuid"
 )
 
 const timeout = 30 * time.Second
 
+const (
+	// heartbeatInterval is how often the client re-announces its presence while connected.
+	heartbeatInterval = 2 * time.Minute
+	// sessionSweepInterval is how often the client forgets sessions that have expired.
+	sessionSweepInterval = time.Minute
+	// DefaultSessionTTL is how long a session may go without announcing its presence
+	// before it is considered to have left. It should be several times longer than
+	// the heartbeatInterval.
+	DefaultSessionTTL = 10 * time.Minute
+	// TypingTTL is how long a user is considered to be typing after announcing it. It
+	// should be several times longer than the interval at which the TUI repeats those
+	// announcements.
+	TypingTTL = 10 * time.Second
+)
+
 // Connector is the type of function that connects to a server over
 // a given transport.
 type Connector func(address string) (io.ReadWriteCloser, error)
@@ -35,19 +56,65 @@ type NetClient struct {
 	*archive.Manager
 	Composer
 	*Notifier
+	// Profile, if set, is updated whenever the username changes.
+	Profile *profile.Profile
+	// SessionTTL is how long other sessions may go without announcing their presence
+	// before they are forgotten. Change it before calling Connect().
+	SessionTTL time.Duration
+	// ShareSeen lets others know which messages the user has viewed. Change it before
+	// calling Connect().
+	ShareSeen bool
+	// Backfill requests messages missing from the history while connected.
+	Backfill *backfill.Engine
+	// verifier checks the signatures of received messages against the trusted keys if
+	// signing is enabled
+	verifier *signing.Verifier
+	keys     *signing.KeyStore
+	// keyring holds the keys of protected threads if encryption is enabled
+	keyring *e2e.Keyring
 	address string
 
-	arbor.ReadWriteCloser
 	connectFunc Connector
 	*session.List
 	session.Session
+	// Typists tracks the other users who are composing replies.
+	Typists *session.TypingList
+	// Viewers tracks the newest message that each other user has viewed.
+	Viewers           *session.SeenList
 	disconnectHandler func(types.Connection)
 	receiveHandler    func(*arbor.ChatMessage)
-	stopSending       chan struct{}
-	stopReceiving     chan struct{}
-	// pingServer is used to request that we attempt to force a response from the server.
-	// This allows us to guard against a stale connection.
-	pingServer chan struct{}
+	reviseHandler     func(string)
+	reactHandler      func(string)
+	// connLock protects conn, which is the current connection to the server (or
+	// nil when disconnected).
+	connLock sync.Mutex
+	conn     *connection
+	// Hook, if set, is shown every chat message before it is sent or handled, and every
+	// META message before it is handled. Change it before calling Connect().
+	Hook hook.Hook
+	// annotations maps message IDs to the notes that the Hook made about them,
+	// rewrites maps them to the content that the Hook chose to show instead, and
+	// dropped holds the IDs of the messages that the Hook discarded. All are protected
+	// by hookLock.
+	hookLock    sync.Mutex
+	annotations map[string][]string
+	rewrites    map[string]string
+	dropped     map[string]struct{}
+	// disconnectLock serializes invocations of the disconnectHandler
+	disconnectLock sync.Mutex
+	// unknownKeys holds the unsupported META keys that have been logged, and is
+	// protected by unknownLock.
+	unknownLock sync.Mutex
+	unknownKeys map[string]bool
+}
+
+// validateUsername checks that a username can be represented in the presence
+// protocol extension.
+func validateUsername(username string) error {
+	if username == "" || strings.ContainsAny(username, "\n") {
+		return fmt.Errorf("Illegal username: \"%s\"", username)
+	}
+	return nil
 }
 
 // NewNetClient creates a NetClient configured to communicate with the server at the
@@ -55,29 +122,36 @@ type NetClient struct {
 func NewNetClient(address, username string, history *archive.Manager) (*NetClient, error) {
 	if address == "" {
 		return nil, fmt.Errorf("Illegal address: \"%s\"", address)
-	} else if username == "" {
-		return nil, fmt.Errorf("Illegal username: \"%s\"", username)
+	} else if err := validateUsername(username); err != nil {
+		return nil, err
 	} else if history == nil {
 		return nil, fmt.Errorf("Illegal archive: %v", history)
 	}
 	composerOut := make(chan *arbor.ProtocolMessage)
-	stopSending := make(chan struct{})
-	stopReceiving := make(chan struct{})
 
 	sessionID, err := uuid.NewV4()
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't generate session id: %s", err)
 	}
+	engine, err := backfill.New(history, backfill.Config{})
+	if err != nil {
+		return nil, err
+	}
 	nc := &NetClient{
-		address:       address,
-		Manager:       history,
-		connectFunc:   TCPDial,
-		Composer:      Composer{username: username, sendChan: composerOut},
-		stopSending:   stopSending,
-		stopReceiving: stopReceiving,
-		List:          session.NewList(),
-		Session:       session.Session{ID: sessionID.String()},
-		pingServer:    make(chan struct{}),
+		address:     address,
+		Manager:     history,
+		connectFunc: TCPDial,
+		Composer:    Composer{username: username, sendChan: composerOut},
+		List:        session.NewList(),
+		Typists:     session.NewTypingList(TypingTTL),
+		Viewers:     session.NewSeenList(),
+		Session:     session.Session{ID: sessionID.String()},
+		SessionTTL:  DefaultSessionTTL,
+		Backfill:    engine,
+		unknownKeys: make(map[string]bool),
+		annotations: make(map[string][]string),
+		rewrites:    make(map[string]string),
+		dropped:     make(map[string]struct{}),
 	}
 	return nc, nil
 }
@@ -90,134 +164,402 @@ func (nc *NetClient) SetConnector(connector Connector) {
 	nc.connectFunc = connector
 }
 
+// EnableSigning configures the client to sign the messages that it sends with the
+// identity, and to verify the signatures of the messages that it receives against the
+// keys in the KeyStore. This should be done before calling Connect() for the first time
+// to avoid race conditions.
+func (nc *NetClient) EnableSigning(identity *signing.Identity, keys *signing.KeyStore) error {
+	verifier, err := signing.NewVerifier(keys)
+	if err != nil {
+		return err
+	}
+	nc.verifier = verifier
+	nc.keys = keys
+	nc.Composer.signer = identity
+	nc.trustOwnKey(nc.Composer.Username())
+	return nil
+}
+
+// trustOwnKey trusts the client's own key for the username if signing is enabled, so
+// that its own messages are verified.
+func (nc *NetClient) trustOwnKey(username string) {
+	if nc.keys == nil {
+		return
+	}
+	if trusted, _ := nc.keys.Trust(username, nc.Composer.signer.PublicKey()); !trusted {
+		log.Printf("Another key is trusted for the username %s, so others may consider your messages invalid\n", username)
+	}
+}
+
+// Verify returns the outcome of checking the signature of the message if signing is
+// enabled, along with the content of the message without its signature. Messages are
+// verified as they arrive, and this only reports the outcome, so it never trusts a
+// new key.
+func (nc *NetClient) Verify(message *arbor.ChatMessage) (types.Verification, string) {
+	if nc.verifier == nil {
+		return types.NotChecked, signing.Strip(message.Content)
+	}
+	return nc.verifier.Result(message)
+}
+
+// verify checks the signature of a message that just arrived if signing is enabled,
+// trusting its key if none is trusted for its username yet. It returns the outcome
+// along with the content of the message without its signature.
+func (nc *NetClient) verify(message *arbor.ChatMessage) (types.Verification, string) {
+	if nc.verifier == nil {
+		return types.NotChecked, signing.Strip(message.Content)
+	}
+	return nc.verifier.Verify(message)
+}
+
+// EnableEncryption configures the client to encrypt its replies within protected
+// threads and to decrypt the messages that it receives with the keys in the Keyring.
+// This should be done before calling Connect() for the first time to avoid race
+// conditions.
+func (nc *NetClient) EnableEncryption(keyring *e2e.Keyring) {
+	nc.keyring = keyring
+}
+
+// lineage returns the IDs of the message and its known ancestors, nearest first.
+func (nc *NetClient) lineage(id string) []string {
+	lineage := make([]string, 0)
+	seen := make(map[string]struct{})
+	for id != "" {
+		if _, ok := seen[id]; ok {
+			break
+		}
+		seen[id] = struct{}{}
+		lineage = append(lineage, id)
+		message := nc.Archive.Get(id)
+		if message == nil {
+			break
+		}
+		id = message.Parent
+	}
+	return lineage
+}
+
+// Reply sends a reply to `parent` with the given message content, unless the Hook
+// drops it.
+func (nc *NetClient) Reply(parent, content string) error {
+	content, err := nc.hookOutbound(parent, content)
+	if err != nil {
+		return err
+	}
+	return nc.reply(parent, content)
+}
+
+// reply sends a reply to `parent` with the given message content. If the reply is
+// within a protected thread, its content is encrypted. Signing happens first, so that
+// the signature is encrypted along with the content.
+func (nc *NetClient) reply(parent, content string) error {
+	if nc.keyring == nil {
+		return nc.Composer.Reply(parent, content)
+	}
+	key, protected := nc.keyring.ForThread(nc.lineage(parent))
+	if !protected {
+		return nc.Composer.Reply(parent, content)
+	}
+	chat, err := nc.Composer.compose(parent, content)
+	if err != nil {
+		return err
+	}
+	if err := key.Encrypt(chat); err != nil {
+		return err
+	}
+	nc.Composer.sendChat(chat)
+	return nil
+}
+
+// Decrypt returns the content of the message, decrypted if possible. If the message is
+// encrypted and can't be decrypted, a placeholder is returned instead.
+func (nc *NetClient) Decrypt(message *arbor.ChatMessage) string {
+	if nc.keyring == nil {
+		if e2e.IsEncrypted(message.Content) {
+			return e2e.NoKeyPlaceholder
+		}
+		return message.Content
+	}
+	content, _ := nc.keyring.Decrypt(message)
+	return content
+}
+
+// ProtectThread creates a key that encrypts every later reply beneath the root
+// message. It returns the key in the form to share with other participants.
+func (nc *NetClient) ProtectThread(root string) (string, error) {
+	if nc.keyring == nil {
+		return "", fmt.Errorf("Encryption is not enabled")
+	}
+	key, err := nc.keyring.Protect(root)
+	if err != nil {
+		return "", err
+	}
+	return key.Shared(), nil
+}
+
+// AddThreadKey adds a key shared by another participant. It returns the ID of the root
+// of the thread that the key protects.
+func (nc *NetClient) AddThreadKey(shared string) (string, error) {
+	if nc.keyring == nil {
+		return "", fmt.Errorf("Encryption is not enabled")
+	}
+	key, err := e2e.ParseShared(shared)
+	if err != nil {
+		return "", err
+	}
+	return key.Root, nc.keyring.Add(key)
+}
+
 // OnDisconnect sets the handler for disconnections. This should be done before
-// calling Connect() for the first time to avoid race conditions.
+// calling Connect() for the first time to avoid race conditions. The handler is
+// invoked once per connection in its own goroutine, but invocations never overlap.
 func (nc *NetClient) OnDisconnect(handler func(types.Connection)) {
 	nc.disconnectHandler = handler
 }
 
 // OnReceive sets the handler for when ChatMessages are received. This should be done before
-// calling Connect() for the first time to avoid race conditions.
+// calling Connect() for the first time to avoid race conditions. The handler runs on the
+// goroutine that reads from the server, so it must not call Disconnect.
 func (nc *NetClient) OnReceive(handler func(*arbor.ChatMessage)) {
 	nc.receiveHandler = handler
 }
 
 // Connect resolves the address of the NetClient and attempts to establish a connection.
+// It is an error to Connect while already connected.
 func (nc *NetClient) Connect() error {
-	conn, err := nc.connectFunc(nc.address)
+	nc.connLock.Lock()
+	defer nc.connLock.Unlock()
+	if nc.conn != nil {
+		return fmt.Errorf("Already connected to %s", nc.address)
+	}
+	raw, err := nc.connectFunc(nc.address)
 	if err != nil {
 		return err
 	}
-	nc.ReadWriteCloser, err = arbor.NewProtocolReadWriter(conn)
+	conn, err := newConnection(raw)
 	if err != nil {
+		raw.Close()
 		return err
 	}
-	go nc.send()
-	go nc.receive()
+	nc.conn = conn
+	conn.wg.Add(3)
+	go nc.send(conn)
+	go nc.receive(conn)
+	go nc.backfill(conn)
 	return nil
 }
 
 // Disconnect stops all communication with the server and closes the connection. It invokes
-// the handler set by OnDisconnect, if there is one.
+// the handler set by OnDisconnect, if there is one. Disconnect blocks until the goroutines
+// servicing the connection have stopped. It is safe to call Disconnect when not connected.
+//
+// Since the handlers set by OnReceive, OnRevise, and OnReact may run on one of those
+// goroutines, they must not call Disconnect, or it will wait for itself forever. They
+// can call it from a new goroutine instead. The handler set by OnDisconnect runs on its
+// own goroutine, so it may call Disconnect directly.
 func (nc *NetClient) Disconnect() error {
-	err := nc.ReadWriteCloser.Close()
-	if nc.disconnectHandler != nil {
-		go nc.disconnectHandler(nc)
+	nc.connLock.Lock()
+	conn := nc.conn
+	nc.connLock.Unlock()
+	if conn == nil {
+		return nil
 	}
-	go func() {
-		nc.stopSending <- struct{}{}
-		nc.stopReceiving <- struct{}{}
-	}()
+	err := nc.hangUp(conn)
+	conn.wg.Wait()
+	return err
+}
 
+// hangUp closes the given connection and invokes the disconnect handler if the
+// connection is still current. Unlike Disconnect, it does not wait for the
+// connection's goroutines to stop, so those goroutines may use it to end their own
+// connection.
+func (nc *NetClient) hangUp(conn *connection) error {
+	nc.connLock.Lock()
+	if nc.conn != conn {
+		// someone else already hung up this connection
+		nc.connLock.Unlock()
+		return nil
+	}
+	nc.conn = nil
+	nc.connLock.Unlock()
+	err := conn.Close()
+	if nc.disconnectHandler != nil {
+		go func() {
+			// never run the handler for two connections at once
+			nc.disconnectLock.Lock()
+			defer nc.disconnectLock.Unlock()
+			nc.disconnectHandler(nc)
+		}()
+	}
 	return err
 }
 
-// send reads messages from the Composer and sends them to the server.
-func (nc *NetClient) send() {
-	errored := false
+// sendContext queues a message to be sent to the server, unless ctx is done first.
+// It should be used instead of the Composer by any code servicing a connection
+// so that it cannot block forever once the connection is closed.
+func (nc *NetClient) sendContext(ctx context.Context, message *arbor.ProtocolMessage) {
+	select {
+	case nc.Composer.sendChan <- message:
+	case <-ctx.Done():
+	}
+}
+
+// send reads messages from the Composer and sends them to the server. It also
+// periodically announces this session's presence and forgets the sessions of others
+// that have not done the same.
+func (nc *NetClient) send(conn *connection) {
+	defer conn.wg.Done()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	sweep := time.NewTicker(sessionSweepInterval)
+	defer sweep.Stop()
 	for {
+		var toSend *arbor.ProtocolMessage
 		select {
-		case protoMessage := <-nc.Composer.sendChan:
-			err := nc.ReadWriteCloser.Write(protoMessage)
-			if !errored && err != nil {
-				errored = true
-				log.Println("Error writing to server:", err)
-				go nc.Disconnect()
-			} else if errored {
-				continue
+		case <-conn.Done():
+			return
+		case toSend = <-nc.Composer.sendChan:
+		case <-heartbeat.C:
+			toSend = herePresence(nc.Composer.Username(), nc.Session.ID)
+		case <-sweep.C:
+			if expired := nc.List.Expire(time.Now().Add(-nc.SessionTTL)); expired > 0 {
+				log.Printf("Expired %d sessions not seen in %s\n", expired, nc.SessionTTL)
 			}
-		case <-nc.pingServer:
-			// query for the root message
-			root, _ := nc.Archive.Root()
-			go nc.Composer.Query(root)
-			go nc.Composer.AskWho()
-		case <-nc.stopSending:
+			continue
+		}
+		if err := conn.Write(toSend); err != nil {
+			log.Println("Error writing to server:", err)
+			nc.hangUp(conn)
 			return
 		}
 	}
 }
 
-// readChannel spawns its own goroutine to read from the NetClient's connection.
-// You can stop the goroutine by closing the channel that it returns.
-func (nc *NetClient) readChannel() chan struct {
+// backfill requests missing messages over the given connection until it closes.
+func (nc *NetClient) backfill(conn *connection) {
+	defer conn.wg.Done()
+	nc.Backfill.Run(conn.ctx, func(id string) {
+		nc.sendContext(conn.ctx, queryMessage(id))
+	})
+}
+
+// BackfillProgress reports how the search for missing messages is going.
+func (nc *NetClient) BackfillProgress() types.BackfillProgress {
+	return nc.Backfill.Progress()
+}
+
+// readResult is the outcome of reading one message from a connection.
+type readResult struct {
 	*arbor.ProtocolMessage
 	error
-} {
-	out := make(chan struct {
-		*arbor.ProtocolMessage
-		error
-	})
+}
+
+// readChannel spawns its own goroutine to read from the given connection and returns
+// a channel of the results. The goroutine stops after the first error or when the
+// connection closes.
+func (nc *NetClient) readChannel(conn *connection) <-chan readResult {
+	out := make(chan readResult)
+	conn.wg.Add(1)
 	// read messages continuously and send results back on a channel
 	go func() {
-		defer func() {
-			// ensure send on closed channel doesn't cause panic
-			if err := recover(); err != nil {
-				if _, ok := err.(runtime.Error); !ok {
-					// silently cancel runtime errors, but allow other errors
-					// to propagate.
-					panic(err)
-				}
-			}
-		}()
+		defer conn.wg.Done()
 		for {
 			m := new(arbor.ProtocolMessage)
-			err := nc.ReadWriteCloser.Read(m)
-			out <- struct {
-				*arbor.ProtocolMessage
-				error
-			}{m, err}
+			err := conn.Read(m)
+			select {
+			case out <- readResult{m, err}:
+			case <-conn.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
 		}
 	}()
 	return out
 }
 
 // handleMessage processes an Arbor ProtocolMessage. The actions
-// taken vary by the type of ProtocolMessage.
-func (nc *NetClient) handleMessage(m *arbor.ProtocolMessage) {
+// taken vary by the type of ProtocolMessage. Any responses are abandoned
+// if ctx is done before they can be sent.
+func (nc *NetClient) handleMessage(ctx context.Context, m *arbor.ProtocolMessage) {
 	switch m.Type {
 	case arbor.NewMessageType:
-		if !nc.Archive.Has(m.UUID) {
+		if !nc.Archive.Has(m.UUID) && !nc.Dropped(m.UUID) {
+			if nc.keyring != nil {
+				// messages that can't be decrypted are kept encrypted in case their
+				// key is added later
+				if content, ok := nc.keyring.Decrypt(m.ChatMessage); ok {
+					m.Content = content
+				}
+			}
+			if result, _ := nc.verify(m.ChatMessage); result == types.Invalid {
+				// forged messages are kept so that their replies stay connected to the
+				// tree, where they are shown as invalid, but they aren't announced
+				log.Printf("Message %s from %s has an invalid signature\n", m.UUID, m.Username)
+				if err := nc.Archive.Add(m.ChatMessage); err != nil {
+					log.Printf("Unable to archive message %s: %s\n", m.UUID, err)
+				}
+				return
+			}
+			if !nc.hookInbound(m.ChatMessage) {
+				return
+			}
+			edit := nc.IsRevision(m.ChatMessage)
+			// the author has finished typing their reply
+			nc.Typists.Stop(m.Username)
 			if nc.receiveHandler != nil {
 				nc.receiveHandler(m.ChatMessage)
-				// ask Notifier to handle the message
-				nc.Notifier.Handle(nc, m.ChatMessage)
+				// ask Notifier to handle the message, unless it only edits another
+				if nc.Notifier != nil && !edit {
+					nc.Notifier.Handle(nc, m.ChatMessage)
+				}
 			}
-			if m.Parent != "" && !nc.Archive.Has(m.Parent) {
-				nc.Query(m.Parent)
+			if edit {
+				log.Printf("Message %s revised by %s\n", m.Parent, m.Username)
+				if nc.reviseHandler != nil {
+					nc.reviseHandler(m.Parent)
+				}
+			}
+			if m.Parent != "" && !nc.Archive.Has(m.Parent) && !nc.Dropped(m.Parent) {
+				nc.sendContext(ctx, queryMessage(m.Parent))
 			}
 		}
 	case arbor.WelcomeType:
 		if !nc.Has(m.Root) {
-			nc.Query(m.Root)
+			nc.sendContext(ctx, queryMessage(m.Root))
 		}
 		for _, recent := range m.Recent {
-			if !nc.Has(recent) {
-				nc.Query(recent)
+			if !nc.Has(recent) && !nc.Dropped(recent) {
+				nc.sendContext(ctx, queryMessage(recent))
 			}
 		}
 	case arbor.MetaType:
-		nc.HandleMeta(m.Meta)
+		nc.handleMeta(ctx, m.Meta)
+	}
+}
+
+// ChangeUsername switches the username of this session. The rename is announced to
+// the server in the background as this session leaving under its old name and
+// rejoining under its new one. The new name is saved in the Profile, if there is one.
+func (nc *NetClient) ChangeUsername(username string) error {
+	if err := validateUsername(username); err != nil {
+		return err
 	}
+	oldUsername := nc.Composer.Username()
+	if oldUsername == username {
+		return nil
+	}
+	nc.Composer.SetUsername(username)
+	nc.trustOwnKey(username)
+	go nc.Composer.AnnounceRename(oldUsername, username, nc.Session.ID)
+	log.Printf("Changed username from %s to %s\n", oldUsername, username)
+	if nc.Profile != nil {
+		if err := nc.Profile.SetUsername(username); err != nil {
+			return fmt.Errorf("Changed username, but unable to save profile: %s", err)
+		}
+	}
+	return nil
 }
 
 // SessionID returns the unique identifier for this session.
@@ -255,19 +597,86 @@ func parsePresence(value string) (username, sessionID string, timestamp time.Tim
 	return
 }
 
+// parsePresenceAbout processes META values that take the form of a presence
+// announcement followed by a line with the ID of a message, such as those of
+// "presence/typing" and "presence/seen".
+func parsePresenceAbout(value string) (username, sessionID, id string, err error) {
+	username, sessionID, _, err = parsePresence(value)
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(value, "\n", 4)
+	if len(parts) < 4 || parts[3] == "" {
+		err = fmt.Errorf("Message ID missing from presence message: %s", value)
+		return
+	}
+	id = parts[3]
+	return
+}
+
+// AnnounceTyping tells others that this session is composing a reply to the parent,
+// unless none of them support typing indicators.
+func (nc *NetClient) AnnounceTyping(parent, sessionID string) {
+	if !nc.peersSupport("presence/typing") {
+		return
+	}
+	nc.Composer.AnnounceTyping(parent, sessionID)
+}
+
+// AnnounceSeen tells others that this session has viewed the message with the given
+// ID, but only if ShareSeen is set and some of them support read indicators.
+func (nc *NetClient) AnnounceSeen(id, sessionID string) {
+	if !nc.ShareSeen || !nc.peersSupport("presence/seen") {
+		return
+	}
+	nc.Composer.AnnounceSeen(id, sessionID)
+}
+
+// SeenBy returns the other users who have viewed the message with the given ID or a
+// newer one, sorted by name. The author of the message is left out.
+func (nc *NetClient) SeenBy(id string) []string {
+	message := nc.Archive.Get(id)
+	if message == nil {
+		return nil
+	}
+	viewers := make([]string, 0)
+	for _, username := range nc.Viewers.SeenSince(message.Timestamp) {
+		if username != message.Username && !nc.Composer.IsOwnUsername(username) {
+			viewers = append(viewers, username)
+		}
+	}
+	return viewers
+}
+
+// Typing returns the other users who are composing replies, mapped to the ID of the
+// message that each is replying to.
+func (nc *NetClient) Typing() map[string]string {
+	return nc.Typists.Active(time.Now())
+}
+
 // HandleMeta implements META message protocol extension handlers.
 func (nc *NetClient) HandleMeta(meta map[string]string) {
+	nc.handleMeta(context.Background(), meta)
+}
+
+// handleMeta implements HandleMeta. Any responses are abandoned if ctx is done
+// before they can be sent.
+func (nc *NetClient) handleMeta(ctx context.Context, meta map[string]string) {
+	meta, ok := nc.hookMeta(meta)
+	if !ok {
+		return
+	}
 	for key, value := range meta {
 		switch key {
 		case "presence/who":
-			nc.Composer.AnnounceHere(nc.Session.ID)
+			nc.sendContext(ctx, herePresence(nc.Composer.Username(), nc.Session.ID))
 		case "presence/here":
 			username, sessionID, timestamp, err := parsePresence(value)
 			if err != nil {
 				log.Println("error parsing presence/here message", err)
 				continue
 			}
-			if username == nc.username && sessionID == nc.Session.ID {
+			if sessionID == nc.Session.ID {
 				// don't track our own session
 				continue
 			}
@@ -283,67 +692,118 @@ func (nc *NetClient) HandleMeta(meta map[string]string) {
 				log.Println("error parsing presence/leave message", err)
 				continue
 			}
-			if username == nc.username && sessionID == nc.Session.ID {
+			if sessionID == nc.Session.ID {
 				// don't remove our own session
 				continue
 			}
+			nc.Typists.Stop(username)
 			err = nc.List.Remove(username, sessionID)
 			if err != nil {
 				log.Println("Error removing session", err)
 				continue
 			}
 			log.Printf("Removed session (id=%s) for user %s\n", sessionID, username)
+		case "presence/typing":
+			username, sessionID, parent, err := parsePresenceAbout(value)
+			if err != nil {
+				log.Println("error parsing presence/typing message", err)
+				continue
+			}
+			if sessionID == nc.Session.ID {
+				// don't track our own session
+				continue
+			}
+			nc.Typists.Track(username, parent, time.Now())
+		case "presence/seen":
+			username, sessionID, id, err := parsePresenceAbout(value)
+			if err != nil {
+				log.Println("error parsing presence/seen message", err)
+				continue
+			}
+			if sessionID == nc.Session.ID {
+				// don't track our own session
+				continue
+			}
+			message := nc.Archive.Get(id)
+			if message == nil {
+				log.Printf("Ignoring view of unknown message %s by %s\n", id, username)
+				continue
+			}
+			nc.Viewers.Track(username, message.Timestamp)
+		case retractKey:
+			if err := nc.handleRevision(key, value); err != nil {
+				log.Printf("Ignoring %s message: %s\n", key, err)
+			}
+		case reactKey, unreactKey:
+			if err := nc.handleReaction(key, value); err != nil {
+				log.Printf("Ignoring %s message: %s\n", key, err)
+			}
+		case capabilitiesKey:
+			if err := nc.handleCapabilities(value); err != nil {
+				log.Printf("Ignoring %s message: %s\n", key, err)
+			}
 		default:
-			log.Println("Unknown meta key:", key)
+			nc.logUnknownMeta(key)
 		}
 	}
 }
 
-// recieve monitors for new messages and for connection staleness.
+// ping attempts to force a response from the server. This allows us to guard
+// against a stale connection.
+func (nc *NetClient) ping(ctx context.Context) {
+	// query for the root message
+	root, _ := nc.Archive.Root()
+	nc.sendContext(ctx, queryMessage(root))
+	nc.sendContext(ctx, whoMessage())
+}
+
+// receive monitors for new messages and for connection staleness.
 // If the connection with the server gets too stale, receive will close
 // it automatically.
-func (nc *NetClient) receive() {
-	errored := false
+func (nc *NetClient) receive(conn *connection) {
+	defer conn.wg.Done()
 	tick := time.NewTimer(timeout)
 	defer tick.Stop()
 	ticks := 0
-	out := nc.readChannel()
-	defer close(out)
+	messages := nc.readChannel(conn)
 	for {
 		select {
-		case <-nc.stopReceiving:
+		case <-conn.Done():
 			return
 		case <-tick.C:
 			ticks++
 			if ticks == 1 {
 				// we haven't heard from the server in 30 seconds,
 				// try to interact.
-				nc.pingServer <- struct{}{}
 				log.Println("No server contact in 30 seconds, pinging...")
-			} else if ticks > 1 {
+				tick.Reset(timeout)
+				nc.ping(conn.ctx)
+			} else {
 				// we haven't heard from the server in a minute,
 				// we're probably disconnected.
-				go nc.Disconnect()
 				log.Println("No server contact in 60 seconds, disconnecting")
+				nc.hangUp(conn)
+				return
 			}
-		case readMsg := <-out:
-			// reset our ticker to wait until 30 seconds from when we
+		case result := <-messages:
+			// reset our timer to wait until 30 seconds from when we
 			// received this message.
+			if !tick.Stop() {
+				select {
+				case <-tick.C:
+				default:
+				}
+			}
 			tick.Reset(timeout)
 			ticks = 0
 
-			// check for errors
-			m := readMsg.ProtocolMessage
-			err := readMsg.error
-			if !errored && err != nil {
-				errored = true
-				log.Println("Error reading from server:", err)
-				go nc.Disconnect()
-			} else if errored {
-				continue
+			if result.error != nil {
+				log.Println("Error reading from server:", result.error)
+				nc.hangUp(conn)
+				return
 			}
 			// process the message
-			nc.handleMessage(m)
+			nc.handleMessage(conn.ctx, result.ProtocolMessage)
 		}
 	}
 }
@@ -2,11 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	arbor "github.com/arborchat/arbor-go"
 	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/e2e"
+	"github.com/arborchat/muscadine/hook"
+	"github.com/arborchat/muscadine/profile"
+	"github.com/arborchat/muscadine/signing"
 	"github.com/arborchat/muscadine/types"
 	"github.com/onsi/gomega"
 )
@@ -69,3 +85,792 @@ func TestNetClient(t *testing.T) {
 
 	g.Eventually(func() int { return <-timesDisconnected }).Should(gomega.Equal(1))
 }
+
+// TestChangeUsername checks that changing the username of a NetClient announces the
+// change to the server and records it in the profile.
+func TestChangeUsername(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "before", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	profilePath := path.Join(os.TempDir(), nc.SessionID(), "server.profile")
+	defer os.RemoveAll(path.Dir(profilePath))
+	nc.Profile, err = profile.New(profilePath)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	g.Expect(nc.ChangeUsername("")).ToNot(gomega.BeNil())
+	g.Expect(nc.ChangeUsername("two\nlines")).ToNot(gomega.BeNil())
+	g.Expect(nc.ChangeUsername("after")).To(gomega.BeNil())
+	g.Expect(nc.Username()).To(gomega.Equal("after"))
+	g.Expect(nc.IsOwnUsername("before")).To(gomega.BeTrue())
+	g.Expect(nc.IsOwnUsername("after")).To(gomega.BeTrue())
+	g.Expect(nc.IsOwnUsername("someone")).To(gomega.BeFalse())
+
+	leave := <-nc.Composer.sendChan
+	username, sessionID, _, err := parsePresence(leave.Meta["presence/leave"])
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(username).To(gomega.Equal("before"))
+	g.Expect(sessionID).To(gomega.Equal(nc.SessionID()))
+	here := <-nc.Composer.sendChan
+	username, sessionID, _, err = parsePresence(here.Meta["presence/here"])
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(username).To(gomega.Equal("after"))
+	g.Expect(sessionID).To(gomega.Equal(nc.SessionID()))
+
+	saved, err := profile.Load(profilePath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(saved.Username).To(gomega.Equal("after"))
+}
+
+// TestRecent checks that notifications are sent for recent messages from anyone using a
+// username other than the current one, including one that this client used before.
+func TestRecent(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "muscadine", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	nc.Composer.SetUsername("after")
+	now := time.Now().Unix()
+	g.Expect(Recent(nc, &arbor.ChatMessage{Username: "after", Timestamp: now})).To(gomega.BeFalse())
+	g.Expect(Recent(nc, &arbor.ChatMessage{Username: "muscadine", Timestamp: now})).To(gomega.BeTrue())
+	g.Expect(Recent(nc, &arbor.ChatMessage{Username: "someone", Timestamp: now - 60})).To(gomega.BeFalse())
+}
+
+// TestHandlePresence checks that presence META messages from other sessions are
+// tracked while those describing this client's own session are ignored.
+func TestHandlePresence(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	nc.HandleMeta(map[string]string{"presence/here": "username\n" + nc.SessionID() + "\n" + now})
+	g.Expect(nc.ActiveSessions()).To(gomega.BeEmpty())
+
+	nc.HandleMeta(map[string]string{"presence/here": "other\nother-session\n" + now})
+	g.Expect(nc.ActiveSessions()).To(gomega.HaveKey("other"))
+
+	nc.HandleMeta(map[string]string{"presence/leave": "other\nother-session\n" + now})
+	g.Expect(nc.ActiveSessions()).To(gomega.BeEmpty())
+}
+
+// TestHandleTyping checks that other users are tracked as typing until their reply
+// arrives, while this client's own session is ignored.
+func TestHandleTyping(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	g.Expect(nc.Add(&arbor.ChatMessage{UUID: "parent", Username: "username", Content: "question"})).To(gomega.BeNil())
+	// typing isn't announced until someone can show it
+	nc.AnnounceTyping("parent", nc.SessionID())
+	g.Consistently(nc.Composer.sendChan, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	nc.HandleMeta(herePresence("other", "other-session").Meta)
+	go nc.AnnounceTyping("parent", nc.SessionID())
+	sent := <-nc.Composer.sendChan
+	nc.HandleMeta(sent.Meta)
+	g.Expect(nc.Typing()).To(gomega.BeEmpty())
+
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	nc.HandleMeta(map[string]string{"presence/typing": "other\nother-session\n" + now})
+	g.Expect(nc.Typing()).To(gomega.BeEmpty())
+	nc.HandleMeta(map[string]string{"presence/typing": "other\nother-session\n" + now + "\nparent"})
+	g.Expect(nc.Typing()).To(gomega.Equal(map[string]string{"other": "parent"}))
+
+	reply := &arbor.ChatMessage{UUID: "reply", Parent: "parent", Username: "other", Content: "done"}
+	nc.handleMessage(context.Background(), &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: reply})
+	g.Expect(nc.Typing()).To(gomega.BeEmpty())
+}
+
+// TestHandleSeen checks that views are only announced if the user opted in and someone
+// can show them, and that the newest message viewed by each other user is tracked.
+func TestHandleSeen(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	for i, id := range []string{"first", "second", "third"} {
+		message := &arbor.ChatMessage{UUID: id, Username: "author", Content: id, Timestamp: int64(i + 1)}
+		g.Expect(nc.Add(message)).To(gomega.BeNil())
+	}
+	nc.AnnounceSeen("second", nc.SessionID())
+	g.Consistently(nc.Composer.sendChan, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	nc.ShareSeen = true
+	nc.AnnounceSeen("second", nc.SessionID())
+	g.Consistently(nc.Composer.sendChan, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	nc.HandleMeta(herePresence("peer", "peer-session").Meta)
+	go nc.AnnounceSeen("second", nc.SessionID())
+	sent := <-nc.Composer.sendChan
+	nc.HandleMeta(sent.Meta)
+	g.Expect(nc.SeenBy("first")).To(gomega.BeEmpty())
+
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	nc.HandleMeta(map[string]string{"presence/seen": "other\nother-session\n" + now + "\nsecond"})
+	nc.HandleMeta(map[string]string{"presence/seen": "author\nauthor-session\n" + now + "\nthird"})
+	nc.HandleMeta(map[string]string{"presence/seen": "third\nthird-session\n" + now + "\nunknown"})
+	g.Expect(nc.SeenBy("first")).To(gomega.Equal([]string{"other"}))
+	g.Expect(nc.SeenBy("second")).To(gomega.Equal([]string{"other"}))
+	g.Expect(nc.SeenBy("third")).To(gomega.BeEmpty())
+}
+
+// TestCapabilities checks that the extensions supported by other sessions are learned
+// from their presence announcements, and that malformed announcements are rejected.
+func TestCapabilities(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	here := herePresence("other", "other-session")
+	username, sessionID, supported, err := parseCapabilities(here.Meta[capabilitiesKey])
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(username).To(gomega.Equal("other"))
+	g.Expect(sessionID).To(gomega.Equal("other-session"))
+	g.Expect(supported).To(gomega.Equal(capabilities))
+
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	for _, invalid := range []string{
+		"other\nother-session",
+		"other\nother-session\n" + now + "\nreaction/add",
+		"other\nother-session\n" + now + "\nreaction/add one",
+		"other\nother-session\n" + now + "\nreaction/add 0",
+	} {
+		_, _, _, err := parseCapabilities(invalid)
+		g.Expect(err).ToNot(gomega.BeNil(), invalid)
+	}
+
+	// our own session is never counted as a peer
+	nc.HandleMeta(herePresence("username", nc.SessionID()).Meta)
+	g.Expect(nc.peersSupport(reactKey)).To(gomega.BeFalse())
+	nc.HandleMeta(map[string]string{
+		"presence/here": "old\nold-session\n" + now,
+		capabilitiesKey: "old\nold-session\n" + now + "\nreaction/add 1",
+	})
+	g.Expect(nc.peersSupport(reactKey)).To(gomega.BeTrue())
+	g.Expect(nc.peersSupport(editKey)).To(gomega.BeFalse())
+	nc.HandleMeta(here.Meta)
+	g.Expect(nc.peersSupport(editKey)).To(gomega.BeTrue())
+	nc.HandleMeta(map[string]string{"presence/leave": "other\nother-session\n" + now})
+	g.Expect(nc.peersSupport(editKey)).To(gomega.BeFalse())
+}
+
+// TestHooks checks that the Hook can transform, drop, and annotate the messages that
+// the client sends and receives, that received messages are only rewritten for display,
+// that signed messages aren't rewritten, and that dropped messages aren't requested
+// again until the client restarts.
+func TestHooks(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	received := make(chan *arbor.ChatMessage, 10)
+	nc.OnReceive(func(m *arbor.ChatMessage) {
+		nc.Add(m)
+		received <- m
+	})
+	nc.Hook = hook.Func(func(event hook.Event) (hook.Result, error) {
+		switch event.Kind {
+		case hook.Meta:
+			if _, ok := event.Meta["presence/here"]; ok {
+				return hook.Result{Drop: true}, nil
+			}
+			return hook.Result{Meta: map[string]string{"presence/here": event.Meta["rewrite"]}}, nil
+		case hook.Outbound:
+			if event.Message.Content == "secret" {
+				return hook.Result{Drop: true}, nil
+			}
+		default:
+			if event.Message.Username == "bot" {
+				return hook.Result{Drop: true}, nil
+			}
+		}
+		content := strings.Replace(event.Message.Content, "ARB-1", "[ARB-1](https://example.com/ARB-1)", -1)
+		return hook.Result{Content: &content, Annotations: []string{"seen by hook"}}, nil
+	})
+	deliver := func(id, username, content string) {
+		chat := &arbor.ChatMessage{UUID: id, Username: username, Content: content, Timestamp: time.Now().Unix()}
+		nc.handleMessage(context.Background(), &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: chat})
+	}
+
+	deliver("linked", "other", "see ARB-1")
+	// rewrites are only shown, so the message is saved as it was sent
+	g.Expect((<-received).Content).To(gomega.Equal("see ARB-1"))
+	g.Expect(nc.Get("linked").Content).To(gomega.Equal("see ARB-1"))
+	shown, rewritten := nc.Rewritten("linked")
+	g.Expect(rewritten).To(gomega.BeTrue())
+	g.Expect(shown).To(gomega.Equal("see [ARB-1](https://example.com/ARB-1)"))
+	g.Expect(nc.Annotations("linked")).To(gomega.Equal([]string{"seen by hook"}))
+	deliver("muted", "bot", "beep")
+	g.Consistently(received, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	g.Expect(nc.Has("muted")).To(gomega.BeFalse())
+	// replies to dropped messages don't cause them to be requested
+	reply := &arbor.ChatMessage{UUID: "unmuted", Parent: "muted", Username: "other", Content: "hi", Timestamp: time.Now().Unix()}
+	go nc.handleMessage(context.Background(), &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: reply})
+	g.Expect((<-received).UUID).To(gomega.Equal("unmuted"))
+	g.Consistently(nc.Composer.sendChan, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	g.Expect(nc.Needed(10)).To(gomega.BeEmpty())
+	// drops aren't saved, so a client without the hook fetches the message again
+	g.Expect(nc.Archive.Needed(10)).To(gomega.Equal([]string{"muted"}))
+	unhooked, err := NewNetClient("localhost:7777", "username", history)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(unhooked.Needed(10)).To(gomega.Equal([]string{"muted"}))
+	signature := signing.SignaturePrefix + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":c2ln"
+	deliver("signed", "other", "see ARB-1"+signature)
+	g.Expect((<-received).Content).To(gomega.Equal("see ARB-1" + signature))
+	_, rewritten = nc.Rewritten("signed")
+	g.Expect(rewritten).To(gomega.BeFalse())
+	g.Expect(nc.Annotations("signed")).To(gomega.Equal([]string{"seen by hook"}))
+
+	go nc.Reply("linked", "fixed ARB-1")
+	sent := <-nc.Composer.sendChan
+	g.Expect(sent.Content).To(gomega.Equal("fixed [ARB-1](https://example.com/ARB-1)"))
+	g.Expect(nc.Reply("linked", "secret")).ToNot(gomega.BeNil())
+
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	nc.HandleMeta(map[string]string{"presence/here": "other\nother-session\n" + now})
+	g.Expect(nc.ActiveSessions()).To(gomega.BeEmpty())
+	nc.HandleMeta(map[string]string{"rewrite": "other\nother-session\n" + now})
+	g.Expect(nc.ActiveSessions()).To(gomega.HaveKey("other"))
+}
+
+// pipeConnector returns a Connector that connects over an in-memory pipe to a minimal
+// server. The server sends a new chat message to each client that connects, then
+// discards everything that the client sends until the connection is closed. The server
+// end of each connection is also sent over the returned channel.
+func pipeConnector(t *testing.T) (Connector, <-chan net.Conn) {
+	servers := make(chan net.Conn, 100)
+	count := 0
+	return func(address string) (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		count++
+		message := &arbor.ProtocolMessage{
+			Type: arbor.NewMessageType,
+			ChatMessage: &arbor.ChatMessage{
+				UUID:      fmt.Sprintf("message-%d", count),
+				Username:  "server",
+				Content:   "hello",
+				Timestamp: time.Now().Unix(),
+			},
+		}
+		go func() {
+			if err := json.NewEncoder(server).Encode(message); err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, server)
+		}()
+		servers <- server
+		return client, nil
+	}, servers
+}
+
+func pipeClientOrSkip(t *testing.T) (*NetClient, <-chan net.Conn) {
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	connector, servers := pipeConnector(t)
+	nc.SetConnector(connector)
+	return nc, servers
+}
+
+// TestConnectDisconnectCycles checks that a NetClient can be connected and disconnected
+// many times, that each connection is torn down cleanly, and that the disconnect handler
+// runs exactly once per connection even when Disconnect is called concurrently. Run it
+// with the race detector.
+func TestConnectDisconnectCycles(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	const cycles = 20
+	baseline := runtime.NumGoroutine()
+	nc, _ := pipeClientOrSkip(t)
+	received := make(chan *arbor.ChatMessage, cycles)
+	disconnected := make(chan struct{}, cycles*2)
+	nc.OnReceive(func(m *arbor.ChatMessage) {
+		received <- m
+	})
+	nc.OnDisconnect(func(types.Connection) {
+		disconnected <- struct{}{}
+	})
+	for i := 0; i < cycles; i++ {
+		g.Expect(nc.Connect()).To(gomega.BeNil())
+		g.Expect(nc.Connect()).ToNot(gomega.BeNil())
+		g.Eventually(received).Should(gomega.Receive())
+		var wg sync.WaitGroup
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.Expect(nc.Disconnect()).To(gomega.BeNil())
+			}()
+		}
+		wg.Wait()
+		g.Eventually(disconnected).Should(gomega.Receive())
+		g.Consistently(disconnected, 10*time.Millisecond).ShouldNot(gomega.Receive())
+	}
+	g.Expect(nc.Disconnect()).To(gomega.BeNil())
+	g.Eventually(runtime.NumGoroutine).Should(gomega.BeNumerically("<=", baseline+2))
+}
+
+// TestServerHangUp checks that a NetClient notices when the server closes the connection
+// and that it can connect again afterward.
+func TestServerHangUp(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	nc, servers := pipeClientOrSkip(t)
+	disconnected := make(chan struct{}, 2)
+	nc.OnReceive(func(m *arbor.ChatMessage) {})
+	nc.OnDisconnect(func(types.Connection) {
+		disconnected <- struct{}{}
+	})
+	for i := 0; i < 5; i++ {
+		g.Expect(nc.Connect()).To(gomega.BeNil())
+		server := <-servers
+		g.Expect(server.Close()).To(gomega.BeNil())
+		g.Eventually(disconnected).Should(gomega.Receive())
+		// the connection is already gone, so this does nothing
+		g.Expect(nc.Disconnect()).To(gomega.BeNil())
+		g.Consistently(disconnected, 10*time.Millisecond).ShouldNot(gomega.Receive())
+	}
+}
+
+// TestComposeWhileConnected checks that messages written by the Composer reach the
+// server, and that a Composer blocked while disconnected delivers its message once
+// a connection is established.
+func TestComposeWhileConnected(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	serverMessages := make(chan *arbor.ProtocolMessage, 10)
+	nc.SetConnector(func(address string) (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go func() {
+			decoder := json.NewDecoder(server)
+			for {
+				m := new(arbor.ProtocolMessage)
+				if err := decoder.Decode(m); err != nil {
+					return
+				}
+				serverMessages <- m
+			}
+		}()
+		return client, nil
+	})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		nc.Query("before-connecting")
+	}()
+	g.Consistently(sent, 10*time.Millisecond).ShouldNot(gomega.BeClosed())
+	g.Expect(nc.Connect()).To(gomega.BeNil())
+	g.Eventually(sent).Should(gomega.BeClosed())
+	var m *arbor.ProtocolMessage
+	g.Eventually(serverMessages).Should(gomega.Receive(&m))
+	g.Expect(m.Type).To(gomega.BeEquivalentTo(arbor.QueryType))
+	g.Expect(m.UUID).To(gomega.Equal("before-connecting"))
+	g.Expect(nc.Disconnect()).To(gomega.BeNil())
+}
+
+// TestSigning checks that a client with signing enabled signs its replies and
+// verifies its own messages.
+func TestSigning(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	message := &arbor.ChatMessage{UUID: "id", Username: "username", Content: "hello"}
+	result, content := nc.Verify(message)
+	g.Expect(result).To(gomega.Equal(types.NotChecked))
+	g.Expect(content).To(gomega.Equal("hello"))
+
+	dir := path.Join(os.TempDir(), nc.SessionID())
+	defer os.RemoveAll(dir)
+	identity, err := signing.LoadIdentity(path.Join(dir, "identity"))
+	if err != nil {
+		t.Skip(err)
+	}
+	keys, err := signing.LoadKeyStore(path.Join(dir, "known.keys"))
+	if err != nil {
+		t.Skip(err)
+	}
+	g.Expect(nc.EnableSigning(identity, keys)).To(gomega.BeNil())
+	go nc.Reply("parent", "hello")
+	sent := <-nc.Composer.sendChan
+	sent.UUID = "sent"
+	result, content = nc.Verify(sent.ChatMessage)
+	g.Expect(result).To(gomega.Equal(types.Verified))
+	g.Expect(content).To(gomega.Equal("hello"))
+
+	// messages are verified as they arrive, and forged ones are archived without
+	// being handed to the UI
+	mallory, err := signing.LoadIdentity(path.Join(dir, "mallory"))
+	if err != nil {
+		t.Skip(err)
+	}
+	received := make(chan *arbor.ChatMessage, 2)
+	nc.OnReceive(func(message *arbor.ChatMessage) {
+		received <- message
+	})
+	forged := &arbor.ChatMessage{UUID: "forged", Parent: "parent", Username: "username", Content: "it's me"}
+	mallory.Sign(forged)
+	result, _ = nc.Verify(forged)
+	g.Expect(result).To(gomega.Equal(types.Invalid))
+	nc.handleMessage(context.Background(), &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: forged})
+	g.Expect(received).ToNot(gomega.Receive())
+	g.Expect(nc.Archive.Has("forged")).To(gomega.BeTrue())
+
+	genuine := &arbor.ChatMessage{UUID: "genuine", Parent: "forged", Username: "mallory", Content: "hi"}
+	mallory.Sign(genuine)
+	result, _ = nc.Verify(genuine)
+	g.Expect(result).To(gomega.Equal(types.Unverified))
+	nc.handleMessage(context.Background(), &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: genuine})
+	g.Expect(received).To(gomega.Receive())
+	result, _ = nc.Verify(genuine)
+	g.Expect(result).To(gomega.Equal(types.Verified))
+	trusted, ok := keys.Trusted("mallory")
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(trusted).To(gomega.Equal(mallory.PublicKey()))
+}
+
+// TestEncryptedThreads checks that replies within protected threads are encrypted
+// after being signed, and that received messages are decrypted before they are
+// verified and handed to the UI.
+func TestEncryptedThreads(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	root := &arbor.ChatMessage{UUID: "root", Username: "username", Content: "root"}
+	g.Expect(nc.Add(root)).To(gomega.BeNil())
+	encrypted := &arbor.ChatMessage{UUID: "id", Parent: "root", Username: "username", Content: e2e.EncryptedPrefix + "key:AAAA"}
+	g.Expect(nc.Decrypt(encrypted)).To(gomega.Equal(e2e.NoKeyPlaceholder))
+	_, err = nc.ProtectThread("root")
+	g.Expect(err).ToNot(gomega.BeNil())
+
+	dir := path.Join(os.TempDir(), nc.SessionID())
+	defer os.RemoveAll(dir)
+	keyring, err := e2e.LoadKeyring(path.Join(dir, "threadkeys"))
+	if err != nil {
+		t.Skip(err)
+	}
+	identity, err := signing.LoadIdentity(path.Join(dir, "identity"))
+	if err != nil {
+		t.Skip(err)
+	}
+	keys, err := signing.LoadKeyStore(path.Join(dir, "known.keys"))
+	if err != nil {
+		t.Skip(err)
+	}
+	g.Expect(nc.EnableSigning(identity, keys)).To(gomega.BeNil())
+	nc.EnableEncryption(keyring)
+
+	go nc.Reply("root", "in the clear")
+	sent := <-nc.Composer.sendChan
+	g.Expect(e2e.IsEncrypted(sent.Content)).To(gomega.BeFalse())
+
+	shared, err := nc.ProtectThread("root")
+	g.Expect(err).To(gomega.BeNil())
+	added, err := nc.AddThreadKey(shared)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(added).To(gomega.Equal("root"))
+	go nc.Reply("root", "secret")
+	sent = <-nc.Composer.sendChan
+	g.Expect(e2e.IsEncrypted(sent.Content)).To(gomega.BeTrue())
+	g.Expect(sent.Content).ToNot(gomega.ContainSubstring("secret"))
+
+	received := make(chan *arbor.ChatMessage, 1)
+	nc.OnReceive(func(message *arbor.ChatMessage) {
+		received <- message
+	})
+	sent.UUID = "sent"
+	nc.handleMessage(context.Background(), sent)
+	message := <-received
+	result, content := nc.Verify(message)
+	g.Expect(result).To(gomega.Equal(types.Verified))
+	g.Expect(content).To(gomega.Equal("secret"))
+}
+
+// TestRevisions checks that authors can edit and retract their own messages, that edits
+// are sent as replies superseding the original, and that revisions are only honored
+// when they come from the author and carry the author's signature if the original did.
+func TestRevisions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	newClient := func(username string) *NetClient {
+		history, err := archive.NewManager(".")
+		if err != nil {
+			t.Skip(err)
+		}
+		nc, err := NewNetClient("localhost:7777", username, history)
+		if err != nil {
+			t.Skip(err)
+		}
+		dir := path.Join(os.TempDir(), nc.SessionID())
+		identity, err := signing.LoadIdentity(path.Join(dir, "identity"))
+		if err != nil {
+			t.Skip(err)
+		}
+		keys, err := signing.LoadKeyStore(path.Join(dir, "known.keys"))
+		if err != nil {
+			t.Skip(err)
+		}
+		if err := nc.EnableSigning(identity, keys); err != nil {
+			t.Skip(err)
+		}
+		return nc
+	}
+	author := newClient("author")
+	defer os.RemoveAll(path.Join(os.TempDir(), author.SessionID()))
+	reader := newClient("reader")
+	defer os.RemoveAll(path.Join(os.TempDir(), reader.SessionID()))
+	revised := make(chan string, 10)
+	reader.OnRevise(func(id string) {
+		revised <- id
+	})
+	reader.OnReceive(func(message *arbor.ChatMessage) {
+		g.Expect(reader.Add(message)).To(gomega.BeNil())
+	})
+
+	go author.Reply("", "helo")
+	sent := <-author.Composer.sendChan
+	sent.UUID = "typo"
+	theirs := &arbor.ChatMessage{UUID: "theirs", Username: "reader", Content: "hi"}
+	gone := &arbor.ChatMessage{UUID: "gone", Username: "author", Content: "oops"}
+	for _, nc := range []*NetClient{author, reader} {
+		g.Expect(nc.Add(sent.ChatMessage)).To(gomega.BeNil())
+		g.Expect(nc.Add(theirs)).To(gomega.BeNil())
+		g.Expect(nc.Add(gone)).To(gomega.BeNil())
+	}
+	g.Expect(author.Edit("theirs", "hello")).ToNot(gomega.BeNil())
+	g.Expect(author.Edit("missing", "hello")).ToNot(gomega.BeNil())
+	g.Expect(author.Edit("typo", "")).ToNot(gomega.BeNil())
+
+	// while no one else supports revisions, edits are refused and retractions are only
+	// applied locally
+	g.Expect(author.Edit("typo", "hello")).ToNot(gomega.BeNil())
+	g.Expect(author.Retract("gone")).To(gomega.BeNil())
+	g.Expect(author.Revisions("gone")).To(gomega.HaveLen(1))
+	g.Consistently(author.Composer.sendChan, 20*time.Millisecond).ShouldNot(gomega.Receive())
+
+	author.HandleMeta(herePresence("reader", reader.SessionID()).Meta)
+	go author.Edit("typo", "hello")
+	edit := <-author.Composer.sendChan
+	g.Expect(edit.Type).To(gomega.BeEquivalentTo(arbor.NewMessageType))
+	g.Expect(edit.Parent).To(gomega.Equal("typo"))
+	g.Expect(edit.Content).To(gomega.HavePrefix("hello" + editMarker))
+	// the edit is applied once the server echoes it
+	g.Expect(author.Revisions("typo")).To(gomega.BeEmpty())
+	edit.UUID = "edit"
+	g.Expect(author.Add(edit.ChatMessage)).To(gomega.BeNil())
+	g.Expect(author.Revisions("typo")).To(gomega.HaveLen(1))
+	g.Expect(author.Revisions("typo")[0].Content).To(gomega.Equal("hello"))
+
+	reader.handleMessage(context.Background(), edit)
+	g.Expect(<-revised).To(gomega.Equal("typo"))
+	g.Expect(reader.IsRevision(edit.ChatMessage)).To(gomega.BeTrue())
+	g.Expect(reader.Revisions("typo")).To(gomega.Equal(author.Revisions("typo")))
+
+	// others can't edit the message, replies without the marker aren't edits, and the
+	// author can't edit a signed message without signing the edit
+	forgeries := []*arbor.ChatMessage{
+		{UUID: "mine", Parent: "typo", Username: "reader", Content: "mine now" + editMarker, Timestamp: 1},
+		{UUID: "reply", Parent: "typo", Username: "author", Content: "just a reply", Timestamp: 1},
+		{UUID: "unsigned", Parent: "typo", Username: "author", Content: "unsigned" + editMarker, Timestamp: 1},
+	}
+	for _, forged := range forgeries {
+		g.Expect(reader.Add(forged)).To(gomega.BeNil())
+		g.Expect(reader.IsRevision(forged)).To(gomega.BeFalse())
+	}
+	g.Expect(reader.Revisions("typo")).To(gomega.HaveLen(1))
+
+	g.Expect(author.Retract("typo")).To(gomega.BeNil())
+	g.Expect(author.Revisions("typo")).To(gomega.HaveLen(2))
+	retraction := <-author.Composer.sendChan
+	g.Expect(retraction.Meta).To(gomega.HaveKey(retractKey))
+
+	// retractions from unknown sessions are ignored
+	reader.HandleMeta(retraction.Meta)
+	g.Expect(reader.Revisions("typo")).To(gomega.HaveLen(1))
+	// as are those claiming to come from the session that receives them
+	forged := revisionMessage(retractKey, "theirs", reader.SessionID(), revisionChat(retractKey, "theirs", "reader", 1, ""))
+	reader.HandleMeta(forged.Meta)
+	g.Expect(reader.Revisions("theirs")).To(gomega.BeEmpty())
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	reader.HandleMeta(map[string]string{"presence/here": "author\n" + author.SessionID() + "\n" + now})
+	// the author's session can't retract a signed message without signing the retraction
+	forged = revisionMessage(retractKey, "typo", author.SessionID(), revisionChat(retractKey, "typo", "author", 1, ""))
+	reader.HandleMeta(forged.Meta)
+	g.Expect(reader.Revisions("typo")).To(gomega.HaveLen(1))
+
+	reader.HandleMeta(retraction.Meta)
+	g.Expect(<-revised).To(gomega.Equal("typo"))
+	revisions := reader.Revisions("typo")
+	g.Expect(revisions).To(gomega.HaveLen(2))
+	g.Expect(revisions[1].Retracted).To(gomega.BeTrue())
+	g.Expect(revisions[1].Content).To(gomega.BeEmpty())
+}
+
+// TestEncryptedRevisions checks that edits within protected threads are encrypted like
+// replies and are recognized once their key is known.
+func TestEncryptedRevisions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	newClient := func(username string) *NetClient {
+		history, err := archive.NewManager(".")
+		if err != nil {
+			t.Skip(err)
+		}
+		nc, err := NewNetClient("localhost:7777", username, history)
+		if err != nil {
+			t.Skip(err)
+		}
+		keyring, err := e2e.LoadKeyring(path.Join(os.TempDir(), nc.SessionID(), "threadkeys"))
+		if err != nil {
+			t.Skip(err)
+		}
+		nc.EnableEncryption(keyring)
+		return nc
+	}
+	author := newClient("author")
+	defer os.RemoveAll(path.Join(os.TempDir(), author.SessionID()))
+	reader := newClient("reader")
+	defer os.RemoveAll(path.Join(os.TempDir(), reader.SessionID()))
+
+	root := &arbor.ChatMessage{UUID: "root", Username: "reader", Content: "root"}
+	g.Expect(author.Add(root)).To(gomega.BeNil())
+	g.Expect(reader.Add(root)).To(gomega.BeNil())
+	shared, err := author.ProtectThread("root")
+	g.Expect(err).To(gomega.BeNil())
+	go author.Reply("root", "helo")
+	sent := <-author.Composer.sendChan
+	sent.UUID = "typo"
+	g.Expect(author.Add(sent.ChatMessage)).To(gomega.BeNil())
+	g.Expect(reader.Add(sent.ChatMessage)).To(gomega.BeNil())
+
+	author.HandleMeta(herePresence("reader", reader.SessionID()).Meta)
+	go author.Edit("typo", "hello")
+	edit := <-author.Composer.sendChan
+	g.Expect(e2e.IsEncrypted(edit.Content)).To(gomega.BeTrue())
+	g.Expect(edit.Content).ToNot(gomega.ContainSubstring("hello"))
+	edit.UUID = "edit"
+	g.Expect(author.Add(edit.ChatMessage)).To(gomega.BeNil())
+	g.Expect(author.Revisions("typo")[0].Content).To(gomega.Equal("hello"))
+
+	g.Expect(reader.Add(edit.ChatMessage)).To(gomega.BeNil())
+	g.Expect(reader.IsRevision(edit.ChatMessage)).To(gomega.BeFalse())
+	g.Expect(reader.Revisions("typo")).To(gomega.BeEmpty())
+	_, err = reader.AddThreadKey(shared)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(reader.IsRevision(edit.ChatMessage)).To(gomega.BeTrue())
+	g.Expect(reader.Revisions("typo")[0].Content).To(gomega.Equal("hello"))
+}
+
+// TestReactions checks that reactions from known sessions are aggregated, that reacting
+// twice with the same tag withdraws the reaction, that reactions are only sent when
+// another session supports them, and that reactions claiming to come from this session
+// are ignored.
+func TestReactions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("localhost:7777", "username", history)
+	if err != nil {
+		t.Skip(err)
+	}
+	reacted := make(chan string, 10)
+	nc.OnReact(func(id string) {
+		reacted <- id
+	})
+	g.Expect(nc.Add(&arbor.ChatMessage{UUID: "news", Username: "other", Content: "we shipped"})).To(gomega.BeNil())
+	g.Expect(nc.React("missing", "+1")).ToNot(gomega.BeNil())
+	g.Expect(nc.React("news", "not a tag")).ToNot(gomega.BeNil())
+
+	// reactions are only announced if someone else supports them
+	g.Expect(nc.React("news", "ok")).To(gomega.BeNil())
+	g.Expect(<-reacted).To(gomega.Equal("news"))
+	g.Expect(nc.Reactions("news")).To(gomega.Equal([]types.Reaction{{Tag: "ok", Usernames: []string{"username"}}}))
+	g.Expect(nc.React("news", "ok")).To(gomega.BeNil())
+	g.Expect(<-reacted).To(gomega.Equal("news"))
+	g.Consistently(nc.Composer.sendChan, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	g.Expect(nc.Reactions("news")).To(gomega.BeEmpty())
+
+	nc.HandleMeta(herePresence("peer", "peer-session").Meta)
+	g.Expect(nc.React("news", "+1")).To(gomega.BeNil())
+	g.Expect(<-reacted).To(gomega.Equal("news"))
+	sent := <-nc.Composer.sendChan
+	g.Expect(sent.Meta).To(gomega.HaveKeyWithValue(reactKey, "news\nusername\n"+nc.SessionID()+"\n+1"))
+
+	// reactions from unknown sessions are ignored
+	reaction := map[string]string{reactKey: "news\nother\nother-session\n+1"}
+	nc.HandleMeta(reaction)
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	nc.HandleMeta(map[string]string{"presence/here": "other\nother-session\n" + now})
+	nc.HandleMeta(reaction)
+	g.Expect(<-reacted).To(gomega.Equal("news"))
+	g.Expect(nc.Reactions("news")).To(gomega.Equal([]types.Reaction{{Tag: "+1", Usernames: []string{"other", "username"}}}))
+
+	g.Expect(nc.React("news", "+1")).To(gomega.BeNil())
+	g.Expect(<-reacted).To(gomega.Equal("news"))
+	sent = <-nc.Composer.sendChan
+	g.Expect(sent.Meta).To(gomega.HaveKey(unreactKey))
+	g.Expect(nc.Reactions("news")).To(gomega.Equal([]types.Reaction{{Tag: "+1", Usernames: []string{"other"}}}))
+
+	// reactions claiming to come from this session are forged
+	nc.HandleMeta(map[string]string{reactKey: "news\nmallory\n" + nc.SessionID() + "\n-1"})
+	nc.HandleMeta(map[string]string{unreactKey: "news\nother\n" + nc.SessionID() + "\n+1"})
+	g.Consistently(reacted, 20*time.Millisecond).ShouldNot(gomega.Receive())
+	g.Expect(nc.Reactions("news")).To(gomega.Equal([]types.Reaction{{Tag: "+1", Usernames: []string{"other"}}}))
+}
@@ -2,61 +2,160 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/signing"
 )
 
 // Composer writes arbor protocol messages
 type Composer struct {
-	username string
-	sendChan chan *arbor.ProtocolMessage
+	usernameLock sync.RWMutex
+	username     string
+	// formerUsernames holds every name that this Composer has used before its
+	// current one.
+	formerUsernames map[string]struct{}
+	sendChan        chan *arbor.ProtocolMessage
+	// signer, if set, signs the messages that the Composer sends
+	signer *signing.Identity
 }
 
-// Reply sends a reply to `parent` with the given message content.
+// Username returns the name that the Composer currently signs messages with.
+func (c *Composer) Username() string {
+	c.usernameLock.RLock()
+	defer c.usernameLock.RUnlock()
+	return c.username
+}
+
+// SetUsername changes the name that the Composer signs subsequent messages with.
+func (c *Composer) SetUsername(username string) {
+	c.usernameLock.Lock()
+	defer c.usernameLock.Unlock()
+	if c.formerUsernames == nil {
+		c.formerUsernames = make(map[string]struct{})
+	}
+	c.formerUsernames[c.username] = struct{}{}
+	c.username = username
+}
+
+// IsOwnUsername returns whether the given username is either the current username of
+// the Composer or one that it used earlier.
+func (c *Composer) IsOwnUsername(username string) bool {
+	c.usernameLock.RLock()
+	defer c.usernameLock.RUnlock()
+	_, former := c.formerUsernames[username]
+	return former || username == c.username
+}
+
+// Reply sends a reply to `parent` with the given message content. The message is
+// signed if the Composer has an identity.
 func (c *Composer) Reply(parent, content string) error {
-	chat, err := arbor.NewChatMessage(content)
+	chat, err := c.compose(parent, content)
 	if err != nil {
 		return err
 	}
-	chat.Parent = parent
-	chat.Username = c.username
-	proto := &arbor.ProtocolMessage{ChatMessage: chat, Type: arbor.NewMessageType}
-	c.sendChan <- proto
+	c.sendChat(chat)
 	return nil
 }
 
+// compose creates a reply to `parent` with the given message content, signing it if
+// the Composer has an identity.
+func (c *Composer) compose(parent, content string) (*arbor.ChatMessage, error) {
+	chat, err := arbor.NewChatMessage(content)
+	if err != nil {
+		return nil, err
+	}
+	chat.Parent = parent
+	chat.Username = c.Username()
+	if c.signer != nil {
+		c.signer.Sign(chat)
+	}
+	return chat, nil
+}
+
+// sendChat sends the chat message to the server.
+func (c *Composer) sendChat(chat *arbor.ChatMessage) {
+	c.sendChan <- &arbor.ProtocolMessage{ChatMessage: chat, Type: arbor.NewMessageType}
+}
+
+// queryMessage creates a QUERY message for the message with the given ID.
+func queryMessage(id string) *arbor.ProtocolMessage {
+	return &arbor.ProtocolMessage{Type: arbor.QueryType, ChatMessage: &arbor.ChatMessage{UUID: id}}
+}
+
 // Query sends a query for the message with the given ID.
 func (c *Composer) Query(id string) {
-	c.sendChan <- &arbor.ProtocolMessage{Type: arbor.QueryType, ChatMessage: &arbor.ChatMessage{UUID: id}}
+	c.sendChan <- queryMessage(id)
 }
 
-// AnnounceHere sends a "presence/here" META message.
-func (c *Composer) AnnounceHere(sessionID string) {
-	c.sendChan <- &arbor.ProtocolMessage{
+// metaMessage creates a META message for the key whose value is the fields, one per
+// line.
+func metaMessage(key string, fields ...string) *arbor.ProtocolMessage {
+	return &arbor.ProtocolMessage{
 		Type: arbor.MetaType,
 		Meta: map[string]string{
-			"presence/here": c.username + "\n" + sessionID + "\n" + fmt.Sprintf("%d", time.Now().Unix()),
+			key: strings.Join(fields, "\n"),
 		},
 	}
 }
 
+// herePresence creates a "presence/here" META message for the given user's session,
+// accompanied by the protocol extensions that it supports.
+func herePresence(username, sessionID string) *arbor.ProtocolMessage {
+	message := metaMessage("presence/here", username, sessionID, fmt.Sprintf("%d", time.Now().Unix()))
+	message.Meta[capabilitiesKey] = capabilitiesValue(username, sessionID)
+	return message
+}
+
+// AnnounceHere sends a "presence/here" META message.
+func (c *Composer) AnnounceHere(sessionID string) {
+	c.sendChan <- herePresence(c.Username(), sessionID)
+}
+
 // AnnounceLeaving sends a "presence/leave" META message.
 func (c *Composer) AnnounceLeaving(sessionID string) {
-	c.sendChan <- &arbor.ProtocolMessage{
+	c.sendChan <- metaMessage("presence/leave", c.Username(), sessionID, fmt.Sprintf("%d", time.Now().Unix()))
+}
+
+// AnnounceRename sends a "presence/leave" META message for the session under its old
+// username followed by a "presence/here" META message under its new username.
+func (c *Composer) AnnounceRename(oldUsername, newUsername, sessionID string) {
+	c.sendChan <- metaMessage("presence/leave", oldUsername, sessionID, fmt.Sprintf("%d", time.Now().Unix()))
+	c.sendChan <- herePresence(newUsername, sessionID)
+}
+
+// typingMessage creates a "presence/typing" META message announcing that the user's
+// session is composing a reply to the parent. Its value is that of a presence
+// announcement followed by the ID of the parent.
+func typingMessage(username, sessionID, parent string) *arbor.ProtocolMessage {
+	return metaMessage("presence/typing", username, sessionID, fmt.Sprintf("%d", time.Now().Unix()), parent)
+}
+
+// AnnounceTyping sends a "presence/typing" META message.
+func (c *Composer) AnnounceTyping(parent, sessionID string) {
+	c.sendChan <- typingMessage(c.Username(), sessionID, parent)
+}
+
+// AnnounceSeen sends a "presence/seen" META message announcing that the user's
+// session has viewed the message with the given ID. Its value is that of a presence
+// announcement followed by the ID.
+func (c *Composer) AnnounceSeen(id, sessionID string) {
+	c.sendChan <- metaMessage("presence/seen", c.Username(), sessionID, fmt.Sprintf("%d", time.Now().Unix()), id)
+}
+
+// whoMessage creates a "presence/who" META message.
+func whoMessage() *arbor.ProtocolMessage {
+	return &arbor.ProtocolMessage{
 		Type: arbor.MetaType,
 		Meta: map[string]string{
-			"presence/leave": c.username + "\n" + sessionID + "\n" + fmt.Sprintf("%d", time.Now().Unix()),
+			"presence/who": "",
 		},
 	}
 }
 
 // AskWho sends a "presence/who" META message.
 func (c *Composer) AskWho() {
-	c.sendChan <- &arbor.ProtocolMessage{
-		Type: arbor.MetaType,
-		Meta: map[string]string{
-			"presence/who": "",
-		},
-	}
+	c.sendChan <- whoMessage()
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	arbor "github.com/arborchat/arbor-go"
+)
+
+// connection is a single live connection to a server. Every goroutine servicing
+// the connection should stop once its context is done, and should be tracked by its
+// wg so that the connection can be torn down cleanly.
+type connection struct {
+	arbor.ReadWriteCloser
+	raw    io.ReadWriteCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wg tracks the goroutines servicing the connection
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newConnection wraps the raw transport to a server in the arbor protocol.
+func newConnection(raw io.ReadWriteCloser) (*connection, error) {
+	protocol, err := arbor.NewProtocolReadWriter(raw)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connection{
+		ReadWriteCloser: protocol,
+		raw:             raw,
+		ctx:             ctx,
+		cancel:          cancel,
+	}, nil
+}
+
+// Close cancels the connection's context and closes it. It is safe to call more
+// than once, and always returns the result of the first call.
+func (c *connection) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		// Closing the underlying transport first unblocks any reads or writes that
+		// are in progress. The protocol layer can't shut down until they finish.
+		c.closeErr = c.raw.Close()
+		// the protocol layer closes the transport again, which may fail harmlessly
+		_ = c.ReadWriteCloser.Close()
+	})
+	return c.closeErr
+}
+
+// Done returns a channel that is closed when the connection begins to close.
+func (c *connection) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
@@ -0,0 +1,249 @@
+// Package e2e protects threads so that only the people who have their key can read
+// them. A protected thread is the subtree of replies beneath a root message. The
+// content of each reply within it is encrypted with a symmetric key that is shared
+// among participants out-of-band, such as in person or over another secure channel.
+// Servers and other users see only ciphertext.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+)
+
+// EncryptedPrefix begins the content of every encrypted message. It is followed by the
+// ID of the key that encrypted it, a colon, and the base64-encoded nonce and ciphertext.
+const EncryptedPrefix = "\u2063e2e:"
+
+// SharedKeyPrefix begins the text form of a thread key, which is what participants
+// share with one another. It is followed by the ID of the thread's root message, a
+// colon, and the base64-encoded key.
+const SharedKeyPrefix = "arbor-thread-key:"
+
+// NoKeyPlaceholder is shown in place of the content of an encrypted message when
+// its key is not known.
+const NoKeyPlaceholder = "[encrypted, no key]"
+
+// UnreadablePlaceholder is shown in place of the content of an encrypted message that
+// could not be decrypted with the key that it names.
+const UnreadablePlaceholder = "[encrypted, unreadable]"
+
+// keySize is the length of thread keys, which are AES-256 keys.
+const keySize = 32
+
+// IsEncrypted returns whether the content is encrypted.
+func IsEncrypted(content string) bool {
+	return strings.HasPrefix(content, EncryptedPrefix)
+}
+
+// ThreadKey is the key that protects a thread.
+type ThreadKey struct {
+	// Root is the ID of the message beneath which replies are encrypted.
+	Root string
+	Key  []byte
+}
+
+// ID returns a short identifier for the key that is included in each message that it
+// encrypts. It reveals nothing about the key itself.
+func (k ThreadKey) ID() string {
+	sum := sha256.Sum256(append([]byte("arbor-thread-key-id\x00"), k.Key...))
+	return base64.RawURLEncoding.EncodeToString(sum[:9])
+}
+
+// Shared returns the text form of the key to give to other participants.
+func (k ThreadKey) Shared() string {
+	return SharedKeyPrefix + k.Root + ":" + base64.StdEncoding.EncodeToString(k.Key)
+}
+
+// ParseShared reads a key in the text form produced by Shared.
+func ParseShared(shared string) (ThreadKey, error) {
+	var key ThreadKey
+	shared = strings.TrimSpace(shared)
+	fields := strings.Split(strings.TrimPrefix(shared, SharedKeyPrefix), ":")
+	if !strings.HasPrefix(shared, SharedKeyPrefix) || len(fields) != 2 || fields[0] == "" {
+		return key, fmt.Errorf("Thread keys look like %s<root-id>:<key>", SharedKeyPrefix)
+	}
+	raw, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(raw) != keySize {
+		return key, fmt.Errorf("Thread key is corrupt")
+	}
+	return ThreadKey{Root: fields[0], Key: raw}, nil
+}
+
+// additionalData returns the data authenticated along with a message's content. It
+// binds the ciphertext to the message's place in the thread and to its author.
+func additionalData(message *arbor.ChatMessage) []byte {
+	return []byte(message.Parent + "\x00" + message.Username)
+}
+
+// aead returns the cipher that encrypts messages with the key.
+func (k ThreadKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt replaces the content of the message with its ciphertext. The message's
+// Parent and Username must already be set, since they are authenticated with it.
+func (k ThreadKey) Encrypt(message *arbor.ChatMessage) error {
+	aead, err := k.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(message.Content), additionalData(message))
+	message.Content = EncryptedPrefix + k.ID() + ":" + base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// Keyring holds the keys of the threads that the user participates in. It is safe for
+// concurrent use.
+type Keyring struct {
+	lock sync.Mutex
+	// Keys maps the ID of each key to the key.
+	Keys map[string]ThreadKey
+	// Added maps the ID of each key to when it was added, in nanoseconds since the
+	// UNIX epoch. Keys added by older versions have no entry.
+	Added map[string]int64 `json:",omitempty"`
+	path  string
+}
+
+// LoadKeyring reads the Keyring stored at the given path. If none has been stored
+// there yet, an empty Keyring is returned.
+func LoadKeyring(keyringPath string) (*Keyring, error) {
+	if keyringPath == "" {
+		return nil, fmt.Errorf("Path may not be the empty string")
+	}
+	k := &Keyring{Keys: make(map[string]ThreadKey), Added: make(map[string]int64), path: keyringPath}
+	data, err := ioutil.ReadFile(keyringPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return k, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("Unable to decode thread keys %s: %s", keyringPath, err)
+	}
+	if k.Keys == nil {
+		k.Keys = make(map[string]ThreadKey)
+	}
+	if k.Added == nil {
+		k.Added = make(map[string]int64)
+	}
+	return k, nil
+}
+
+// Protect generates a new key for the thread beneath the root message, adds it to the
+// Keyring, and returns it.
+func (k *Keyring) Protect(root string) (ThreadKey, error) {
+	key := ThreadKey{Root: root, Key: make([]byte, keySize)}
+	if root == "" {
+		return key, fmt.Errorf("Cannot protect a thread without a root")
+	}
+	if _, err := io.ReadFull(rand.Reader, key.Key); err != nil {
+		return key, err
+	}
+	return key, k.Add(key)
+}
+
+// Add adds the key to the Keyring and saves it. Adding a key that is already in the
+// Keyring doesn't change when it was added.
+func (k *Keyring) Add(key ThreadKey) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	id := key.ID()
+	if _, ok := k.Keys[id]; !ok {
+		k.Added[id] = time.Now().UnixNano()
+	}
+	k.Keys[id] = key
+	return k.save()
+}
+
+// ForThread returns the key that protects the thread containing a message, given the
+// IDs of that message and its ancestors, nearest first. If more than one of them is
+// protected, the key of the nearest is used. If a thread has several keys, such as
+// when it was protected more than once, the one added most recently is used.
+func (k *Keyring) ForThread(lineage []string) (ThreadKey, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for _, id := range lineage {
+		newest, found := "", false
+		for keyID, key := range k.Keys {
+			if key.Root != id {
+				continue
+			}
+			// keys added at the same time are ordered by ID so that the choice is stable
+			if !found || k.Added[keyID] > k.Added[newest] || (k.Added[keyID] == k.Added[newest] && keyID > newest) {
+				newest, found = keyID, true
+			}
+		}
+		if found {
+			return k.Keys[newest], true
+		}
+	}
+	return ThreadKey{}, false
+}
+
+// Decrypt returns the plaintext of the message's content. If the content isn't
+// encrypted, it is returned unchanged. The final return value is false if the content
+// is encrypted but can't be decrypted, in which case a placeholder is returned.
+func (k *Keyring) Decrypt(message *arbor.ChatMessage) (string, bool) {
+	if !IsEncrypted(message.Content) {
+		return message.Content, true
+	}
+	fields := strings.SplitN(strings.TrimPrefix(message.Content, EncryptedPrefix), ":", 2)
+	if len(fields) != 2 {
+		return UnreadablePlaceholder, false
+	}
+	k.lock.Lock()
+	key, ok := k.Keys[fields[0]]
+	k.lock.Unlock()
+	if !ok {
+		return NoKeyPlaceholder, false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return UnreadablePlaceholder, false
+	}
+	aead, err := key.aead()
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return UnreadablePlaceholder, false
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], additionalData(message))
+	if err != nil {
+		return UnreadablePlaceholder, false
+	}
+	return string(plaintext), true
+}
+
+// save writes the Keyring to its path. The caller must hold its lock.
+func (k *Keyring) save() error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(k.path, data, 0600)
+}
@@ -0,0 +1,130 @@
+package e2e_test
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/e2e"
+	uuid "github.com/nu7hatch/gouuid"
+	"github.com/onsi/gomega"
+)
+
+// keyringOrSkip loads a Keyring from a path within the temporary directory that
+// does not exist yet. The returned function removes it.
+func keyringOrSkip(t *testing.T) (*e2e.Keyring, string, func()) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Skip(err)
+	}
+	dir := path.Join(os.TempDir(), id.String())
+	keyringPath := path.Join(dir, "threadkeys")
+	keyring, err := e2e.LoadKeyring(keyringPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	return keyring, keyringPath, func() { os.RemoveAll(dir) }
+}
+
+// TestEncrypt checks that messages encrypted with a thread's key can be decrypted by
+// anyone holding the key, and only by them.
+func TestEncrypt(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	keyring, _, cleanup := keyringOrSkip(t)
+	defer cleanup()
+	key, err := keyring.Protect("root")
+	g.Expect(err).To(gomega.BeNil())
+	message := &arbor.ChatMessage{UUID: "id", Parent: "root", Username: "alice", Content: "secret"}
+	g.Expect(key.Encrypt(message)).To(gomega.BeNil())
+	g.Expect(e2e.IsEncrypted(message.Content)).To(gomega.BeTrue())
+	g.Expect(message.Content).ToNot(gomega.ContainSubstring("secret"))
+
+	content, ok := keyring.Decrypt(message)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(content).To(gomega.Equal("secret"))
+
+	other, _, cleanupOther := keyringOrSkip(t)
+	defer cleanupOther()
+	content, ok = other.Decrypt(message)
+	g.Expect(ok).To(gomega.BeFalse())
+	g.Expect(content).To(gomega.Equal(e2e.NoKeyPlaceholder))
+
+	moved := *message
+	moved.Parent = "elsewhere"
+	content, ok = keyring.Decrypt(&moved)
+	g.Expect(ok).To(gomega.BeFalse())
+	g.Expect(content).To(gomega.Equal(e2e.UnreadablePlaceholder))
+
+	plain := &arbor.ChatMessage{UUID: "plain", Content: "hello"}
+	content, ok = other.Decrypt(plain)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(content).To(gomega.Equal("hello"))
+}
+
+// TestParseShared checks that keys survive being shared as text and that malformed
+// keys are rejected.
+func TestParseShared(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	keyring, _, cleanup := keyringOrSkip(t)
+	defer cleanup()
+	key, err := keyring.Protect("root")
+	g.Expect(err).To(gomega.BeNil())
+	parsed, err := e2e.ParseShared(" " + key.Shared() + "\n")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(parsed).To(gomega.Equal(key))
+	g.Expect(parsed.ID()).To(gomega.Equal(key.ID()))
+
+	for _, shared := range []string{
+		"",
+		"root:" + strings.TrimPrefix(key.Shared(), e2e.SharedKeyPrefix+"root:"),
+		e2e.SharedKeyPrefix + ":AAAA",
+		e2e.SharedKeyPrefix + "root:not base64",
+		e2e.SharedKeyPrefix + "root:AAAA",
+	} {
+		_, err := e2e.ParseShared(shared)
+		g.Expect(err).ToNot(gomega.BeNil(), shared)
+	}
+}
+
+// TestKeyring checks that a Keyring finds the nearest protected thread and that its
+// keys are persisted.
+func TestKeyring(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	keyring, keyringPath, cleanup := keyringOrSkip(t)
+	defer cleanup()
+	_, ok := keyring.ForThread([]string{"reply", "root"})
+	g.Expect(ok).To(gomega.BeFalse())
+	outer, err := keyring.Protect("root")
+	g.Expect(err).To(gomega.BeNil())
+	inner, err := keyring.Protect("reply")
+	g.Expect(err).To(gomega.BeNil())
+	_, err = keyring.Protect("")
+	g.Expect(err).ToNot(gomega.BeNil())
+
+	key, ok := keyring.ForThread([]string{"nested", "reply", "root"})
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(key).To(gomega.Equal(inner))
+	key, ok = keyring.ForThread([]string{"sibling", "root"})
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(key).To(gomega.Equal(outer))
+
+	// the newest key of a thread that was protected again is used
+	newer, err := keyring.Protect("root")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(keyring.Add(outer)).To(gomega.BeNil())
+	for i := 0; i < 10; i++ {
+		key, ok = keyring.ForThread([]string{"sibling", "root"})
+		g.Expect(ok).To(gomega.BeTrue())
+		g.Expect(key).To(gomega.Equal(newer))
+	}
+
+	info, err := os.Stat(keyringPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(info.Mode().Perm()).To(gomega.Equal(os.FileMode(0600)))
+	reloaded, err := e2e.LoadKeyring(keyringPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(reloaded.Keys).To(gomega.Equal(keyring.Keys))
+	g.Expect(reloaded.Added).To(gomega.Equal(keyring.Added))
+}
@@ -0,0 +1,240 @@
+// Package headless implements a front-end for muscadine that has no user interface.
+// It is intended to run unattended on a server, where it keeps a connection open,
+// fills gaps in the history, and regularly saves everything that it receives.
+package headless
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/types"
+)
+
+const (
+	// DefaultSaveInterval is how often new messages are saved by default.
+	DefaultSaveInterval = time.Minute
+	// DefaultQueryInterval is how often missing messages are requested by default.
+	DefaultQueryInterval = 30 * time.Second
+	// reconnectDelay is how long to wait between connection attempts.
+	reconnectDelay = 5 * time.Second
+	// leaveTimeout bounds how long shutdown waits to announce that we are leaving.
+	leaveTimeout = 5 * time.Second
+	// queryBatchSize is the maximum number of missing messages requested at once.
+	queryBatchSize = 50
+)
+
+// Config controls the behavior of a Daemon.
+type Config struct {
+	// SaveInterval is how often the history is saved if it has changed.
+	SaveInterval time.Duration
+	// QueryInterval is how often missing messages are requested from the server. If
+	// the client requests them on its own, its progress is logged this often instead.
+	QueryInterval time.Duration
+}
+
+// Daemon is a types.UI that displays nothing. Every message that it receives is added
+// to the client's archive, which is saved periodically.
+type Daemon struct {
+	types.Client
+	saver    types.Saver
+	config   Config
+	messages chan *arbor.ChatMessage
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Logf writes a structured log entry consisting of an event name followed by
+// key=value pairs. Values containing whitespace or quotes are quoted.
+func Logf(event string, keyvals ...interface{}) {
+	entry := "event=" + event
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		value := fmt.Sprint(keyvals[i+1])
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		entry += fmt.Sprintf(" %v=%s", keyvals[i], value)
+	}
+	log.Println(entry)
+}
+
+// New creates a Daemon that stores messages received by the client and persists
+// them with the saver. It connects to the server immediately, and runs until
+// it receives SIGINT or SIGTERM or until Stop is called.
+func New(client types.Client, saver types.Saver, config Config) (*Daemon, error) {
+	if client == nil {
+		return nil, fmt.Errorf("Cannot create Daemon with nil client")
+	} else if saver == nil {
+		return nil, fmt.Errorf("Cannot create Daemon with nil saver")
+	}
+	if config.SaveInterval <= 0 {
+		config.SaveInterval = DefaultSaveInterval
+	}
+	if config.QueryInterval <= 0 {
+		config.QueryInterval = DefaultQueryInterval
+	}
+	d := &Daemon{
+		Client:   client,
+		saver:    saver,
+		config:   config,
+		messages: make(chan *arbor.ChatMessage),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	client.OnReceive(d.Display)
+	go d.manageConnection()
+	go d.run()
+	return d, nil
+}
+
+// Display stores the provided message.
+func (d *Daemon) Display(message *arbor.ChatMessage) {
+	select {
+	case d.messages <- message:
+	case <-d.done:
+	}
+}
+
+// AwaitExit blocks until the Daemon has shut down.
+func (d *Daemon) AwaitExit() {
+	<-d.done
+}
+
+// Stop asks the Daemon to shut down. It is safe to call more than once.
+func (d *Daemon) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+// manageConnection connects to the server as soon as possible, and reconnects
+// whenever the connection is lost.
+func (d *Daemon) manageConnection() {
+	disconnected := make(chan struct{})
+	d.OnDisconnect(func(types.Connection) {
+		select {
+		case disconnected <- struct{}{}:
+		case <-d.done:
+		}
+	})
+	for {
+		if err := d.Connect(); err != nil {
+			Logf("connect_failed", "error", err)
+			select {
+			case <-time.After(reconnectDelay):
+				continue
+			case <-d.done:
+				return
+			}
+		}
+		Logf("connected")
+		go func() {
+			d.AnnounceHere(d.SessionID())
+			d.AskWho()
+		}()
+		select {
+		case <-disconnected:
+			Logf("disconnected")
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// queryNeeded requests messages that are referenced by the history but missing from it.
+func (d *Daemon) queryNeeded() {
+	needed := d.Needed(queryBatchSize)
+	if len(needed) == 0 {
+		return
+	}
+	Logf("query_missing", "count", len(needed))
+	go func() {
+		for _, id := range needed {
+			d.Query(id)
+		}
+	}()
+}
+
+// save persists the history.
+func (d *Daemon) save(reason string) {
+	start := time.Now()
+	if err := d.saver.Save(); err != nil {
+		Logf("save_failed", "reason", reason, "error", err)
+		return
+	}
+	Logf("saved", "reason", reason, "duration", time.Since(start))
+}
+
+// leave announces to the server that this session is ending, giving up after a
+// short while if that is not possible.
+func (d *Daemon) leave() {
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		d.AnnounceLeaving(d.SessionID())
+	}()
+	select {
+	case <-left:
+		Logf("left")
+	case <-time.After(leaveTimeout):
+		Logf("leave_failed", "error", "timed out announcing departure")
+	}
+}
+
+// run stores incoming messages and periodically saves the history and requests
+// missing messages until it is asked to stop.
+func (d *Daemon) run() {
+	defer close(d.done)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	saveTicker := time.NewTicker(d.config.SaveInterval)
+	defer saveTicker.Stop()
+	queryTicker := time.NewTicker(d.config.QueryInterval)
+	defer queryTicker.Stop()
+	unsaved := 0
+	var lastProgress types.BackfillProgress
+	for {
+		select {
+		case message := <-d.messages:
+			if err := d.Add(message); err != nil {
+				Logf("add_failed", "id", message.UUID, "error", err)
+				continue
+			}
+			unsaved++
+			Logf("message", "id", message.UUID, "parent", message.Parent, "user", message.Username, "timestamp", message.Timestamp)
+		case <-saveTicker.C:
+			if unsaved > 0 {
+				d.save("interval")
+				unsaved = 0
+			}
+		case <-queryTicker.C:
+			if reporter, ok := d.Client.(types.BackfillReporter); ok {
+				// the client is already searching for missing messages
+				if progress := reporter.BackfillProgress(); progress != lastProgress {
+					lastProgress = progress
+					Logf("backfill", "missing", progress.Missing, "in_flight", progress.InFlight, "fetched", progress.Fetched, "unavailable", progress.Unavailable)
+				}
+				continue
+			}
+			d.queryNeeded()
+		case sig := <-signals:
+			Logf("shutdown", "signal", sig)
+			d.leave()
+			d.save("shutdown")
+			return
+		case <-d.stop:
+			Logf("shutdown", "signal", "none")
+			d.leave()
+			d.save("shutdown")
+			return
+		}
+	}
+}
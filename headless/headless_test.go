@@ -0,0 +1,108 @@
+package headless_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/headless"
+	"github.com/arborchat/muscadine/types"
+	"github.com/onsi/gomega"
+)
+
+// fakeClient is a types.Client that records the messages it is asked to send
+// instead of sending them to a server.
+type fakeClient struct {
+	*archive.Archive
+	sync.Mutex
+	queries   chan string
+	presence  chan string
+	connected chan struct{}
+	receive   func(*arbor.ChatMessage)
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		Archive:   archive.New(),
+		queries:   make(chan string, 100),
+		presence:  make(chan string, 100),
+		connected: make(chan struct{}, 100),
+	}
+}
+
+func (f *fakeClient) Username() string                           { return "logger" }
+func (f *fakeClient) ChangeUsername(string) error                { return nil }
+func (f *fakeClient) Reply(string, string) error                 { return nil }
+func (f *fakeClient) Query(id string)                            { f.queries <- id }
+func (f *fakeClient) AskWho()                                    { f.presence <- "who" }
+func (f *fakeClient) AnnounceHere(string)                        { f.presence <- "here" }
+func (f *fakeClient) AnnounceLeaving(string)                     { f.presence <- "leave" }
+func (f *fakeClient) SessionID() string                          { return "session" }
+func (f *fakeClient) OnDisconnect(func(types.Connection))        {}
+func (f *fakeClient) Disconnect() error                          { return nil }
+func (f *fakeClient) ActiveSessions() map[string]time.Time       { return nil }
+func (f *fakeClient) Users(time.Time) []types.UserSummary        { return nil }
+func (f *fakeClient) Events() []types.PresenceEvent              { return nil }
+func (f *fakeClient) Connect() error                             { f.connected <- struct{}{}; return nil }
+func (f *fakeClient) OnReceive(handler func(*arbor.ChatMessage)) { f.receive = handler }
+
+// countingSaver counts how many times it has been asked to save.
+type countingSaver struct {
+	sync.Mutex
+	saves int
+}
+
+func (c *countingSaver) Save() error {
+	c.Lock()
+	defer c.Unlock()
+	c.saves++
+	return nil
+}
+
+func (c *countingSaver) Saves() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.saves
+}
+
+// TestNewInvalid checks that the Daemon constructor rejects missing parameters.
+func TestNewInvalid(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	d, err := headless.New(nil, new(countingSaver), headless.Config{})
+	g.Expect(d).To(gomega.BeNil())
+	g.Expect(err).ToNot(gomega.BeNil())
+	d, err = headless.New(newFakeClient(), nil, headless.Config{})
+	g.Expect(d).To(gomega.BeNil())
+	g.Expect(err).ToNot(gomega.BeNil())
+}
+
+// TestDaemon checks that a Daemon connects, stores and saves the messages that it
+// receives, requests missing messages, and announces its departure when stopped.
+func TestDaemon(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	client := newFakeClient()
+	saver := new(countingSaver)
+	d, err := headless.New(client, saver, headless.Config{
+		SaveInterval:  10 * time.Millisecond,
+		QueryInterval: 10 * time.Millisecond,
+	})
+	g.Expect(err).To(gomega.BeNil())
+
+	g.Eventually(client.connected).Should(gomega.Receive())
+	g.Eventually(client.presence).Should(gomega.Receive(gomega.Equal("here")))
+	g.Eventually(client.presence).Should(gomega.Receive(gomega.Equal("who")))
+
+	client.receive(&arbor.ChatMessage{UUID: "child", Parent: "missing", Username: "someone", Content: "hi", Timestamp: 1})
+	g.Eventually(func() bool { return client.Has("child") }).Should(gomega.BeTrue())
+	g.Eventually(client.queries).Should(gomega.Receive(gomega.Equal("missing")))
+	g.Eventually(saver.Saves).Should(gomega.Equal(1))
+	g.Consistently(saver.Saves, 50*time.Millisecond).Should(gomega.Equal(1))
+
+	d.Stop()
+	d.Stop()
+	d.AwaitExit()
+	g.Expect(client.presence).To(gomega.Receive(gomega.Equal("leave")))
+	g.Expect(saver.Saves()).To(gomega.Equal(2))
+}
@@ -0,0 +1,160 @@
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long an Exec waits for its program to answer by default.
+const DefaultTimeout = 5 * time.Second
+
+// Exec is a Hook that runs an external program. The program is started when the
+// first Event arrives and keeps running until Close is called. Each Event is written
+// to its standard input as a line of JSON, and the program must answer each with a
+// line of JSON describing a Result on its standard output, in the same order. The
+// answer "{}" leaves the message unchanged. Anything that the program writes to its
+// standard error is logged. If the program exits or fails to answer in time, it is
+// stopped and started again for the next Event. It is safe for concurrent use.
+type Exec struct {
+	// Path is the program to run.
+	Path string
+	// Timeout is how long to wait for an answer. Zero means DefaultTimeout.
+	Timeout time.Duration
+
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	answers chan []byte
+}
+
+// NewExec creates an Exec that runs the program at the given path, which is looked up
+// in the PATH if it contains no slashes.
+func NewExec(path string) (*Exec, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot use %s as a hook: %s", path, err)
+	}
+	return &Exec{Path: resolved}, nil
+}
+
+// logWriter logs each line written to it, prefixed with the name of a hook.
+type logWriter struct {
+	prefix string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		log.Printf("%s: %s\n", w.prefix, line)
+	}
+	return len(p), nil
+}
+
+// start runs the program and begins reading its answers. The caller must hold the
+// lock.
+func (e *Exec) start() error {
+	cmd := exec.Command(e.Path)
+	cmd.Stderr = logWriter{prefix: e.Path}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to start hook %s: %s", e.Path, err)
+	}
+	answers := make(chan []byte)
+	go func() {
+		defer close(answers)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			answers <- append([]byte{}, scanner.Bytes()...)
+		}
+	}()
+	e.cmd, e.stdin, e.answers = cmd, stdin, answers
+	return nil
+}
+
+// stop kills the program, if it is running, and waits for it to exit. The caller must
+// hold the lock.
+func (e *Exec) stop() {
+	if e.cmd == nil {
+		return
+	}
+	e.stdin.Close()
+	e.cmd.Process.Kill()
+	// the program was killed, so how it exited is of no interest. Waiting closes its
+	// output, so the reader will finish once any answer that it holds is drained.
+	e.cmd.Wait()
+	for range e.answers {
+	}
+	e.cmd, e.stdin, e.answers = nil, nil, nil
+}
+
+// Process shows the Event to the program and returns its answer.
+func (e *Exec) Process(event Event) (Result, error) {
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return e.ProcessBefore(event, time.Now().Add(timeout))
+}
+
+// ProcessBefore shows the Event to the program and returns its answer, unless the
+// deadline passes first. The program is not started if the deadline has already
+// passed.
+func (e *Exec) ProcessBefore(event Event, deadline time.Time) (Result, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var result Result
+	if !time.Now().Before(deadline) {
+		return result, fmt.Errorf("No time left to run hook %s", e.Path)
+	}
+	if e.cmd == nil {
+		if err := e.start(); err != nil {
+			return result, err
+		}
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return result, err
+	}
+	if _, err := e.stdin.Write(append(line, '\n')); err != nil {
+		e.stop()
+		return result, fmt.Errorf("Unable to write to hook %s: %s", e.Path, err)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case answer, ok := <-e.answers:
+		if !ok {
+			e.stop()
+			return result, fmt.Errorf("Hook %s exited", e.Path)
+		}
+		if err := json.Unmarshal(answer, &result); err != nil {
+			return result, fmt.Errorf("Invalid answer from hook %s: %s", e.Path, err)
+		}
+		return result, nil
+	case <-timer.C:
+		e.stop()
+		return result, fmt.Errorf("Hook %s didn't answer in time", e.Path)
+	}
+}
+
+// Close stops the program. It will be started again if another Event arrives.
+func (e *Exec) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.stop()
+	return nil
+}
@@ -0,0 +1,151 @@
+// Package hook lets users customize how messages are processed without changing
+// Muscadine itself. A Hook is shown every chat message as it is received or before it
+// is sent, along with every META message received, and may transform the message,
+// drop it, or annotate it with notes that are shown beside it. Hooks are usually
+// external programs run with Exec.
+package hook
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Kind identifies where a message shown to a Hook came from.
+type Kind string
+
+const (
+	// Inbound messages are chat messages received from the server.
+	Inbound Kind = "inbound"
+	// Outbound messages are replies composed by the user that are about to be sent.
+	Outbound Kind = "outbound"
+	// Meta messages are META messages received from the server.
+	Meta Kind = "meta"
+)
+
+// Message describes a chat message shown to a Hook. Outbound messages have no ID or
+// timestamp yet. The content never includes a signature.
+type Message struct {
+	ID        string `json:"id,omitempty"`
+	Parent    string `json:"parent"`
+	Username  string `json:"username"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Content   string `json:"content"`
+}
+
+// Event is a message shown to a Hook. Message is set for inbound and outbound chat
+// messages, and Meta is set for META messages.
+type Event struct {
+	Kind    Kind              `json:"kind"`
+	Message *Message          `json:"message,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// Result is what a Hook decided to do with an Event. The zero Result leaves the
+// message unchanged.
+type Result struct {
+	// Drop discards the message. Dropped inbound messages are never shown or saved,
+	// dropped outbound messages are never sent, and dropped META messages are ignored.
+	Drop bool `json:"drop,omitempty"`
+	// Content, if set, replaces the content of a chat message. Inbound messages are
+	// still saved as they were sent, and the new content is only shown.
+	Content *string `json:"content,omitempty"`
+	// Meta, if set, replaces the keys and values of a META message.
+	Meta map[string]string `json:"meta,omitempty"`
+	// Annotations are notes about a chat message that are shown beside it. They
+	// aren't sent to anyone. Since outbound messages have no ID until the server
+	// assigns one, they can't be annotated.
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// Hook processes the messages that a client sends and receives.
+type Hook interface {
+	Process(Event) (Result, error)
+}
+
+// TimedHook is a Hook that can give up on an Event once a deadline passes.
+type TimedHook interface {
+	Hook
+	// ProcessBefore is like Process, but fails if the Event can't be processed before
+	// the deadline.
+	ProcessBefore(Event, time.Time) (Result, error)
+}
+
+// Func adapts an ordinary function to a Hook.
+type Func func(Event) (Result, error)
+
+// Process invokes the function.
+func (f Func) Process(event Event) (Result, error) {
+	return f(event)
+}
+
+// Chain is a Hook that runs several Hooks in order. Each is shown the message as the
+// previous ones left it, and the rest are skipped once one drops it. Annotations from
+// every Hook are kept, unless the message has no ID. A Hook that fails is logged and
+// skipped, so that one broken Hook can't stop the conversation.
+type Chain []Hook
+
+// Process runs every Hook in the Chain on the Event.
+func (c Chain) Process(event Event) (Result, error) {
+	return c.process(event, time.Time{})
+}
+
+// ProcessBefore runs every Hook in the Chain on the Event, sharing a single deadline
+// between them. TimedHooks that haven't answered by the deadline are skipped, as are
+// any that follow them. Other Hooks can't be interrupted, so they are always run.
+func (c Chain) ProcessBefore(event Event, deadline time.Time) (Result, error) {
+	return c.process(event, deadline)
+}
+
+// process implements Process and ProcessBefore. The zero deadline means that each Hook
+// may take as long as it likes.
+func (c Chain) process(event Event, deadline time.Time) (Result, error) {
+	var combined Result
+	for i, hook := range c {
+		var (
+			result Result
+			err    error
+		)
+		if timed, ok := hook.(TimedHook); ok && !deadline.IsZero() {
+			result, err = timed.ProcessBefore(event, deadline)
+		} else {
+			result, err = hook.Process(event)
+		}
+		if err != nil {
+			log.Printf("Skipping hook %d: %s\n", i, err)
+			continue
+		} else if err := check(event, result); err != nil {
+			log.Printf("Skipping hook %d: %s\n", i, err)
+			continue
+		}
+		if event.Message != nil && event.Message.ID != "" {
+			combined.Annotations = append(combined.Annotations, result.Annotations...)
+		}
+		if result.Drop {
+			combined.Drop = true
+			return combined, nil
+		}
+		if result.Content != nil {
+			message := *event.Message
+			message.Content = *result.Content
+			event.Message = &message
+			combined.Content = result.Content
+		}
+		if result.Meta != nil {
+			event.Meta = result.Meta
+			combined.Meta = result.Meta
+		}
+	}
+	return combined, nil
+}
+
+// check ensures that a Result only changes the parts of the message that the Event
+// has.
+func check(event Event, result Result) error {
+	if result.Content != nil && event.Message == nil {
+		return fmt.Errorf("content returned for %s event without a chat message", event.Kind)
+	} else if result.Meta != nil && event.Kind != Meta {
+		return fmt.Errorf("META returned for %s event", event.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package hook_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arborchat/muscadine/hook"
+	"github.com/onsi/gomega"
+)
+
+// inbound returns an inbound Event for a message with the given content.
+func inbound(content string) hook.Event {
+	return hook.Event{Kind: hook.Inbound, Message: &hook.Message{ID: "id", Username: "bot", Content: content}}
+}
+
+// TestChain checks that each Hook in a Chain sees the message as the previous ones left
+// it, that dropping a message stops the Chain, and that failing Hooks are skipped.
+func TestChain(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	upper := hook.Func(func(event hook.Event) (hook.Result, error) {
+		content := strings.ToUpper(event.Message.Content)
+		return hook.Result{Content: &content, Annotations: []string{"shouted"}}, nil
+	})
+	seen := ""
+	note := hook.Func(func(event hook.Event) (hook.Result, error) {
+		seen = event.Message.Content
+		return hook.Result{Annotations: []string{"noted"}}, nil
+	})
+	broken := hook.Func(func(event hook.Event) (hook.Result, error) {
+		return hook.Result{Drop: true}, errors.New("broken")
+	})
+	misplaced := hook.Func(func(event hook.Event) (hook.Result, error) {
+		return hook.Result{Meta: map[string]string{"key": "value"}}, nil
+	})
+	drop := hook.Func(func(event hook.Event) (hook.Result, error) {
+		return hook.Result{Drop: event.Kind == hook.Inbound}, nil
+	})
+
+	result, err := hook.Chain{upper, broken, misplaced, note}.Process(inbound("hello"))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(seen).To(gomega.Equal("HELLO"))
+	g.Expect(result.Drop).To(gomega.BeFalse())
+	g.Expect(*result.Content).To(gomega.Equal("HELLO"))
+	g.Expect(result.Annotations).To(gomega.Equal([]string{"shouted", "noted"}))
+
+	seen = ""
+	result, err = hook.Chain{drop, note}.Process(inbound("hello"))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Drop).To(gomega.BeTrue())
+	g.Expect(seen).To(gomega.BeEmpty())
+
+	// outbound messages can't be annotated until they have an ID
+	result, err = hook.Chain{upper, drop}.Process(hook.Event{Kind: hook.Outbound, Message: &hook.Message{Content: "hi"}})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Drop).To(gomega.BeFalse())
+	g.Expect(*result.Content).To(gomega.Equal("HI"))
+	g.Expect(result.Annotations).To(gomega.BeEmpty())
+
+	result, err = hook.Chain{drop, misplaced}.Process(hook.Event{Kind: hook.Meta, Meta: map[string]string{"a": "b"}})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Meta).To(gomega.Equal(map[string]string{"key": "value"}))
+}
+
+// scriptOrSkip writes a shell script with the given body and creates an Exec for it.
+func scriptOrSkip(t *testing.T, dir, name, body string) *hook.Exec {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip(err)
+	}
+	script := path.Join(dir, name)
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Skip(err)
+	}
+	exec, err := hook.NewExec(script)
+	if err != nil {
+		t.Skip(err)
+	}
+	return exec
+}
+
+// TestExec checks that an external program answers each Event in turn, that it is
+// restarted after it exits or stops answering, and that a Chain of programs gives up
+// once its deadline passes.
+func TestExec(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = hook.NewExec(path.Join(dir, "missing"))
+	g.Expect(err).ToNot(gomega.BeNil())
+
+	count := scriptOrSkip(t, dir, "count", `n=0
+while read -r line; do
+	n=$((n+1))
+	echo "{\"annotations\": [\"event $n\"]}"
+done`)
+	defer count.Close()
+	for _, expected := range []string{"event 1", "event 2"} {
+		result, err := count.Process(inbound("hello"))
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(result.Annotations).To(gomega.Equal([]string{expected}))
+	}
+	g.Expect(count.Close()).To(gomega.BeNil())
+	result, err := count.Process(inbound("hello"))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Annotations).To(gomega.Equal([]string{"event 1"}))
+
+	once := scriptOrSkip(t, dir, "once", `read -r line
+echo '{"drop": true}'`)
+	defer once.Close()
+	result, err = once.Process(inbound("hello"))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Drop).To(gomega.BeTrue())
+	_, err = once.Process(inbound("hello"))
+	g.Expect(err).ToNot(gomega.BeNil())
+	result, err = once.Process(inbound("hello"))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Drop).To(gomega.BeTrue())
+
+	silent := scriptOrSkip(t, dir, "silent", `cat > /dev/null`)
+	silent.Timeout = 50 * time.Millisecond
+	defer silent.Close()
+	_, err = silent.Process(inbound("hello"))
+	g.Expect(err).ToNot(gomega.BeNil())
+
+	// the hooks in a chain share one deadline, so the rest are skipped once it passes
+	silent.Timeout = time.Minute
+	start := time.Now()
+	result, err = hook.Chain{silent, count}.ProcessBefore(inbound("hello"), start.Add(50*time.Millisecond))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Annotations).To(gomega.BeEmpty())
+	g.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+	result, err = count.Process(inbound("hello"))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(result.Annotations).To(gomega.Equal([]string{"event 2"}))
+
+	garbage := scriptOrSkip(t, dir, "garbage", `while read -r line; do echo "not json"; done`)
+	defer garbage.Close()
+	_, err = garbage.Process(inbound("hello"))
+	g.Expect(err).ToNot(gomega.BeNil())
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/hook"
+	"github.com/arborchat/muscadine/signing"
+)
+
+// hookDeadline is how long every Hook together may take to process a message. Hooks
+// run while messages are being received, so a slow one delays the whole conversation.
+const hookDeadline = time.Second
+
+// hookFlag is a flag.Value that collects the programs given to each use of a flag.
+type hookFlag []string
+
+func (h *hookFlag) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *hookFlag) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+// loadHooks creates a Chain that runs each of the programs in order. The returned
+// function stops them.
+func loadHooks(paths []string) (hook.Chain, func(), error) {
+	chain := make(hook.Chain, 0, len(paths))
+	execs := make([]*hook.Exec, 0, len(paths))
+	closeAll := func() {
+		for _, exec := range execs {
+			exec.Close()
+		}
+	}
+	for _, path := range paths {
+		exec, err := hook.NewExec(path)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		chain = append(chain, exec)
+		execs = append(execs, exec)
+	}
+	return chain, closeAll, nil
+}
+
+// hookMessage describes a chat message for a Hook.
+func hookMessage(chat *arbor.ChatMessage) *hook.Message {
+	return &hook.Message{
+		ID:        chat.UUID,
+		Parent:    chat.Parent,
+		Username:  chat.Username,
+		Timestamp: chat.Timestamp,
+		Content:   signing.Strip(chat.Content),
+	}
+}
+
+// runHook shows the event to the Hook, if there is one, giving it until hookDeadline
+// to answer if it can be interrupted. A Hook that fails leaves the message unchanged.
+func (nc *NetClient) runHook(event hook.Event) hook.Result {
+	if nc.Hook == nil {
+		return hook.Result{}
+	}
+	var (
+		result hook.Result
+		err    error
+	)
+	if timed, ok := nc.Hook.(hook.TimedHook); ok {
+		result, err = timed.ProcessBefore(event, time.Now().Add(hookDeadline))
+	} else {
+		result, err = nc.Hook.Process(event)
+	}
+	if err != nil {
+		log.Printf("Error running hook on %s message: %s\n", event.Kind, err)
+		return hook.Result{}
+	}
+	return result
+}
+
+// hookInbound runs the Hook on a chat message received from the server, rewriting and
+// annotating it as the Hook decides. The message itself is never changed, so that it is
+// saved as it was sent, and rewrites are only shown. It returns false if the Hook
+// dropped the message, which is remembered so that it isn't requested again while the
+// client runs. Signed messages are never rewritten, since the content shown wouldn't be
+// what was signed.
+func (nc *NetClient) hookInbound(chat *arbor.ChatMessage) bool {
+	result := nc.runHook(hook.Event{Kind: hook.Inbound, Message: hookMessage(chat)})
+	if result.Drop {
+		log.Printf("Message %s from %s dropped by hook\n", chat.UUID, chat.Username)
+		nc.hookLock.Lock()
+		nc.dropped[chat.UUID] = struct{}{}
+		nc.hookLock.Unlock()
+		return false
+	}
+	nc.annotate(chat.UUID, result.Annotations)
+	if result.Content != nil {
+		if _, key, _ := signing.Split(chat.Content); key != nil {
+			log.Printf("Not rewriting signed message %s from %s\n", chat.UUID, chat.Username)
+		} else {
+			nc.hookLock.Lock()
+			nc.rewrites[chat.UUID] = *result.Content
+			nc.hookLock.Unlock()
+		}
+	}
+	return true
+}
+
+// hookOutbound runs the Hook on a reply before it is composed. It returns the content
+// to send, or an error if the Hook dropped the reply.
+func (nc *NetClient) hookOutbound(parent, content string) (string, error) {
+	message := &hook.Message{Parent: parent, Username: nc.Composer.Username(), Content: content}
+	result := nc.runHook(hook.Event{Kind: hook.Outbound, Message: message})
+	if result.Drop {
+		return "", fmt.Errorf("Reply was dropped by a hook")
+	} else if result.Content != nil {
+		content = *result.Content
+	}
+	return content, nil
+}
+
+// hookMeta runs the Hook on a META message received from the server. It returns the
+// keys and values to handle, or false if the Hook dropped the message.
+func (nc *NetClient) hookMeta(meta map[string]string) (map[string]string, bool) {
+	result := nc.runHook(hook.Event{Kind: hook.Meta, Meta: meta})
+	if result.Drop {
+		return nil, false
+	} else if result.Meta != nil {
+		return result.Meta, true
+	}
+	return meta, true
+}
+
+// annotate remembers notes from a Hook about the message with the given ID. Notes are
+// only kept in memory, and repeated notes are ignored.
+func (nc *NetClient) annotate(id string, notes []string) {
+	if len(notes) == 0 {
+		return
+	}
+	nc.hookLock.Lock()
+	defer nc.hookLock.Unlock()
+	known := make(map[string]struct{})
+	for _, note := range nc.annotations[id] {
+		known[note] = struct{}{}
+	}
+	for _, note := range notes {
+		if _, ok := known[note]; !ok {
+			known[note] = struct{}{}
+			nc.annotations[id] = append(nc.annotations[id], note)
+		}
+	}
+}
+
+// Annotations returns the notes that hooks made about the message with the given ID.
+func (nc *NetClient) Annotations(id string) []string {
+	nc.hookLock.Lock()
+	defer nc.hookLock.Unlock()
+	return append([]string{}, nc.annotations[id]...)
+}
+
+// Rewritten returns the content that hooks chose to show in place of the content of the
+// message with the given ID. The final return value is false if the message wasn't
+// rewritten. Rewrites are only kept in memory.
+func (nc *NetClient) Rewritten(id string) (string, bool) {
+	nc.hookLock.Lock()
+	defer nc.hookLock.Unlock()
+	content, ok := nc.rewrites[id]
+	return content, ok
+}
+
+// Dropped returns whether the Hook discarded the message with the given ID. Drops are
+// only kept in memory, so messages dropped by a hook that has since been removed are
+// fetched again after a restart.
+func (nc *NetClient) Dropped(id string) bool {
+	nc.hookLock.Lock()
+	defer nc.hookLock.Unlock()
+	_, ok := nc.dropped[id]
+	return ok
+}
+
+// Needed returns the IDs of up to n messages that are referenced by the history but
+// missing from it, leaving out those that the Hook dropped.
+func (nc *NetClient) Needed(n int) []string {
+	needed := nc.Manager.Needed(n)
+	kept := needed[:0]
+	for _, id := range needed {
+		if !nc.Dropped(id) {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/arbortest"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/types"
+	"github.com/onsi/gomega"
+)
+
+// testClient is a NetClient connected to a fake server. It archives the messages that
+// it receives, as the user interfaces do.
+type testClient struct {
+	*NetClient
+	received     chan *arbor.ChatMessage
+	disconnected chan struct{}
+}
+
+// serverOrSkip creates a fake server.
+func serverOrSkip(t *testing.T) *arbortest.Server {
+	server, err := arbortest.NewServer()
+	if err != nil {
+		t.Skip(err)
+	}
+	return server
+}
+
+// testClientOrSkip creates a client with the given username that connects to the
+// fake server.
+func testClientOrSkip(t *testing.T, server *arbortest.Server, username string) *testClient {
+	history, err := archive.NewManager(".")
+	if err != nil {
+		t.Skip(err)
+	}
+	nc, err := NewNetClient("arbortest", username, history)
+	if err != nil {
+		t.Skip(err)
+	}
+	nc.SetConnector(server.Connect)
+	c := &testClient{
+		NetClient:    nc,
+		received:     make(chan *arbor.ChatMessage, 100),
+		disconnected: make(chan struct{}, 100),
+	}
+	nc.OnReceive(func(m *arbor.ChatMessage) {
+		if err := nc.Add(m); err != nil {
+			t.Error(err)
+		}
+		c.received <- m
+	})
+	nc.OnDisconnect(func(types.Connection) {
+		c.disconnected <- struct{}{}
+	})
+	return c
+}
+
+// seedChain adds a chain of messages beneath the server's root and returns the last.
+func seedChain(t *testing.T, server *arbortest.Server, length int) *arbor.ChatMessage {
+	parent := server.Root
+	var message *arbor.ChatMessage
+	for i := 0; i < length; i++ {
+		message = &arbor.ChatMessage{
+			UUID:      fmt.Sprintf("seed-%d", i),
+			Parent:    parent,
+			Username:  "seed",
+			Content:   fmt.Sprintf("message %d", i),
+			Timestamp: int64(i + 1),
+		}
+		if err := server.Seed(message); err != nil {
+			t.Skip(err)
+		}
+		parent = message.UUID
+	}
+	return message
+}
+
+// TestServerBackfill checks that a client fetches the server's root and recent
+// messages after being welcomed, then crawls back through their ancestors.
+func TestServerBackfill(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server := serverOrSkip(t)
+	defer server.Close()
+	// deeper than the recent messages listed in WELCOME, so some must be backfilled
+	seedChain(t, server, arbortest.RecentCount*2)
+	client := testClientOrSkip(t, server, "alice")
+	g.Expect(client.Connect()).To(gomega.BeNil())
+	defer client.Disconnect()
+	g.Eventually(func() bool {
+		return client.Has(server.Root)
+	}, 5*time.Second).Should(gomega.BeTrue())
+	for i := 0; i < arbortest.RecentCount*2; i++ {
+		g.Eventually(func() bool {
+			return client.Has(fmt.Sprintf("seed-%d", i))
+		}, 5*time.Second).Should(gomega.BeTrue())
+	}
+}
+
+// TestServerConversation checks that replies and presence announcements from one
+// client reach the others.
+func TestServerConversation(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server := serverOrSkip(t)
+	defer server.Close()
+	alice := testClientOrSkip(t, server, "alice")
+	bob := testClientOrSkip(t, server, "bob")
+	g.Expect(alice.Connect()).To(gomega.BeNil())
+	defer alice.Disconnect()
+	g.Expect(bob.Connect()).To(gomega.BeNil())
+	defer bob.Disconnect()
+	g.Eventually(server.Clients).Should(gomega.Equal(2))
+
+	g.Expect(alice.Reply(server.Root, "hello bob")).To(gomega.BeNil())
+	var m *arbor.ChatMessage
+	for _, c := range []*testClient{alice, bob} {
+		g.Eventually(c.received).Should(gomega.Receive(&m))
+		for m.Content != "hello bob" {
+			// skip the root, which may arrive first
+			g.Eventually(c.received).Should(gomega.Receive(&m))
+		}
+		g.Expect(m.Username).To(gomega.Equal("alice"))
+		g.Expect(m.Parent).To(gomega.Equal(server.Root))
+	}
+
+	alice.AskWho()
+	g.Eventually(alice.ActiveSessions).Should(gomega.HaveKey("bob"))
+	bob.AnnounceLeaving(bob.SessionID())
+	g.Eventually(alice.ActiveSessions).ShouldNot(gomega.HaveKey("bob"))
+}
+
+// TestServerFaults checks that a client copes with a server that is slow, loses
+// messages, sends garbage, and hangs up.
+func TestServerFaults(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server := serverOrSkip(t)
+	defer server.Close()
+	client := testClientOrSkip(t, server, "alice")
+
+	server.SetFaults(arbortest.Faults{Refuse: fmt.Errorf("connection refused")})
+	g.Expect(client.Connect()).ToNot(gomega.BeNil())
+	server.SetFaults(arbortest.Faults{})
+	g.Expect(client.Connect()).To(gomega.BeNil())
+	g.Eventually(client.received).Should(gomega.Receive())
+
+	const delay = 100 * time.Millisecond
+	server.SetFaults(arbortest.Faults{Delay: delay})
+	slow, err := server.Reply(server.Root, "server", "slow")
+	g.Expect(err).To(gomega.BeNil())
+	g.Consistently(client.received, delay/2).ShouldNot(gomega.Receive())
+	g.Eventually(client.received).Should(gomega.Receive(gomega.Equal(slow)))
+
+	server.SetFaults(arbortest.Faults{Drop: func(m *arbor.ProtocolMessage) bool {
+		return m.Type == arbor.NewMessageType && m.Content == "lost"
+	}})
+	_, err = server.Reply(server.Root, "server", "lost")
+	g.Expect(err).To(gomega.BeNil())
+	kept, err := server.Reply(server.Root, "server", "kept")
+	g.Expect(err).To(gomega.BeNil())
+	g.Eventually(client.received).Should(gomega.Receive(gomega.Equal(kept)))
+
+	server.SetFaults(arbortest.Faults{})
+	server.SendGarbage()
+	g.Eventually(client.disconnected).Should(gomega.Receive())
+	g.Expect(client.Connect()).To(gomega.BeNil())
+	g.Eventually(server.Clients).Should(gomega.Equal(1))
+
+	server.Disconnect()
+	g.Eventually(client.disconnected).Should(gomega.Receive())
+	g.Expect(client.Connect()).To(gomega.BeNil())
+	g.Expect(client.Disconnect()).To(gomega.BeNil())
+	g.Eventually(client.disconnected).Should(gomega.Receive())
+	g.Consistently(client.disconnected, 20*time.Millisecond).ShouldNot(gomega.Receive())
+}
@@ -9,8 +9,13 @@ import (
 	"os/user"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/e2e"
+	"github.com/arborchat/muscadine/headless"
+	"github.com/arborchat/muscadine/profile"
+	"github.com/arborchat/muscadine/signing"
 	"github.com/arborchat/muscadine/tui"
 	"github.com/arborchat/muscadine/types"
 )
@@ -44,10 +49,66 @@ func getDefaultHistFileTemplate() string {
 	return path.Join(getDataDir(), serverAddressPlaceholder+".arborhist")
 }
 
+// getDefaultProfileFile returns a path to the default muscadine profile file
+// location, which is chosen by the address of the server.
+func getDefaultProfileFile(serverAddress string) string {
+	return strings.Replace(getDefaultProfileFileTemplate(), serverAddressPlaceholder, serverAddress, 1)
+}
+
+// getDefaultProfileFileTemplate returns an example of the default profile file location. It contains a placeholder for the server's address.
+func getDefaultProfileFileTemplate() string {
+	return path.Join(getDataDir(), serverAddressPlaceholder+".profile")
+}
+
+// getDefaultIdentityFile returns a path to the default location of the key that signs
+// messages. The same identity is used on every server.
+func getDefaultIdentityFile() string {
+	return path.Join(getDataDir(), "identity.ed25519")
+}
+
+// getDefaultKnownKeysFile returns a path to the default location of the keys trusted
+// for users on the server at the given address.
+func getDefaultKnownKeysFile(serverAddress string) string {
+	return strings.Replace(getDefaultKnownKeysFileTemplate(), serverAddressPlaceholder, serverAddress, 1)
+}
+
+// getDefaultKnownKeysFileTemplate returns an example of the default known keys file location. It contains a placeholder for the server's address.
+func getDefaultKnownKeysFileTemplate() string {
+	return path.Join(getDataDir(), serverAddressPlaceholder+".keys")
+}
+
+// getDefaultThreadKeysFile returns a path to the default location of the keys of
+// protected threads on the server at the given address.
+func getDefaultThreadKeysFile(serverAddress string) string {
+	return strings.Replace(getDefaultThreadKeysFileTemplate(), serverAddressPlaceholder, serverAddress, 1)
+}
+
+// getDefaultThreadKeysFileTemplate returns an example of the default thread keys file location. It contains a placeholder for the server's address.
+func getDefaultThreadKeysFileTemplate() string {
+	return path.Join(getDataDir(), serverAddressPlaceholder+".threadkeys")
+}
+
+// flagWasSet returns whether the named flag was provided on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 // configureLogging attempts to set the global logger to use the named file, and logs
 // an error to stdout if it fails. It returns a teardown function that can be used to
 // clean up the logging and print a status message to the user.
+// If logfile is "-", logs are written to stderr instead.
 func configureLogging(logfile string) func() {
+	if logfile == "-" {
+		log.SetOutput(os.Stderr)
+		log.Println("--- New Session ---")
+		return func() {}
+	}
 	if err := os.MkdirAll(path.Dir(logfile), 0700); err != nil {
 		log.Printf("Error creating log storage directory (%s): %v\n", path.Dir(logfile), err)
 	}
@@ -65,37 +126,116 @@ func configureLogging(logfile string) func() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	var (
-		ui                types.UI
-		err               error
-		username          string
-		histfile, logfile string
-		histfileTemplate  = getDefaultHistFileTemplate()
-		version           bool
+		ui                 types.UI
+		err                error
+		username           string
+		histfile, logfile  string
+		profileFile        string
+		identityFile       string
+		knownKeysFile      string
+		knownKeysTemplate  = getDefaultKnownKeysFileTemplate()
+		sign               bool
+		shareSeen          bool
+		hookPaths          hookFlag
+		threadKeysFile     string
+		threadKeysTemplate = getDefaultThreadKeysFileTemplate()
+		histfileTemplate   = getDefaultHistFileTemplate()
+		profileTemplate    = getDefaultProfileFileTemplate()
+		version            bool
+		sessionTTL         time.Duration
+		headlessMode       bool
+		saveInterval       time.Duration
+		readOnly           bool
+		compress           bool
 	)
-	flag.StringVar(&username, "username", "muscadine", "Set your username on the server")
+	flag.StringVar(&username, "username", "muscadine", "Set your username on the server (defaults to the last username used on the server)")
+	flag.StringVar(&profileFile, "profile", profileTemplate, "Load/Store server-specific preferences in this file")
 	flag.StringVar(&histfile, "histfile", histfileTemplate, "Load/Store history in this file")
-	flag.StringVar(&logfile, "logfile", getDefaultLogFile(), "Write logs to this file")
+	flag.StringVar(&logfile, "logfile", getDefaultLogFile(), "Write logs to this file (\"-\" for stderr)")
 	flag.BoolVar(&version, "version", false, "Print version number and exit")
+	flag.DurationVar(&sessionTTL, "session-ttl", DefaultSessionTTL, "Consider users offline if they have not announced their presence within this duration")
+	flag.BoolVar(&headlessMode, "headless", false, "Run without a user interface, archiving the server's history until interrupted")
+	flag.BoolVar(&readOnly, "readonly", false, "Open the history file without saving changes to it, even if another instance of muscadine is using it")
+	flag.DurationVar(&saveInterval, "save-interval", headless.DefaultSaveInterval, "In headless mode, save new history this often")
+	flag.BoolVar(&sign, "sign", false, "Sign your messages and verify the signatures of others")
+	flag.BoolVar(&shareSeen, "share-seen", false, "Let others know which messages you have viewed in the history")
+	flag.Var(&hookPaths, "hook", "Run this program on every message sent and received (may be repeated to run several in order)")
+	flag.StringVar(&identityFile, "identity", getDefaultIdentityFile(), "Load/Store the key that signs your messages in this file")
+	flag.StringVar(&knownKeysFile, "known-keys", knownKeysTemplate, "Load/Store the keys trusted for other users on the server in this file")
+	flag.StringVar(&threadKeysFile, "thread-keys", threadKeysTemplate, "Load/Store the keys of encrypted threads on the server in this file")
+	flag.BoolVar(&compress, "compress", false, "Compress the history file with gzip, which older versions of muscadine can't read (history that is already compressed stays compressed unless this is false)")
+	retention := retentionFlags(flag.CommandLine)
 	flag.Parse()
 	if version {
 		fmt.Printf("Muscadine %s\n", Version)
 		return
 	}
 	if len(flag.Args()) < 1 {
-		log.Fatal("Usage: " + os.Args[0] + " <ip>:<port>")
+		log.Fatal("Usage: " + os.Args[0] + " <ip>:<port>\n       " + os.Args[0] + " (" + strings.Join(subcommandNames(), "|") + ") -h")
 	}
 	serverAddress := flag.Arg(0)
 	if histfile == histfileTemplate {
 		// use default history file
 		histfile = getDefaultHistFile(serverAddress)
 	}
+	if profileFile == profileTemplate {
+		// use default profile file
+		profileFile = getDefaultProfileFile(serverAddress)
+	}
+	if knownKeysFile == knownKeysTemplate {
+		// use default known keys file
+		knownKeysFile = getDefaultKnownKeysFile(serverAddress)
+	}
+	if threadKeysFile == threadKeysTemplate {
+		// use default thread keys file
+		threadKeysFile = getDefaultThreadKeysFile(serverAddress)
+	}
 	defer configureLogging(logfile)() // defer the returned cleanup function
+	prof, err := profile.Load(profileFile)
+	if err != nil {
+		log.Println("error loading profile", err)
+		prof, err = profile.New(profileFile)
+		if err != nil {
+			log.Fatalln("unable to construct profile", err)
+		}
+	}
+	if !flagWasSet("username") && prof.Username != "" {
+		username = prof.Username
+	}
 	history, err := archive.NewManager(histfile)
 	if err != nil {
 		log.Fatalln("unable to construct archive", err)
 	}
-	if err := history.Load(); err != nil {
+	history.SetRetention(retention())
+	if flagWasSet("compress") {
+		history.SetCompression(compress)
+	}
+	if readOnly {
+		history.SetReadOnly(true)
+	} else if err := history.Lock(); archive.IsLocked(err) {
+		fmt.Fprintf(os.Stderr, "%s\nAnother instance of muscadine is using this history file. Use -readonly to open it anyway without saving any changes.\n", err)
+		os.Exit(1)
+	} else if err != nil {
+		log.Println("unable to lock history file", err)
+	} else {
+		defer history.Unlock()
+	}
+	if err := loadWithPassphrase(history, histfile); err != nil {
+		if encrypted, _ := history.Encrypted(); encrypted {
+			// continuing would replace the encrypted history when it is saved
+			fmt.Fprintf(os.Stderr, "Unable to open %s: %s\n", histfile, err)
+			os.Exit(1)
+		}
 		log.Println("error loading history", err)
 	}
 	client, err := NewNetClient(serverAddress, username, history)
@@ -103,15 +243,59 @@ func main() {
 		log.Println("Error creating client", err)
 		return
 	}
-	// configure notification logic to send desktop notification on all recent messages
-	notifier := &Notifier{ShouldNotify: Recent}
-	client.Notifier = notifier
-	ui, err = tui.NewTUI(client)
+	client.Profile = prof
+	client.SessionTTL = sessionTTL
+	client.ShareSeen = shareSeen
+	if len(hookPaths) > 0 {
+		hooks, closeHooks, err := loadHooks(hookPaths)
+		if err != nil {
+			log.Fatalln("unable to load hooks", err)
+		}
+		defer closeHooks()
+		client.Hook = hooks
+	}
+	if sign {
+		identity, err := signing.LoadIdentity(identityFile)
+		if err != nil {
+			log.Fatalln("unable to load identity", err)
+		}
+		keys, err := signing.LoadKeyStore(knownKeysFile)
+		if err != nil {
+			log.Fatalln("unable to load known keys", err)
+		}
+		if err := client.EnableSigning(identity, keys); err != nil {
+			log.Fatalln("unable to enable signing", err)
+		}
+		log.Println("Signing messages with key", signing.Fingerprint(identity.PublicKey()))
+	}
+	keyring, err := e2e.LoadKeyring(threadKeysFile)
 	if err != nil {
-		log.Fatal("Error creating TUI", err)
-		return
+		log.Println("unable to load thread keys", err)
+	} else {
+		client.EnableEncryption(keyring)
+	}
+	if headlessMode {
+		daemon, err := headless.New(client, history, headless.Config{SaveInterval: saveInterval})
+		if err != nil {
+			log.Fatal("Error creating headless UI", err)
+			return
+		}
+		ui = daemon
+	} else {
+		// configure notification logic to send desktop notification on all recent messages
+		notifier := &Notifier{ShouldNotify: Recent}
+		client.Notifier = notifier
+		terminal, err := tui.NewTUI(client, sessionTTL)
+		if err != nil {
+			log.Fatal("Error creating TUI", err)
+			return
+		}
+		ui = terminal
 	}
 	ui.AwaitExit()
+	if history.ReadOnly() {
+		return
+	}
 	if err := history.Save(); err != nil {
 		log.Fatalln("error saving history", err)
 	}
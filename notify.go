@@ -4,6 +4,7 @@ import (
 	"time"
 
 	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/signing"
 	"github.com/gen2brain/beeep"
 )
 
@@ -17,17 +18,18 @@ type Notifier struct {
 // current notification policy.
 func (n *Notifier) Handle(cli *NetClient, msg *arbor.ChatMessage) {
 	if n.ShouldNotify(cli, msg) {
-		beeep.Notify("Muscadine", msg.Username+": "+msg.Content, "")
+		beeep.Notify("Muscadine", msg.Username+": "+signing.Strip(cli.Decrypt(msg)), "")
 	}
 }
 
 // Recent sends a notification for every incoming message within the recent
-// past that wasn't authored by the current user.
+// past that wasn't sent under the current user's username.
 func Recent(cli *NetClient, msg *arbor.ChatMessage) bool {
 	// is the message new?
 	if msg.Timestamp > (time.Now().Unix() - int64(5)) {
-		// do not reply to self
-		if cli.username != msg.Username {
+		// do not notify about messages sent under the current username. Former
+		// usernames may since have been taken by someone else.
+		if msg.Username != cli.Composer.Username() {
 			return true
 		}
 	}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/arborchat/muscadine/archive"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// passphraseAttempts is how many times the user may enter the passphrase for an
+// encrypted history file before giving up.
+const passphraseAttempts = 3
+
+// stdin is shared by every prompt so that no input is lost when it is redirected.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase prompts for a passphrase without echoing it. When input is not a
+// terminal, such as when it is redirected in a script, a line is read from it instead.
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		defer fmt.Fprintln(os.Stderr)
+		return terminal.ReadPassword(fd)
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("Unable to read passphrase: %s", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// askPassphrase prompts for the passphrase of the history file if it is encrypted.
+func askPassphrase(history *archive.Manager, histPath string) error {
+	encrypted, err := history.Encrypted()
+	if err != nil || !encrypted {
+		return err
+	}
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", histPath))
+	if err != nil {
+		return err
+	}
+	history.SetPassphrase(passphrase)
+	return nil
+}
+
+// loadWithPassphrase loads the history file, prompting for its passphrase if it is
+// encrypted until the correct one is entered or the user runs out of attempts.
+func loadWithPassphrase(history *archive.Manager, histPath string) error {
+	for attempt := 1; ; attempt++ {
+		if err := askPassphrase(history, histPath); err != nil {
+			return err
+		}
+		err := history.Load()
+		if err != archive.ErrWrongPassphrase || attempt == passphraseAttempts {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Incorrect passphrase, try again.")
+	}
+}
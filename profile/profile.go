@@ -0,0 +1,71 @@
+// Package profile stores the preferences that a user has chosen for a particular
+// server so that they persist between sessions.
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// Profile holds the user's preferences for a single server. It is safe for
+// concurrent use.
+type Profile struct {
+	lock sync.Mutex
+	// Username is the name that the user most recently chose on the server.
+	Username string
+	path     string
+}
+
+// New creates an empty Profile that will be stored at the given path.
+func New(profilePath string) (*Profile, error) {
+	if profilePath == "" {
+		return nil, fmt.Errorf("Path may not be the empty string")
+	}
+	return &Profile{path: profilePath}, nil
+}
+
+// Load reads the Profile stored at the given path. If no profile has been
+// stored there yet, an empty Profile is returned.
+func Load(profilePath string) (*Profile, error) {
+	p, err := New(profilePath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(profilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Unable to decode profile %s: %s", profilePath, err)
+	}
+	return p, nil
+}
+
+// SetUsername records a new username and saves the Profile.
+func (p *Profile) SetUsername(username string) error {
+	p.lock.Lock()
+	p.Username = username
+	p.lock.Unlock()
+	return p.Save()
+}
+
+// Save writes the Profile to its path, creating parent directories as needed.
+func (p *Profile) Save() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.path, data, 0600)
+}
@@ -0,0 +1,52 @@
+package profile_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/arborchat/muscadine/profile"
+	uuid "github.com/nu7hatch/gouuid"
+	"github.com/onsi/gomega"
+)
+
+func tempPathOrSkip(t *testing.T) string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Skip(err)
+	}
+	return path.Join(os.TempDir(), id.String(), "server.profile")
+}
+
+// TestNewInvalid ensures that profiles cannot be created without a path.
+func TestNewInvalid(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	p, err := profile.New("")
+	g.Expect(p).To(gomega.BeNil())
+	g.Expect(err).ToNot(gomega.BeNil())
+}
+
+// TestLoadMissing ensures that loading a profile that was never saved results in
+// an empty profile.
+func TestLoadMissing(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	p, err := profile.Load(tempPathOrSkip(t))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(p).ToNot(gomega.BeNil())
+	g.Expect(p.Username).To(gomega.Equal(""))
+}
+
+// TestSaveLoad ensures that a saved username can be loaded again.
+func TestSaveLoad(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	profilePath := tempPathOrSkip(t)
+	defer os.RemoveAll(path.Dir(profilePath))
+	p, err := profile.New(profilePath)
+	if err != nil {
+		t.Skip(err)
+	}
+	g.Expect(p.SetUsername("alice")).To(gomega.BeNil())
+	loaded, err := profile.Load(profilePath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(loaded.Username).To(gomega.Equal("alice"))
+}
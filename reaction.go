@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The reaction extension lets users acknowledge a message without replying to it. A
+// reaction is announced with a META message whose value takes the form
+// "id\nusername\nsessionID\ntag", where id is the message being reacted to, username
+// and sessionID identify the reacting session, and tag is an emoji or short word.
+// Reactions are withdrawn the same way with a different key.
+const (
+	reactKey   = "reaction/add"
+	unreactKey = "reaction/remove"
+)
+
+// maxTagLength is the greatest number of characters in a reaction's tag.
+const maxTagLength = 16
+
+// validateTag checks that a tag is short and free of spaces.
+func validateTag(tag string) error {
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("Reactions must be 1 to %d characters without spaces: \"%s\"", maxTagLength, tag)
+	}
+	return nil
+}
+
+// parseReaction processes "reaction/add" and "reaction/remove" META values into their
+// constituent parts.
+func parseReaction(key, value string) (id, username, sessionID, tag string, err error) {
+	parts := strings.SplitN(value, "\n", 4)
+	if len(parts) < 4 {
+		err = fmt.Errorf("invalid %s message: %s", key, value)
+		return
+	}
+	id, username, sessionID, tag = parts[0], parts[1], parts[2], parts[3]
+	if id == "" || username == "" || sessionID == "" {
+		err = fmt.Errorf("ID, username, and session ID of %s message cannot be empty", key)
+		return
+	}
+	err = validateTag(tag)
+	return
+}
+
+// React adds the user's reaction to the message with the given ID, or withdraws it if
+// the user already reacted with the same tag. The change is applied to the local
+// history immediately and announced to the server in the background if any other
+// session supports reactions.
+func (nc *NetClient) React(id, tag string) error {
+	if err := validateTag(tag); err != nil {
+		return err
+	} else if !nc.Archive.Has(id) {
+		return fmt.Errorf("Unknown message %s", id)
+	}
+	username := nc.Composer.Username()
+	key := reactKey
+	for _, reaction := range nc.Archive.Reactions(id) {
+		if reaction.Tag != tag {
+			continue
+		}
+		for _, reactor := range reaction.Usernames {
+			if reactor == username {
+				key = unreactKey
+			}
+		}
+	}
+	message := metaMessage(key, id, username, nc.Session.ID, tag)
+	// META messages may not be echoed back to their sender, so the reaction is applied
+	// here rather than when it arrives
+	if err := nc.applyReaction(key, id, username, tag); err != nil {
+		return err
+	} else if !nc.peersSupport(key) {
+		log.Printf("Not announcing %s to message %s, since no one connected supports it\n", key, id)
+		return nil
+	}
+	go func() {
+		nc.Composer.sendChan <- message
+	}()
+	return nil
+}
+
+// OnReact sets the handler for when the reactions to a message change. This should be
+// done before calling Connect() for the first time to avoid race conditions.
+func (nc *NetClient) OnReact(handler func(id string)) {
+	nc.reactHandler = handler
+}
+
+// handleReaction applies a reaction announced in a META message by another session.
+// Reactions are only honored if they come from a known session of the user who
+// reacted. Since this session's own reactions are applied when they are made, those
+// claiming to come from it are forged.
+func (nc *NetClient) handleReaction(key, value string) error {
+	id, username, sessionID, tag, err := parseReaction(key, value)
+	if err != nil {
+		return err
+	} else if sessionID == nc.Session.ID {
+		return fmt.Errorf("reaction to message %s claims to come from this session", id)
+	} else if !nc.List.HasSession(username, sessionID) {
+		return fmt.Errorf("session %s of %s is unknown", sessionID, username)
+	}
+	return nc.applyReaction(key, id, username, tag)
+}
+
+// applyReaction records the user's reaction to the message with the given ID, or its
+// withdrawal.
+func (nc *NetClient) applyReaction(key, id, username, tag string) error {
+	if key == reactKey {
+		if err := nc.Archive.AddReaction(id, username, tag); err != nil {
+			return err
+		}
+	} else {
+		nc.Archive.RemoveReaction(id, username, tag)
+	}
+	log.Printf("Reaction %s to message %s by %s\n", key, id, username)
+	if nc.reactHandler != nil {
+		nc.reactHandler(id)
+	}
+	return nil
+}
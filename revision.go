@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/e2e"
+	"github.com/arborchat/muscadine/types"
+)
+
+// The message revision extension lets authors edit and retract the messages that they
+// sent. An edit is an ordinary ChatMessage replying to the message that it supersedes,
+// whose content ends with editMarker (before any signature). Clients that don't
+// understand edits show it as a reply, so the correction is never lost, and it can be
+// queried and backfilled like any other message. A retraction is announced with a META
+// message whose value takes the form "id\nusername\nsessionID\ntimestamp\nsignature",
+// where id is the message being retracted, username and sessionID identify the
+// author's session, timestamp is the UNIX epoch time of the change, and signature is
+// the content of a ChatMessage standing in for the retraction, so that it can be
+// signed in the same way as a reply.
+const (
+	editKey    = "message/edit"
+	retractKey = "message/retract"
+)
+
+// editMarker ends the content of an edit. Like a signature, it begins with an invisible
+// separator, and it reads naturally in clients that show the edit as a reply.
+const editMarker = "\n\u2063(edit)"
+
+// revisionChat creates the ChatMessage that stands in for a revision of the message
+// with the given ID. Its parent names the revision, so that the signature of one
+// revision can't be replayed as another.
+func revisionChat(key, id, username string, timestamp int64, content string) *arbor.ChatMessage {
+	return &arbor.ChatMessage{
+		Parent:    fmt.Sprintf("%s:%s:%d", key, id, timestamp),
+		Username:  username,
+		Content:   content,
+		Timestamp: timestamp,
+	}
+}
+
+// composeRevision creates a revision of the message with the given ID, signing it if
+// the Composer has an identity.
+func (c *Composer) composeRevision(key, id, content string) *arbor.ChatMessage {
+	chat := revisionChat(key, id, c.Username(), time.Now().Unix(), content)
+	if c.signer != nil {
+		c.signer.Sign(chat)
+	}
+	return chat
+}
+
+// revisionMessage creates a META message announcing the revision of the message with
+// the given ID by the session.
+func revisionMessage(key, id, sessionID string, chat *arbor.ChatMessage) *arbor.ProtocolMessage {
+	return metaMessage(key, id, chat.Username, sessionID, strconv.FormatInt(chat.Timestamp, 10), chat.Content)
+}
+
+// parseRevision processes "message/retract" META values into the ID of the revised
+// message, the session that revised it, and the ChatMessage standing in for the
+// revision.
+func parseRevision(key, value string) (id, sessionID string, chat *arbor.ChatMessage, err error) {
+	parts := strings.SplitN(value, "\n", 5)
+	if len(parts) < 5 {
+		err = fmt.Errorf("invalid %s message: %s", key, value)
+		return
+	}
+	id, sessionID = parts[0], parts[2]
+	if id == "" || parts[1] == "" || sessionID == "" {
+		err = fmt.Errorf("ID, username, and session ID of %s message cannot be empty", key)
+		return
+	}
+	timestamp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Error decoding timestamp in %s message: %s", key, value)
+		return
+	}
+	chat = revisionChat(key, id, parts[1], timestamp, parts[4])
+	return
+}
+
+// ownMessage returns the message with the given ID if the user sent it, or an error
+// explaining why it can't be revised.
+func (nc *NetClient) ownMessage(id string) (*arbor.ChatMessage, error) {
+	original := nc.Archive.Get(id)
+	if original == nil {
+		return nil, fmt.Errorf("Unknown message %s", id)
+	} else if original.Username != nc.Composer.Username() {
+		return nil, fmt.Errorf("Only messages sent as %s can be revised", nc.Composer.Username())
+	}
+	return original, nil
+}
+
+// Edit replaces the content of one of the user's messages. The edit is sent as a reply
+// to the message, so it passes through the Hook and is signed and encrypted just like
+// one, and it is applied once the server echoes it back. Since everyone else would see
+// it as an ordinary reply, it is refused unless another session supports edits.
+func (nc *NetClient) Edit(id, content string) error {
+	if content == "" {
+		return fmt.Errorf("Edited content cannot be empty")
+	} else if _, err := nc.ownMessage(id); err != nil {
+		return err
+	} else if !nc.peersSupport(editKey) {
+		return fmt.Errorf("No one connected supports edits, so reply with the correction instead")
+	}
+	content, err := nc.hookOutbound(id, content)
+	if err != nil {
+		return err
+	}
+	return nc.reply(id, content+editMarker)
+}
+
+// Retract withdraws one of the user's messages. The retraction is applied to the local
+// history immediately and announced to the server in the background if any other
+// session supports retractions.
+func (nc *NetClient) Retract(id string) error {
+	original, err := nc.ownMessage(id)
+	if err != nil {
+		return err
+	}
+	chat := nc.Composer.composeRevision(retractKey, id, "")
+	message := revisionMessage(retractKey, id, nc.Session.ID, chat)
+	// META messages may not be echoed back to their sender, so the retraction is
+	// applied here rather than when it arrives
+	if err := nc.applyRevision(id, original.Username, types.Revision{Timestamp: chat.Timestamp, Retracted: true}); err != nil {
+		return err
+	} else if !nc.peersSupport(retractKey) {
+		log.Printf("Not announcing %s of message %s, since no one connected supports it\n", retractKey, id)
+		return nil
+	}
+	go func() {
+		nc.Composer.sendChan <- message
+	}()
+	return nil
+}
+
+// OnRevise sets the handler for when a message is revised by its author. This should be
+// done before calling Connect() for the first time to avoid race conditions.
+func (nc *NetClient) OnRevise(handler func(id string)) {
+	nc.reviseHandler = handler
+}
+
+// handleRevision applies a retraction announced in a META message by another session.
+// Retractions are only honored if they come from a known session of the message's
+// author. Since this session's own retractions are applied when they are made, those
+// claiming to come from it are forged. If the original message was signed by a trusted
+// key, the retraction must be signed by the same key.
+func (nc *NetClient) handleRevision(key, value string) error {
+	id, sessionID, chat, err := parseRevision(key, value)
+	if err != nil {
+		return err
+	}
+	original := nc.Archive.Get(id)
+	if original == nil {
+		return fmt.Errorf("revised message %s is unknown", id)
+	} else if chat.Username != original.Username {
+		return fmt.Errorf("%s can't revise message %s sent by %s", chat.Username, id, original.Username)
+	} else if sessionID == nc.Session.ID {
+		return fmt.Errorf("revision of message %s claims to come from this session", id)
+	} else if !nc.List.HasSession(chat.Username, sessionID) {
+		return fmt.Errorf("session %s of %s is unknown", sessionID, chat.Username)
+	}
+	result, _ := nc.verify(chat)
+	if err := checkRevision(result, nc.verification(original)); err != nil {
+		return fmt.Errorf("revision of message %s by %s %s", id, chat.Username, err)
+	}
+	return nc.applyRevision(id, chat.Username, types.Revision{Timestamp: chat.Timestamp, Retracted: true})
+}
+
+// editOf returns the content that the message gives the original message if it is an
+// acceptable edit of it: a reply from the same author whose content ends with
+// editMarker, signed by the same key if the original was signed. Encrypted edits are
+// only recognized once they can be decrypted.
+func (nc *NetClient) editOf(original, message *arbor.ChatMessage) (string, bool) {
+	if message.Parent != original.UUID || message.Username != original.Username {
+		return "", false
+	}
+	chat := *message
+	if e2e.IsEncrypted(chat.Content) {
+		if nc.keyring == nil {
+			return "", false
+		}
+		content, ok := nc.keyring.Decrypt(message)
+		if !ok {
+			return "", false
+		}
+		chat.Content = content
+	}
+	result, content := nc.Verify(&chat)
+	if !strings.HasSuffix(content, editMarker) || checkRevision(result, nc.verification(original)) != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(content, editMarker), true
+}
+
+// IsRevision returns whether the message is an acceptable edit of the message that it
+// replies to, rather than an ordinary reply.
+func (nc *NetClient) IsRevision(message *arbor.ChatMessage) bool {
+	original := nc.Archive.Get(message.Parent)
+	if original == nil {
+		return false
+	}
+	_, ok := nc.editOf(original, message)
+	return ok
+}
+
+// verification returns the outcome of verifying the message.
+func (nc *NetClient) verification(message *arbor.ChatMessage) types.Verification {
+	result, _ := nc.Verify(message)
+	return result
+}
+
+// checkRevision returns an error if the outcome of verifying a revision means that it
+// must not be honored, given the outcome of verifying the original message.
+func checkRevision(result, original types.Verification) error {
+	if result == types.Invalid {
+		return fmt.Errorf("has an invalid signature")
+	} else if result != types.Verified && original == types.Verified {
+		return fmt.Errorf("isn't signed, but the message was")
+	}
+	return nil
+}
+
+// applyRevision records the revision of the message with the given ID.
+func (nc *NetClient) applyRevision(id, username string, revision types.Revision) error {
+	if err := nc.Archive.Revise(id, revision); err != nil {
+		return err
+	}
+	log.Printf("Message %s revised by %s\n", id, username)
+	if nc.reviseHandler != nil {
+		nc.reviseHandler(id)
+	}
+	return nil
+}
+
+// Revisions returns the changes that the author made to the message, oldest first.
+// Edits are found among the replies to the message, while retractions are kept by the
+// Archive. A retraction made within the same second as an edit comes after it.
+func (nc *NetClient) Revisions(id string) []types.Revision {
+	original := nc.Archive.Get(id)
+	if original == nil {
+		return nc.Archive.Revisions(id)
+	}
+	var revisions []types.Revision
+	for _, child := range nc.Archive.ChildrenOf(id) {
+		message := nc.Archive.Get(child)
+		if message == nil {
+			continue
+		}
+		if content, ok := nc.editOf(original, message); ok {
+			revisions = append(revisions, types.Revision{Content: content, Timestamp: message.Timestamp})
+		}
+	}
+	revisions = append(revisions, nc.Archive.Revisions(id)...)
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Timestamp < revisions[j].Timestamp
+	})
+	return revisions
+}
@@ -3,7 +3,10 @@ package session
 import (
 	"fmt"
 	"sort"
+	"sync"
 	"time"
+
+	"github.com/arborchat/muscadine/types"
 )
 
 // Session represents known login sessions of other users. The Id
@@ -14,14 +17,37 @@ type Session struct {
 	LastSeen time.Time
 }
 
-// List represents the known active user sessions on an arbor server.
+// List represents the known active user sessions on an arbor server. It is safe
+// for concurrent use.
 type List struct {
-	Active map[string]map[string]time.Time
+	lock   sync.RWMutex
+	active map[string]map[string]time.Time
+	// capabilities maps session IDs to the protocol extensions that each session
+	// announced support for, mapped to their versions.
+	capabilities map[string]map[string]int
+	// events holds the most recent arrivals and departures of users, oldest first.
+	events []types.PresenceEvent
 }
 
+// maxEvents is the number of arrivals and departures that a List remembers.
+const maxEvents = 100
+
 // NewList creates an empty list of sessions.
 func NewList() *List {
-	return &List{make(map[string]map[string]time.Time)}
+	return &List{
+		active:       make(map[string]map[string]time.Time),
+		capabilities: make(map[string]map[string]int),
+		events:       make([]types.PresenceEvent, 0, maxEvents),
+	}
+}
+
+// record remembers that a user arrived or departed, forgetting the oldest
+// event if necessary. The caller must hold the List's lock.
+func (l *List) record(username string, joined bool, when time.Time) {
+	if len(l.events) >= maxEvents {
+		l.events = l.events[1:]
+	}
+	l.events = append(l.events, types.PresenceEvent{Username: username, Joined: joined, Time: when})
 }
 
 // Track updates the List with the given session information for the given
@@ -31,7 +57,9 @@ func (l *List) Track(username string, sess Session) error {
 	if username == "" || sess.ID == "" {
 		return fmt.Errorf("Invalid username (%s) or session ID (%s)", username, sess.ID)
 	}
-	userSessions, present := l.Active[username]
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	userSessions, present := l.active[username]
 	if present {
 		// search the existing sessions for the user
 		lastSeen, exists := userSessions[sess.ID]
@@ -43,13 +71,14 @@ func (l *List) Track(username string, sess Session) error {
 			return nil
 		}
 		// insert the session if it wasn't present
-		l.Active[username][sess.ID] = sess.LastSeen
+		l.active[username][sess.ID] = sess.LastSeen
 		return nil
 	}
 	// user has no sessions, create this one for them
 	userSessions = make(map[string]time.Time)
 	userSessions[sess.ID] = sess.LastSeen
-	l.Active[username] = userSessions
+	l.active[username] = userSessions
+	l.record(username, true, sess.LastSeen)
 
 	return nil
 }
@@ -60,16 +89,20 @@ func (l *List) Remove(username, sessID string) error {
 	if username == "" || sessID == "" {
 		return fmt.Errorf("Invalid username (%s) or session ID (%s)", username, sessID)
 	}
-	userSessions, present := l.Active[username]
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	userSessions, present := l.active[username]
 	if present {
 		// search the existing sessions for the user
 		_, exists := userSessions[sessID]
 		if exists {
 			// delete the session if we found it
 			delete(userSessions, sessID)
+			delete(l.capabilities, sessID)
 			// delete the whole map for the user if this was their only session
-			if len(l.Active[username]) == 0 {
-				delete(l.Active, username)
+			if len(l.active[username]) == 0 {
+				delete(l.active, username)
+				l.record(username, false, time.Now())
 			}
 			return nil
 		}
@@ -80,11 +113,82 @@ func (l *List) Remove(username, sessID string) error {
 	return fmt.Errorf("Can't delete session (%s) for user (%s), user has no sessions", sessID, username)
 }
 
+// HasSession returns whether the user has a session with ID sessID in the List.
+func (l *List) HasSession(username, sessID string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, exists := l.active[username][sessID]
+	return exists
+}
+
+// SetCapabilities records the protocol extensions that the session with ID sessID
+// supports, mapped to their versions. It replaces any that the session announced
+// before. Capabilities may be recorded before the session itself is tracked, but they
+// are only considered by Supports once it is.
+func (l *List) SetCapabilities(sessID string, capabilities map[string]int) error {
+	if sessID == "" {
+		return fmt.Errorf("Invalid session ID (%s)", sessID)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.capabilities[sessID] = make(map[string]int, len(capabilities))
+	for key, version := range capabilities {
+		l.capabilities[sessID][key] = version
+	}
+	return nil
+}
+
+// Capabilities returns the protocol extensions that the session with ID sessID
+// announced support for, mapped to their versions.
+func (l *List) Capabilities(sessID string) map[string]int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	capabilities := make(map[string]int, len(l.capabilities[sessID]))
+	for key, version := range l.capabilities[sessID] {
+		capabilities[key] = version
+	}
+	return capabilities
+}
+
+// Supports returns whether any tracked session announced support for the protocol
+// extension with the given key at the given version or a newer one.
+func (l *List) Supports(key string, version int) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for _, sessionMap := range l.active {
+		for sessionID := range sessionMap {
+			if supported, ok := l.capabilities[sessionID][key]; ok && supported >= version {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sessions returns a copy of every known session, as a map from usernames to maps
+// from session IDs to the time that each session was last seen. It takes the place of
+// the List's former Active field, which could not be read safely while the List was
+// in use.
+func (l *List) Sessions() map[string]map[string]time.Time {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	sessions := make(map[string]map[string]time.Time, len(l.active))
+	for user, sessionMap := range l.active {
+		sessions[user] = make(map[string]time.Time, len(sessionMap))
+		for sessionID, lastSeen := range sessionMap {
+			sessions[user][sessionID] = lastSeen
+		}
+	}
+	return sessions
+}
+
 // ActiveSessions returns a map from usernames to the most active session
 // for each user.
 func (l *List) ActiveSessions() map[string]time.Time {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
 	activeMap := make(map[string]time.Time)
-	for user, sessionMap := range l.Active {
+	for user, sessionMap := range l.active {
 		// make a list of all sessions for the user
 		sessions := make([]*Session, 0, len(sessionMap))
 		for sessionID, lastSeen := range sessionMap {
@@ -102,3 +206,66 @@ func (l *List) ActiveSessions() map[string]time.Time {
 	}
 	return activeMap
 }
+
+// Users summarizes the sessions of every user that has been seen since the
+// provided time. Sessions that were last seen earlier are ignored. The results
+// are sorted with the most recently seen users first.
+func (l *List) Users(seenSince time.Time) []types.UserSummary {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	users := make([]types.UserSummary, 0, len(l.active))
+	for user, sessionMap := range l.active {
+		summary := types.UserSummary{Username: user}
+		for _, lastSeen := range sessionMap {
+			if lastSeen.Before(seenSince) {
+				continue
+			}
+			summary.Sessions++
+			if lastSeen.After(summary.LastSeen) {
+				summary.LastSeen = lastSeen
+			}
+		}
+		if summary.Sessions > 0 {
+			users = append(users, summary)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastSeen.Equal(users[j].LastSeen) {
+			return users[i].Username < users[j].Username
+		}
+		return users[i].LastSeen.After(users[j].LastSeen)
+	})
+	return users
+}
+
+// Events returns the most recent arrivals and departures of users, oldest first.
+func (l *List) Events() []types.PresenceEvent {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	events := make([]types.PresenceEvent, len(l.events))
+	copy(events, l.events)
+	return events
+}
+
+// Expire removes every session that has not been seen since olderThan. Users
+// left without sessions are recorded as having departed. It returns the number
+// of sessions removed.
+func (l *List) Expire(olderThan time.Time) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	removed := 0
+	for user, sessionMap := range l.active {
+		for sessionID, lastSeen := range sessionMap {
+			if lastSeen.Before(olderThan) {
+				delete(sessionMap, sessionID)
+				delete(l.capabilities, sessionID)
+				removed++
+			}
+		}
+		if len(sessionMap) == 0 {
+			delete(l.active, user)
+			l.record(user, false, time.Now())
+		}
+	}
+	return removed
+}
@@ -57,6 +57,56 @@ func TestRemoveSession(t *testing.T) {
 	g.Expect(err).ToNot(gomega.BeNil())
 }
 
+// TestHasSession ensures that sessions are only found for the user who owns them
+func TestHasSession(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	list := session.NewList()
+	g.Expect(list.HasSession(username, sessionName)).To(gomega.BeFalse())
+	err := list.Track(username, session.Session{ID: sessionName, LastSeen: time.Now()})
+	if err != nil {
+		t.Skip("Tracking failed", err)
+	}
+	g.Expect(list.HasSession(username, sessionName)).To(gomega.BeTrue())
+	g.Expect(list.HasSession("someone else", sessionName)).To(gomega.BeFalse())
+	g.Expect(list.HasSession(username, "another session")).To(gomega.BeFalse())
+}
+
+// TestSupports ensures that capabilities only count once their session is tracked, and
+// are forgotten along with it
+func TestSupports(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	list := session.NewList()
+	g.Expect(list.SetCapabilities("", map[string]int{"reaction/add": 1})).ToNot(gomega.BeNil())
+	g.Expect(list.SetCapabilities(sessionName, map[string]int{"reaction/add": 2})).To(gomega.BeNil())
+	g.Expect(list.Capabilities(sessionName)).To(gomega.Equal(map[string]int{"reaction/add": 2}))
+	g.Expect(list.Supports("reaction/add", 1)).To(gomega.BeFalse())
+	err := list.Track(username, session.Session{ID: sessionName, LastSeen: time.Now()})
+	if err != nil {
+		t.Skip("Tracking failed", err)
+	}
+	g.Expect(list.Supports("reaction/add", 1)).To(gomega.BeTrue())
+	g.Expect(list.Supports("reaction/add", 2)).To(gomega.BeTrue())
+	g.Expect(list.Supports("reaction/add", 3)).To(gomega.BeFalse())
+	g.Expect(list.Supports("message/edit", 1)).To(gomega.BeFalse())
+	g.Expect(list.Remove(username, sessionName)).To(gomega.BeNil())
+	g.Expect(list.Capabilities(sessionName)).To(gomega.BeEmpty())
+	g.Expect(list.Supports("reaction/add", 1)).To(gomega.BeFalse())
+}
+
+// TestSessions ensures that every session is listed, and that the listing is a copy
+func TestSessions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	list := session.NewList()
+	now := time.Now()
+	if err := list.Track(username, session.Session{ID: sessionName, LastSeen: now}); err != nil {
+		t.Skip("Tracking failed", err)
+	}
+	sessions := list.Sessions()
+	g.Expect(sessions).To(gomega.Equal(map[string]map[string]time.Time{username: {sessionName: now}}))
+	delete(sessions[username], sessionName)
+	g.Expect(list.HasSession(username, sessionName)).To(gomega.BeTrue())
+}
+
 // TestRemoveFakeSession ensures that removing a nonexistent session fails
 func TestRemoveFakeSession(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
@@ -141,3 +191,92 @@ func TestActiveSessionsEmpty(t *testing.T) {
 	sessions = list.ActiveSessions()
 	g.Expect(sessions).To(gomega.BeEmpty())
 }
+
+// TestUsers ensures that Users summarizes each user's sessions, ignores sessions that
+// have not been seen recently, and sorts users by how recently they were seen.
+func TestUsers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	list := session.NewList()
+	now := time.Now()
+	secondUser := username + "-second"
+	staleUser := username + "-stale"
+	_ = list.Track(username, session.Session{sessionName, now.Add(-2 * time.Minute)})
+	_ = list.Track(username, session.Session{sessionName + "-second", now.Add(-1 * time.Minute)})
+	_ = list.Track(username, session.Session{sessionName + "-stale", now.Add(-1 * time.Hour)})
+	_ = list.Track(secondUser, session.Session{sessionName, now})
+	_ = list.Track(staleUser, session.Session{sessionName, now.Add(-1 * time.Hour)})
+
+	users := list.Users(now.Add(-10 * time.Minute))
+	g.Expect(users).To(gomega.HaveLen(2))
+	g.Expect(users[0].Username).To(gomega.Equal(secondUser))
+	g.Expect(users[0].Sessions).To(gomega.Equal(1))
+	g.Expect(users[1].Username).To(gomega.Equal(username))
+	g.Expect(users[1].Sessions).To(gomega.Equal(2))
+	g.Expect(users[1].LastSeen).To(gomega.BeEquivalentTo(now.Add(-1 * time.Minute)))
+
+	g.Expect(list.Users(time.Time{})).To(gomega.HaveLen(3))
+}
+
+// TestEvents ensures that users joining and leaving are recorded in order.
+func TestEvents(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	list := session.NewList()
+	g.Expect(list.Events()).To(gomega.BeEmpty())
+	_ = list.Track(username, session.Session{sessionName, time.Now()})
+	// a second session for the same user is not a new arrival
+	_ = list.Track(username, session.Session{sessionName + "-second", time.Now()})
+	_ = list.Remove(username, sessionName)
+	_ = list.Remove(username, sessionName+"-second")
+	events := list.Events()
+	g.Expect(events).To(gomega.HaveLen(2))
+	g.Expect(events[0].Username).To(gomega.Equal(username))
+	g.Expect(events[0].Joined).To(gomega.BeTrue())
+	g.Expect(events[1].Username).To(gomega.Equal(username))
+	g.Expect(events[1].Joined).To(gomega.BeFalse())
+}
+
+// TestExpire ensures that sessions that have not been seen recently are removed
+// and that users without any remaining sessions are recorded as departed.
+func TestExpire(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	list := session.NewList()
+	now := time.Now()
+	staleUser := username + "-stale"
+	_ = list.Track(username, session.Session{sessionName, now})
+	_ = list.Track(username, session.Session{sessionName + "-stale", now.Add(-1 * time.Hour)})
+	_ = list.Track(staleUser, session.Session{sessionName, now.Add(-1 * time.Hour)})
+
+	g.Expect(list.Expire(now.Add(-10 * time.Minute))).To(gomega.Equal(2))
+	active := list.ActiveSessions()
+	g.Expect(active).To(gomega.HaveLen(1))
+	g.Expect(active).To(gomega.HaveKey(username))
+	g.Expect(list.Remove(username, sessionName+"-stale")).ToNot(gomega.BeNil())
+
+	events := list.Events()
+	last := events[len(events)-1]
+	g.Expect(last.Username).To(gomega.Equal(staleUser))
+	g.Expect(last.Joined).To(gomega.BeFalse())
+
+	g.Expect(list.Expire(now.Add(-10 * time.Minute))).To(gomega.Equal(0))
+}
+
+// TestConcurrentAccess ensures that a List can be modified and read from multiple
+// goroutines at once. It is most useful when run with the race detector.
+func TestConcurrentAccess(t *testing.T) {
+	list := session.NewList()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = list.Track(username, session.Session{sessionName, time.Now()})
+			_ = list.Remove(username, sessionName)
+			list.Expire(time.Now().Add(-time.Minute))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		list.ActiveSessions()
+		list.Users(time.Time{})
+		list.Events()
+	}
+	<-done
+}
@@ -0,0 +1,45 @@
+package session
+
+import (
+	"sort"
+	"sync"
+)
+
+// SeenList tracks the newest message that each user has viewed. It is safe for
+// concurrent use.
+type SeenList struct {
+	lock sync.Mutex
+	// newest maps each user to the timestamp of the newest message that they viewed.
+	newest map[string]int64
+}
+
+// NewSeenList creates an empty SeenList.
+func NewSeenList() *SeenList {
+	return &SeenList{newest: make(map[string]int64)}
+}
+
+// Track records that the user viewed a message with the given timestamp. Only the
+// newest message viewed by each user is remembered.
+func (s *SeenList) Track(username string, timestamp int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if newest, ok := s.newest[username]; ok && newest > timestamp {
+		return
+	}
+	s.newest[username] = timestamp
+}
+
+// SeenSince returns the users who viewed a message at least as new as the timestamp,
+// sorted by name.
+func (s *SeenList) SeenSince(timestamp int64) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	usernames := make([]string, 0, len(s.newest))
+	for username, newest := range s.newest {
+		if newest >= timestamp {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
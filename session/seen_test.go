@@ -0,0 +1,23 @@
+package session_test
+
+import (
+	"testing"
+
+	"github.com/arborchat/muscadine/session"
+	"github.com/onsi/gomega"
+)
+
+// TestSeenList ensures that only the newest message viewed by each user counts
+func TestSeenList(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	seen := session.NewSeenList()
+	g.Expect(seen.SeenSince(0)).To(gomega.BeEmpty())
+
+	seen.Track("bob", 2)
+	seen.Track("alice", 3)
+	// scrolling back to older messages doesn't unsee newer ones
+	seen.Track("alice", 1)
+	g.Expect(seen.SeenSince(1)).To(gomega.Equal([]string{"alice", "bob"}))
+	g.Expect(seen.SeenSince(3)).To(gomega.Equal([]string{"alice"}))
+	g.Expect(seen.SeenSince(4)).To(gomega.BeEmpty())
+}
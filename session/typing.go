@@ -0,0 +1,57 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// typist describes a user who is composing a reply.
+type typist struct {
+	parent string
+	until  time.Time
+}
+
+// TypingList tracks the users who are composing replies. Each report that a user is
+// typing expires after a short time unless it is repeated. It is safe for concurrent
+// use.
+type TypingList struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	typists map[string]typist
+}
+
+// NewTypingList creates an empty TypingList whose reports expire after ttl.
+func NewTypingList(ttl time.Duration) *TypingList {
+	return &TypingList{ttl: ttl, typists: make(map[string]typist)}
+}
+
+// Track records that the user was composing a reply to the parent at the given time.
+// A user is only ever tracked as replying to one message at a time.
+func (t *TypingList) Track(username, parent string, at time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.typists[username] = typist{parent: parent, until: at.Add(t.ttl)}
+}
+
+// Stop forgets that the user is typing, such as when their reply arrives.
+func (t *TypingList) Stop(username string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.typists, username)
+}
+
+// Active returns the users who are typing at the given time, mapped to the ID of the
+// message that each is replying to. Expired reports are forgotten.
+func (t *TypingList) Active(now time.Time) map[string]string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	active := make(map[string]string, len(t.typists))
+	for username, typist := range t.typists {
+		if now.After(typist.until) {
+			delete(t.typists, username)
+			continue
+		}
+		active[username] = typist.parent
+	}
+	return active
+}
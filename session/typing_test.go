@@ -0,0 +1,27 @@
+package session_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arborchat/muscadine/session"
+	"github.com/onsi/gomega"
+)
+
+// TestTypingList ensures that typists are tracked until their reports expire or they
+// stop
+func TestTypingList(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	typing := session.NewTypingList(10 * time.Second)
+	start := time.Unix(1000, 0)
+	g.Expect(typing.Active(start)).To(gomega.BeEmpty())
+
+	typing.Track("alice", "parent", start)
+	typing.Track("bob", "parent", start)
+	typing.Track("bob", "other", start.Add(5*time.Second))
+	g.Expect(typing.Active(start.Add(time.Second))).To(gomega.Equal(map[string]string{"alice": "parent", "bob": "other"}))
+	g.Expect(typing.Active(start.Add(11 * time.Second))).To(gomega.Equal(map[string]string{"bob": "other"}))
+
+	typing.Stop("bob")
+	g.Expect(typing.Active(start.Add(time.Second))).To(gomega.BeEmpty())
+}
@@ -0,0 +1,202 @@
+package signing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/types"
+	"golang.org/x/crypto/ed25519"
+)
+
+// KeyStore remembers the public key that each username signs messages with. The first
+// key seen for a username is trusted from then on. It is safe for concurrent use.
+type KeyStore struct {
+	lock sync.Mutex
+	// Keys maps each username to its trusted public key.
+	Keys map[string][]byte
+	path string
+}
+
+// LoadKeyStore reads the KeyStore stored at the given path. If none has been stored
+// there yet, an empty KeyStore is returned.
+func LoadKeyStore(storePath string) (*KeyStore, error) {
+	if storePath == "" {
+		return nil, fmt.Errorf("Path may not be the empty string")
+	}
+	k := &KeyStore{Keys: make(map[string][]byte), path: storePath}
+	data, err := ioutil.ReadFile(storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return k, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("Unable to decode known keys %s: %s", storePath, err)
+	}
+	if k.Keys == nil {
+		k.Keys = make(map[string][]byte)
+	}
+	return k, nil
+}
+
+// Trust returns whether the key is the trusted key for the username. If no key is
+// trusted for the username yet, this key becomes trusted and the KeyStore is saved.
+func (k *KeyStore) Trust(username string, key ed25519.PublicKey) (bool, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if trusted, ok := k.Keys[username]; ok {
+		return bytes.Equal(trusted, key), nil
+	}
+	k.Keys[username] = append([]byte{}, key...)
+	return true, k.save()
+}
+
+// Trusted returns the key that is trusted for the username, if there is one.
+func (k *KeyStore) Trusted(username string) (ed25519.PublicKey, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	key, ok := k.Keys[username]
+	return ed25519.PublicKey(key), ok
+}
+
+// Forget stops trusting any key for the username, so that the next key seen for it
+// will be trusted instead. This is needed when a user legitimately changes keys.
+func (k *KeyStore) Forget(username string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.Keys, username)
+	return k.save()
+}
+
+// save writes the KeyStore to its path. The caller must hold its lock.
+func (k *KeyStore) save() error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(k.path, data, 0600)
+}
+
+// MaxResults is the number of messages whose outcomes a Verifier remembers. Once it has
+// verified more, it forgets the outcomes for the messages that it verified first.
+const MaxResults = 10000
+
+// Verifier checks the signatures of messages against the keys in a KeyStore. It
+// remembers the outcome for the last MaxResults messages. It is safe for concurrent
+// use.
+type Verifier struct {
+	store *KeyStore
+	lock  sync.Mutex
+	// results holds the outcome for each message, and order holds their IDs in the
+	// order that they were first verified
+	results map[string]result
+	order   []string
+}
+
+// result is the outcome of verifying a message with particular content. The content
+// of a message may change once it can be decrypted.
+type result struct {
+	content string
+	types.Verification
+}
+
+// NewVerifier creates a Verifier that trusts the keys in the KeyStore.
+func NewVerifier(store *KeyStore) (*Verifier, error) {
+	if store == nil {
+		return nil, fmt.Errorf("Verifier requires a KeyStore")
+	}
+	return &Verifier{store: store, results: make(map[string]result)}, nil
+}
+
+// Verify checks the signature of the message and returns the outcome along with the
+// content of the message without its signature. Unsigned messages are Unverified.
+// Signed messages are Invalid if the signature doesn't match, or if it was made by a
+// key other than the one trusted for the message's username. If no key is trusted for
+// the username yet, the message's key becomes trusted, so messages should be verified
+// once each, in the order in which they arrive.
+func (v *Verifier) Verify(message *arbor.ChatMessage) (types.Verification, string) {
+	content, key, signature := Split(message.Content)
+	if previous, ok := v.previous(message); ok {
+		return previous, content
+	}
+	verification := v.verify(message, content, key, signature, true)
+	if message.UUID != "" {
+		v.remember(message, verification)
+	}
+	return verification, content
+}
+
+// Result returns the outcome of verifying the message, along with its content without
+// its signature. Unlike Verify, it never trusts a new key. If the message wasn't
+// verified with its current content, it is checked against the keys that are already
+// trusted, and is Unverified if no key is trusted for its username.
+func (v *Verifier) Result(message *arbor.ChatMessage) (types.Verification, string) {
+	content, key, signature := Split(message.Content)
+	if previous, ok := v.previous(message); ok {
+		return previous, content
+	}
+	return v.verify(message, content, key, signature, false), content
+}
+
+// previous returns the remembered outcome of verifying the message, if it was verified
+// with its current content.
+func (v *Verifier) previous(message *arbor.ChatMessage) (types.Verification, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	previous, ok := v.results[message.UUID]
+	if !ok || previous.content != message.Content {
+		return types.NotChecked, false
+	}
+	return previous.Verification, true
+}
+
+// remember records the outcome of verifying the message, forgetting the oldest outcome
+// if there are more than MaxResults.
+func (v *Verifier) remember(message *arbor.ChatMessage, verification types.Verification) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.results[message.UUID]; !ok {
+		v.order = append(v.order, message.UUID)
+	}
+	v.results[message.UUID] = result{content: message.Content, Verification: verification}
+	if len(v.order) > MaxResults {
+		delete(v.results, v.order[0])
+		v.order = v.order[1:]
+	}
+}
+
+// verify checks the signature without remembering the outcome. If trust is true and
+// no key is trusted for the message's username, its key becomes trusted. Otherwise
+// such messages are Unverified.
+func (v *Verifier) verify(message *arbor.ChatMessage, content string, key ed25519.PublicKey, signature []byte, trust bool) types.Verification {
+	if key == nil {
+		return types.Unverified
+	}
+	if !ed25519.Verify(key, signedPayload(message, content), signature) {
+		return types.Invalid
+	}
+	if !trust {
+		trusted, ok := v.store.Trusted(message.Username)
+		if !ok {
+			return types.Unverified
+		} else if !bytes.Equal(trusted, key) {
+			return types.Invalid
+		}
+		return types.Verified
+	}
+	// failing to save a newly trusted key still trusts it for now
+	if trusted, _ := v.store.Trust(message.Username, key); !trusted {
+		return types.Invalid
+	}
+	return types.Verified
+}
@@ -0,0 +1,124 @@
+// Package signing lets users prove that they wrote their messages. Each user has an
+// ed25519 identity that signs the messages that they send. Since the fields of an
+// arbor ChatMessage are fixed, the signature travels on a final line of the message's
+// content, so it is preserved wherever the message is stored or relayed. Other users
+// trust the first key that they see for each username, and consider any message
+// signed with a different key for that username to be invalid.
+package signing
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	arbor "github.com/arborchat/arbor-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// SignaturePrefix begins the final line of the content of a signed message. It
+// starts with an invisible separator so that other clients are less likely to
+// mistake it for part of the message. The rest of the line is the public key of the
+// signer and the signature, both base64-encoded and separated by a colon.
+const SignaturePrefix = "\n\u2063ed25519:"
+
+// signedPayload returns the bytes that are signed for a message with the given content.
+// The UUID and timestamp are not signed, since the server may assign them.
+func signedPayload(message *arbor.ChatMessage, content string) []byte {
+	return []byte(strings.Join([]string{"arbor-signature-v1", message.Parent, message.Username, content}, "\x00"))
+}
+
+// Split separates the content of a message from its signature line, if it has one.
+// It returns the content without the signature, along with the public key and
+// signature, which are nil if the message is not signed.
+func Split(content string) (string, ed25519.PublicKey, []byte) {
+	index := strings.LastIndex(content, SignaturePrefix)
+	if index < 0 {
+		return content, nil, nil
+	}
+	fields := strings.Split(content[index+len(SignaturePrefix):], ":")
+	if len(fields) != 2 {
+		return content, nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[0])
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return content, nil, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return content, nil, nil
+	}
+	return content[:index], ed25519.PublicKey(key), signature
+}
+
+// Strip returns the content of a message without its signature line.
+func Strip(content string) string {
+	content, _, _ = Split(content)
+	return content
+}
+
+// Fingerprint returns a short representation of a public key that people can compare.
+func Fingerprint(key ed25519.PublicKey) string {
+	encoded := base64.RawURLEncoding.EncodeToString(key)
+	const length = 16
+	if len(encoded) > length {
+		encoded = encoded[:length]
+	}
+	return encoded
+}
+
+// Identity is a key pair that signs a user's messages.
+type Identity struct {
+	key ed25519.PrivateKey
+}
+
+// LoadIdentity reads the identity stored at the given path. If there isn't one, a
+// new identity is generated and stored there.
+func LoadIdentity(identityPath string) (*Identity, error) {
+	if identityPath == "" {
+		return nil, fmt.Errorf("Path may not be the empty string")
+	}
+	data, err := ioutil.ReadFile(identityPath)
+	if os.IsNotExist(err) {
+		return createIdentity(identityPath)
+	} else if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Unable to decode identity %s", identityPath)
+	}
+	return &Identity{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// createIdentity generates a new identity and stores it at the given path.
+func createIdentity(identityPath string) (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Dir(identityPath), 0700); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key.Seed()) + "\n"
+	if err := ioutil.WriteFile(identityPath, []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+// PublicKey returns the key that verifies the identity's signatures.
+func (i *Identity) PublicKey() ed25519.PublicKey {
+	return i.key.Public().(ed25519.PublicKey)
+}
+
+// Sign appends a signature line to the content of the message. The message's Parent
+// and Username must already be set, since they are signed along with the content.
+func (i *Identity) Sign(message *arbor.ChatMessage) {
+	signature := ed25519.Sign(i.key, signedPayload(message, message.Content))
+	message.Content += SignaturePrefix + base64.StdEncoding.EncodeToString(i.PublicKey()) +
+		":" + base64.StdEncoding.EncodeToString(signature)
+}
@@ -0,0 +1,166 @@
+package signing_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/signing"
+	"github.com/arborchat/muscadine/types"
+	uuid "github.com/nu7hatch/gouuid"
+	"github.com/onsi/gomega"
+)
+
+// tempDirOrSkip returns a path within the temporary directory that does not exist yet.
+func tempDirOrSkip(t *testing.T) string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Skip(err)
+	}
+	return path.Join(os.TempDir(), id.String())
+}
+
+// identityOrSkip loads the identity stored at the given path, creating it if needed.
+func identityOrSkip(t *testing.T, identityPath string) *signing.Identity {
+	identity, err := signing.LoadIdentity(identityPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	return identity
+}
+
+// signedOrSkip creates a message signed by the identity.
+func signedOrSkip(t *testing.T, identity *signing.Identity, id, username, content string) *arbor.ChatMessage {
+	message := &arbor.ChatMessage{UUID: id, Parent: "parent", Username: username, Content: content, Timestamp: 1}
+	identity.Sign(message)
+	return message
+}
+
+// TestLoadIdentity checks that an identity is created when none exists, and that the
+// same identity is loaded from then on.
+func TestLoadIdentity(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := tempDirOrSkip(t)
+	defer os.RemoveAll(dir)
+	_, err := signing.LoadIdentity("")
+	g.Expect(err).ToNot(gomega.BeNil())
+	created, err := signing.LoadIdentity(path.Join(dir, "identity"))
+	g.Expect(err).To(gomega.BeNil())
+	loaded, err := signing.LoadIdentity(path.Join(dir, "identity"))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(loaded.PublicKey()).To(gomega.Equal(created.PublicKey()))
+	g.Expect(signing.Fingerprint(loaded.PublicKey())).To(gomega.HaveLen(16))
+}
+
+// TestSplit checks that signatures are separated from the content of messages.
+func TestSplit(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := tempDirOrSkip(t)
+	defer os.RemoveAll(dir)
+	identity := identityOrSkip(t, path.Join(dir, "identity"))
+	message := signedOrSkip(t, identity, "id", "alice", "hello\nworld")
+	content, key, signature := signing.Split(message.Content)
+	g.Expect(content).To(gomega.Equal("hello\nworld"))
+	g.Expect(key).To(gomega.Equal(identity.PublicKey()))
+	g.Expect(signature).ToNot(gomega.BeEmpty())
+	g.Expect(signing.Strip("unsigned")).To(gomega.Equal("unsigned"))
+	g.Expect(signing.Strip("bad" + signing.SignaturePrefix + "not:base64!")).To(gomega.Equal("bad" + signing.SignaturePrefix + "not:base64!"))
+}
+
+// TestVerify checks that messages are verified against the first key seen for each
+// username, and that tampering invalidates them.
+func TestVerify(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := tempDirOrSkip(t)
+	defer os.RemoveAll(dir)
+	alice := identityOrSkip(t, path.Join(dir, "alice"))
+	mallory := identityOrSkip(t, path.Join(dir, "mallory"))
+	keysPath := path.Join(dir, "known.keys")
+	keys, err := signing.LoadKeyStore(keysPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	_, err = signing.NewVerifier(nil)
+	g.Expect(err).ToNot(gomega.BeNil())
+	verifier, err := signing.NewVerifier(keys)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	result, content := verifier.Verify(&arbor.ChatMessage{UUID: "unsigned", Username: "alice", Content: "hi"})
+	g.Expect(result).To(gomega.Equal(types.Unverified))
+	g.Expect(content).To(gomega.Equal("hi"))
+	result, content = verifier.Verify(signedOrSkip(t, alice, "first", "alice", "hello"))
+	g.Expect(result).To(gomega.Equal(types.Verified))
+	g.Expect(content).To(gomega.Equal("hello"))
+	result, _ = verifier.Verify(signedOrSkip(t, mallory, "forged", "alice", "it's me"))
+	g.Expect(result).To(gomega.Equal(types.Invalid))
+	tampered := signedOrSkip(t, alice, "tampered", "alice", "hello")
+	tampered.Parent = "elsewhere"
+	result, _ = verifier.Verify(tampered)
+	g.Expect(result).To(gomega.Equal(types.Invalid))
+
+	// the trusted keys are remembered
+	reloaded, err := signing.LoadKeyStore(keysPath)
+	g.Expect(err).To(gomega.BeNil())
+	trusted, ok := reloaded.Trusted("alice")
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(trusted).To(gomega.Equal(alice.PublicKey()))
+	g.Expect(reloaded.Forget("alice")).To(gomega.BeNil())
+	verifier, err = signing.NewVerifier(reloaded)
+	if err != nil {
+		t.Skip(err)
+	}
+	result, _ = verifier.Verify(signedOrSkip(t, mallory, "new-key", "alice", "new key"))
+	g.Expect(result).To(gomega.Equal(types.Verified))
+}
+
+// TestResult checks that reporting the outcome of verification never trusts a new key,
+// and that outcomes recorded by Verify are reported until they are evicted.
+func TestResult(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir := tempDirOrSkip(t)
+	defer os.RemoveAll(dir)
+	alice := identityOrSkip(t, path.Join(dir, "alice"))
+	mallory := identityOrSkip(t, path.Join(dir, "mallory"))
+	keysPath := path.Join(dir, "known.keys")
+	keys, err := signing.LoadKeyStore(keysPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	verifier, err := signing.NewVerifier(keys)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	forged := signedOrSkip(t, mallory, "forged", "alice", "it's me")
+	result, content := verifier.Result(forged)
+	g.Expect(result).To(gomega.Equal(types.Unverified))
+	g.Expect(content).To(gomega.Equal("it's me"))
+	_, ok := keys.Trusted("alice")
+	g.Expect(ok).To(gomega.BeFalse())
+	_, err = os.Stat(keysPath)
+	g.Expect(os.IsNotExist(err)).To(gomega.BeTrue())
+
+	first := signedOrSkip(t, alice, "first", "alice", "hello")
+	result, _ = verifier.Verify(first)
+	g.Expect(result).To(gomega.Equal(types.Verified))
+	result, _ = verifier.Result(first)
+	g.Expect(result).To(gomega.Equal(types.Verified))
+	result, _ = verifier.Result(forged)
+	g.Expect(result).To(gomega.Equal(types.Invalid))
+	result, _ = verifier.Result(signedOrSkip(t, alice, "later", "alice", "again"))
+	g.Expect(result).To(gomega.Equal(types.Verified))
+
+	// outcomes outlive the keys they were checked with, until enough others are verified
+	g.Expect(keys.Forget("alice")).To(gomega.BeNil())
+	result, _ = verifier.Result(first)
+	g.Expect(result).To(gomega.Equal(types.Verified))
+	for i := 0; i < signing.MaxResults; i++ {
+		verifier.Verify(&arbor.ChatMessage{UUID: fmt.Sprintf("unsigned-%d", i), Username: "bob", Content: "hi"})
+	}
+	result, _ = verifier.Result(first)
+	g.Expect(result).To(gomega.Equal(types.Unverified))
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arborchat/muscadine/archive"
+)
+
+// subcommand is a tool that works with history files without connecting to a server.
+type subcommand struct {
+	// summary is a one-line description of the subcommand
+	summary string
+	run     func(args []string) error
+}
+
+// subcommands maps the name of each subcommand to its implementation.
+var subcommands map[string]subcommand
+
+func init() {
+	// this is initialized here because subcommands use it to describe themselves
+	subcommands = map[string]subcommand{
+		"export": {"Write history as a Markdown, HTML, or plain-text transcript", runExport},
+		"merge":  {"Combine other history files into a server's history", runMerge},
+		"fsck":   {"Check a history file for corruption and salvage what can be read", runFsck},
+		"prune":  {"Remove old history according to a retention policy", runPrune},
+		"rekey":  {"Encrypt a history file, change its passphrase, or decrypt it", runRekey},
+	}
+}
+
+// subcommandNames returns the sorted names of all subcommands.
+func subcommandNames() []string {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newFlagSet creates a FlagSet for the named subcommand with a usage message that
+// describes its positional arguments.
+func newFlagSet(name, positional string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", os.Args[0], name, positional, subcommands[name].summary)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// historyPath chooses the history file that a subcommand operates on. An explicit
+// path takes precedence over the default history file of a server address.
+func historyPath(histfile string, flags *flag.FlagSet) (string, error) {
+	if histfile != "" {
+		return histfile, nil
+	} else if flags.NArg() > 0 {
+		return getDefaultHistFile(flags.Arg(0)), nil
+	}
+	return "", fmt.Errorf("Either -histfile or a server address is required")
+}
+
+// loadHistory reads the history file at the given path, prompting for its passphrase
+// if it is encrypted. Unlike the client, it refuses to create the file if it does not
+// exist.
+func loadHistory(histPath string) (*archive.Manager, error) {
+	if _, err := os.Stat(histPath); err != nil {
+		return nil, err
+	}
+	history, err := archive.NewManager(histPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadWithPassphrase(history, histPath); err != nil {
+		return nil, fmt.Errorf("Unable to load %s: %s", histPath, err)
+	}
+	return history, nil
+}
+
+// parseTime accepts either an RFC 3339 timestamp or a date in local time.
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// parseUntil is like parseTime, but a date means the last second of that day, so that
+// messages sent at any time on the date are included.
+func parseUntil(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return day, err
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+// sizeValue is a flag.Value for a number of bytes, which may have a K, M, or G suffix.
+type sizeValue int64
+
+func (s *sizeValue) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeValue) Set(value string) error {
+	multiplier := int64(1)
+	value = strings.TrimSuffix(strings.ToUpper(value), "B")
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size")
+	}
+	*s = sizeValue(n * multiplier)
+	return nil
+}
+
+// retentionFlags defines the flags that configure a retention policy on the FlagSet.
+// The returned function reports the policy once the flags have been parsed.
+func retentionFlags(flags *flag.FlagSet) func() archive.Retention {
+	var (
+		maxAge   time.Duration
+		maxCount int
+		maxSize  sizeValue
+	)
+	flags.DurationVar(&maxAge, "retain-age", 0, "Only keep messages sent within this duration, such as 720h (0 keeps them all)")
+	flags.IntVar(&maxCount, "retain-count", 0, "Only keep this many of the most recent messages (0 keeps them all)")
+	flags.Var(&maxSize, "retain-size", "Only keep about this much of the most recent history, such as 10M (0 keeps it all)")
+	return func() archive.Retention {
+		return archive.Retention{MaxAge: maxAge, MaxCount: maxCount, MaxSize: int64(maxSize)}
+	}
+}
+
+// runExport implements the export subcommand.
+func runExport(args []string) error {
+	var (
+		histfile, output, formatName string
+		root, users, since, until    string
+		filter                       archive.ExportFilter
+	)
+	flags := newFlagSet("export", "[<ip>:<port>]")
+	flags.StringVar(&histfile, "histfile", "", "Export this history file (defaults to that of the server address)")
+	flags.StringVar(&output, "o", "", "Write the transcript to this file instead of stdout")
+	flags.StringVar(&formatName, "format", "markdown", "Transcript format: markdown, html, or text")
+	flags.StringVar(&root, "root", "", "Only export the thread beginning with the message with this id")
+	flags.StringVar(&users, "user", "", "Only export messages from these users (comma-separated)")
+	flags.StringVar(&since, "since", "", "Only export messages sent at or after this time (YYYY-MM-DD or RFC 3339)")
+	flags.StringVar(&until, "until", "", "Only export messages sent at or before this time (YYYY-MM-DD or RFC 3339)")
+	flags.Parse(args)
+	format, err := archive.ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+	filter.Root = root
+	if users != "" {
+		filter.Users = strings.Split(users, ",")
+	}
+	if since != "" {
+		if filter.Since, err = parseTime(since); err != nil {
+			return fmt.Errorf("Invalid -since: %s", err)
+		}
+	}
+	if until != "" {
+		if filter.Until, err = parseUntil(until); err != nil {
+			return fmt.Errorf("Invalid -until: %s", err)
+		}
+	}
+	histPath, err := historyPath(histfile, flags)
+	if err != nil {
+		return err
+	}
+	history, err := loadHistory(histPath)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return history.Export(out, format, filter)
+}
+
+// summarize shortens message content to fit on a single line of a report.
+func summarize(content string) string {
+	const maxLength = 40
+	content = strings.Replace(content, "\n", " ", -1)
+	if runes := []rune(content); len(runes) > maxLength {
+		return string(runes[:maxLength-3]) + "..."
+	}
+	return content
+}
+
+// runMerge implements the merge subcommand.
+func runMerge(args []string) error {
+	var (
+		histfile, quarantinePath string
+		dryRun                   bool
+	)
+	flags := newFlagSet("merge", "(-histfile <path> | <ip>:<port>) <other-history-file>...")
+	flags.StringVar(&histfile, "histfile", "", "Merge into this history file (defaults to that of the server address)")
+	flags.StringVar(&quarantinePath, "quarantine", "", "Instead of rejecting a file with conflicting messages, merge the rest of it and add every version of the conflicting messages to this file")
+	flags.BoolVar(&dryRun, "dry-run", false, "Report what would be merged without changing any files")
+	flags.Parse(args)
+	histPath, err := historyPath(histfile, flags)
+	if err != nil {
+		return err
+	}
+	sources := flags.Args()
+	if histfile == "" {
+		// the first argument was the server address
+		sources = sources[1:]
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("No history files to merge")
+	}
+	history, err := archive.NewManager(histPath)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		if err := history.Lock(); err != nil {
+			return err
+		}
+		defer history.Unlock()
+	}
+	if _, err := os.Stat(histPath); err == nil {
+		if err := loadWithPassphrase(history, histPath); err != nil {
+			return fmt.Errorf("Unable to load %s: %s", histPath, err)
+		}
+	}
+	quarantine := &archive.Quarantine{}
+	added, rejected := 0, 0
+	for _, source := range sources {
+		report, err := mergeFile(history.Archive, source, quarantinePath != "")
+		if report != nil {
+			fmt.Printf("%s: %d added, %d duplicates, %d conflicts\n", source, len(report.Added), report.Duplicates, len(report.Conflicts))
+			for _, conflict := range report.Conflicts {
+				fmt.Printf("  conflict on %s: ours is \"%s\" from %s, theirs is \"%s\" from %s\n", conflict.Incoming.UUID,
+					summarize(conflict.Existing.Content), conflict.Existing.Username,
+					summarize(conflict.Incoming.Content), conflict.Incoming.Username)
+				quarantine.Add(conflict.Incoming)
+			}
+			added += len(report.Added)
+		}
+		if err != nil {
+			fmt.Printf("%s: rejected: %s\n", source, err)
+			rejected++
+		}
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d messages would be added to %s\n", added, histPath)
+	} else {
+		if quarantinePath != "" && len(quarantine.Messages) > 0 {
+			if err := writeQuarantine(quarantine, quarantinePath); err != nil {
+				return err
+			}
+			fmt.Printf("Conflicting messages written to %s\n", quarantinePath)
+		}
+		if added > 0 {
+			if err := history.Save(); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%d messages added to %s\n", added, histPath)
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d of %d history files were rejected", rejected, len(sources))
+	}
+	return nil
+}
+
+// mergeFile merges the history file at the given path into the archive.
+func mergeFile(a *archive.Archive, source string, quarantine bool) (*archive.MergeReport, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return a.Merge(file, quarantine)
+}
+
+// writeQuarantine adds the quarantined messages to any that are already in the
+// quarantine file at the given path.
+func writeQuarantine(quarantine *archive.Quarantine, quarantinePath string) error {
+	if existing, err := os.Open(quarantinePath); err == nil {
+		err = quarantine.Load(existing)
+		existing.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to read existing quarantine file %s: %s", quarantinePath, err)
+		}
+	}
+	file, err := os.Create(quarantinePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return quarantine.Persist(file)
+}
+
+// runFsck implements the fsck subcommand.
+func runFsck(args []string) error {
+	var histfile, salvagePath, quarantinePath string
+	flags := newFlagSet("fsck", "(-histfile <path> | <ip>:<port>)")
+	flags.StringVar(&histfile, "histfile", "", "Check this history file (defaults to that of the server address)")
+	flags.StringVar(&salvagePath, "salvage", "", "Write every valid message that can be read to a new history file at this path")
+	flags.StringVar(&quarantinePath, "quarantine", "", "Add the messages that were left out of the salvaged history to this file")
+	flags.Parse(args)
+	histPath, err := historyPath(histfile, flags)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(histPath); err != nil {
+		return err
+	}
+	if salvagePath == histPath {
+		return fmt.Errorf("Refusing to overwrite %s while salvaging it, choose another path", histPath)
+	}
+	history, err := archive.NewManager(histPath)
+	if err != nil {
+		return err
+	}
+	if err := askPassphrase(history, histPath); err != nil {
+		return err
+	}
+	report, err := history.Check()
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%s: %d messages, %d errors, %d warnings\n", histPath, report.Messages, report.Errors(), len(report.Problems)-report.Errors())
+	if salvagePath != "" {
+		file, err := os.Create(salvagePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := report.Salvaged.Persist(file); err != nil {
+			return err
+		}
+		fmt.Printf("Salvaged %d messages into %s\n", report.SalvagedMessages, salvagePath)
+		if encrypted, _ := history.Encrypted(); encrypted {
+			fmt.Printf("The salvaged history is not encrypted, use rekey to encrypt it\n")
+		}
+	}
+	if quarantinePath != "" && len(report.Quarantined.Messages) > 0 {
+		if err := writeQuarantine(report.Quarantined, quarantinePath); err != nil {
+			return err
+		}
+		fmt.Printf("%d messages left out of the salvaged history written to %s\n", len(report.Quarantined.Messages), quarantinePath)
+	}
+	if report.Errors() > 0 {
+		return fmt.Errorf("%s is corrupt", histPath)
+	}
+	return nil
+}
+
+// runPrune implements the prune subcommand.
+func runPrune(args []string) error {
+	var (
+		histfile string
+		dryRun   bool
+	)
+	flags := newFlagSet("prune", "(-histfile <path> | <ip>:<port>)")
+	flags.StringVar(&histfile, "histfile", "", "Prune this history file (defaults to that of the server address)")
+	flags.BoolVar(&dryRun, "dry-run", false, "Report what would be removed without changing the history file")
+	retention := retentionFlags(flags)
+	flags.Parse(args)
+	policy := retention()
+	if policy.IsZero() {
+		return fmt.Errorf("At least one of -retain-age, -retain-count, or -retain-size is required")
+	}
+	histPath, err := historyPath(histfile, flags)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(histPath); err != nil {
+		return err
+	}
+	history, err := archive.NewManager(histPath)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		// hold the lock while loading so that no other instance saves in the meantime
+		if err := history.Lock(); err != nil {
+			return err
+		}
+		defer history.Unlock()
+	}
+	if err := loadWithPassphrase(history, histPath); err != nil {
+		return fmt.Errorf("Unable to load %s: %s", histPath, err)
+	}
+	report := history.Prune(policy, time.Now(), dryRun)
+	for _, message := range report.Removed {
+		fmt.Printf("%s %s %s: %s\n", message.UUID, time.Unix(message.Timestamp, 0).Format("2006-01-02 15:04"), message.Username, summarize(message.Content))
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d messages would be removed from %s, keeping %d\n", len(report.Removed), histPath, report.Kept)
+		return nil
+	}
+	if len(report.Removed) > 0 {
+		if err := history.Save(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%d messages removed from %s, keeping %d\n", len(report.Removed), histPath, report.Kept)
+	return nil
+}
+
+// runRekey implements the rekey subcommand.
+func runRekey(args []string) error {
+	var (
+		histfile string
+		decrypt  bool
+	)
+	flags := newFlagSet("rekey", "(-histfile <path> | <ip>:<port>)")
+	flags.StringVar(&histfile, "histfile", "", "Change the passphrase of this history file (defaults to that of the server address)")
+	flags.BoolVar(&decrypt, "decrypt", false, "Remove the encryption from the history file instead of changing its passphrase")
+	flags.Parse(args)
+	histPath, err := historyPath(histfile, flags)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(histPath); err != nil {
+		return err
+	}
+	history, err := archive.NewManager(histPath)
+	if err != nil {
+		return err
+	}
+	if err := history.Lock(); err != nil {
+		return err
+	}
+	defer history.Unlock()
+	if err := loadWithPassphrase(history, histPath); err != nil {
+		return fmt.Errorf("Unable to load %s: %s", histPath, err)
+	}
+	if decrypt {
+		history.SetPassphrase(nil)
+	} else {
+		passphrase, err := readPassphrase("New passphrase: ")
+		if err != nil {
+			return err
+		}
+		if len(passphrase) == 0 {
+			return fmt.Errorf("The passphrase may not be empty, use -decrypt to remove the encryption")
+		}
+		confirmation, err := readPassphrase("Confirm new passphrase: ")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(passphrase, confirmation) {
+			return fmt.Errorf("The passphrases do not match")
+		}
+		history.SetPassphrase(passphrase)
+	}
+	if err := history.Save(); err != nil {
+		return err
+	}
+	// the backups can still be read without the new passphrase
+	if err := history.RemoveBackups(); err != nil {
+		return fmt.Errorf("Unable to remove the backups of %s: %s", histPath, err)
+	}
+	if decrypt {
+		fmt.Printf("%s is no longer encrypted\n", histPath)
+	} else {
+		fmt.Printf("%s is encrypted with the new passphrase\n", histPath)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/onsi/gomega"
+)
+
+// historyFileOrSkip creates a history file in a temporary directory containing the
+// given messages. It returns the path of the file and of the directory, which should
+// be removed by the caller.
+func historyFileOrSkip(t *testing.T, messages ...*arbor.ChatMessage) (string, string) {
+	dir, err := ioutil.TempDir("", "muscadine")
+	if err != nil {
+		t.Skip(err)
+	}
+	histPath := path.Join(dir, "test.arborhist")
+	history, err := archive.NewManager(histPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, m := range messages {
+		if err := history.Add(m); err != nil {
+			t.Skip(err)
+		}
+	}
+	if err := history.Save(); err != nil {
+		t.Skip(err)
+	}
+	return histPath, dir
+}
+
+// TestRunExport checks that the export subcommand writes a filtered transcript and
+// rejects invalid arguments.
+func TestRunExport(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	histPath, dir := historyFileOrSkip(t,
+		&arbor.ChatMessage{UUID: "root", Username: "alice", Content: "hello", Timestamp: 100},
+		&arbor.ChatMessage{UUID: "reply", Parent: "root", Username: "bob", Content: "hi", Timestamp: 200},
+	)
+	defer os.RemoveAll(dir)
+	output := path.Join(dir, "out.txt")
+
+	g.Expect(runExport([]string{"-histfile", histPath, "-o", output, "-format", "text", "-user", "bob"})).To(gomega.BeNil())
+	transcript, err := ioutil.ReadFile(output)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(string(transcript)).To(gomega.Equal("[1970-01-01T00:03:20Z] bob: hi\n"))
+
+	// a date-only -until includes the whole day
+	day := time.Unix(200, 0).In(time.Local).Format("2006-01-02")
+	g.Expect(runExport([]string{"-histfile", histPath, "-o", output, "-format", "text", "-until", day})).To(gomega.BeNil())
+	transcript, err = ioutil.ReadFile(output)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(strings.Count(string(transcript), "\n")).To(gomega.Equal(2))
+
+	g.Expect(runExport([]string{"-histfile", histPath, "-format", "pdf"})).ToNot(gomega.BeNil())
+	g.Expect(runExport([]string{"-histfile", histPath, "-since", "yesterday"})).ToNot(gomega.BeNil())
+	g.Expect(runExport([]string{"-histfile", path.Join(dir, "missing.arborhist")})).ToNot(gomega.BeNil())
+	g.Expect(runExport([]string{})).ToNot(gomega.BeNil())
+}
+
+// TestRunMerge checks that the merge subcommand adds new messages from other history
+// files and quarantines conflicting messages when asked to.
+func TestRunMerge(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	shared := &arbor.ChatMessage{UUID: "shared", Username: "alice", Content: "hello", Timestamp: 100}
+	ours, dir := historyFileOrSkip(t, shared)
+	defer os.RemoveAll(dir)
+	friend, friendDir := historyFileOrSkip(t, shared,
+		&arbor.ChatMessage{UUID: "reply", Parent: "shared", Username: "bob", Content: "hi", Timestamp: 200})
+	defer os.RemoveAll(friendDir)
+	conflicting, conflictingDir := historyFileOrSkip(t,
+		&arbor.ChatMessage{UUID: "shared", Username: "mallory", Content: "forged", Timestamp: 100},
+		&arbor.ChatMessage{UUID: "other", Parent: "shared", Username: "carol", Content: "hey", Timestamp: 300})
+	defer os.RemoveAll(conflictingDir)
+	other, otherDir := historyFileOrSkip(t,
+		&arbor.ChatMessage{UUID: "shared", Username: "eve", Content: "also forged", Timestamp: 100})
+	defer os.RemoveAll(otherDir)
+	quarantine := path.Join(dir, "quarantine.json")
+
+	g.Expect(runMerge([]string{"-histfile", ours})).ToNot(gomega.BeNil())
+	g.Expect(runMerge([]string{"-histfile", ours, "-dry-run", friend})).To(gomega.BeNil())
+	unchanged, err := loadHistory(ours)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(unchanged.Has("reply")).To(gomega.BeFalse())
+
+	g.Expect(runMerge([]string{"-histfile", ours, friend, conflicting})).ToNot(gomega.BeNil())
+	merged, err := loadHistory(ours)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(merged.Has("reply")).To(gomega.BeTrue())
+	g.Expect(merged.Has("other")).To(gomega.BeFalse())
+
+	g.Expect(runMerge([]string{"-histfile", ours, "-quarantine", quarantine, conflicting})).To(gomega.BeNil())
+	merged, err = loadHistory(ours)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(merged.Has("other")).To(gomega.BeTrue())
+	g.Expect(merged.Get("shared").Content).To(gomega.Equal("hello"))
+
+	// every conflicting version is kept, including those already in the quarantine file
+	g.Expect(runMerge([]string{"-histfile", ours, "-quarantine", quarantine, other, conflicting})).To(gomega.BeNil())
+	file, err := os.Open(quarantine)
+	g.Expect(err).To(gomega.BeNil())
+	defer file.Close()
+	quarantined := &archive.Quarantine{}
+	g.Expect(quarantined.Load(file)).To(gomega.BeNil())
+	contents := []string{}
+	for _, message := range quarantined.Messages {
+		contents = append(contents, message.Content)
+	}
+	g.Expect(contents).To(gomega.ConsistOf("forged", "also forged"))
+}
+
+// TestRunFsck checks that the fsck subcommand detects a truncated history file and
+// salvages the messages that it can read.
+func TestRunFsck(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	histPath, dir := historyFileOrSkip(t,
+		&arbor.ChatMessage{UUID: "root", Username: "alice", Content: "hello", Timestamp: 100},
+		&arbor.ChatMessage{UUID: "reply", Parent: "root", Username: "bob", Content: "hi", Timestamp: 200},
+	)
+	defer os.RemoveAll(dir)
+	salvagePath := path.Join(dir, "salvaged.arborhist")
+	g.Expect(runFsck([]string{"-histfile", histPath})).To(gomega.BeNil())
+	g.Expect(runFsck([]string{"-histfile", histPath, "-salvage", histPath})).ToNot(gomega.BeNil())
+
+	contents, err := ioutil.ReadFile(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(ioutil.WriteFile(histPath, contents[:len(contents)/2+10], 0600)).To(gomega.BeNil())
+	g.Expect(runFsck([]string{"-histfile", histPath, "-salvage", salvagePath})).ToNot(gomega.BeNil())
+	salvaged, err := loadHistory(salvagePath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(salvaged.Has("root")).To(gomega.BeTrue())
+	g.Expect(runFsck([]string{"-histfile", salvagePath})).To(gomega.BeNil())
+}
+
+// TestRunFsckCompressed checks that the messages before the point at which a compressed
+// history file was truncated can be salvaged.
+func TestRunFsckCompressed(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	messages := []*arbor.ChatMessage{{UUID: "root", Username: "alice", Content: "hello", Timestamp: 100}}
+	for i := 0; i < 500; i++ {
+		messages = append(messages, &arbor.ChatMessage{UUID: fmt.Sprintf("reply-%d", i), Parent: "root",
+			Username: "bob", Content: fmt.Sprintf("reply number %d", i*7919), Timestamp: int64(200 + i)})
+	}
+	histPath, dir := historyFileOrSkip(t, messages...)
+	defer os.RemoveAll(dir)
+	salvagePath := path.Join(dir, "salvaged.arborhist")
+	history, err := loadHistory(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	history.SetCompression(true)
+	g.Expect(history.Save()).To(gomega.BeNil())
+
+	contents, err := ioutil.ReadFile(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(contents[:len(archive.GzipMagic)]).To(gomega.Equal(archive.GzipMagic))
+	g.Expect(ioutil.WriteFile(histPath, contents[:len(contents)/2], 0600)).To(gomega.BeNil())
+	g.Expect(runFsck([]string{"-histfile", histPath, "-salvage", salvagePath})).ToNot(gomega.BeNil())
+	salvaged, err := loadHistory(salvagePath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(salvaged.Has("root")).To(gomega.BeTrue())
+	g.Expect(salvaged.Has("reply-0")).To(gomega.BeTrue())
+	g.Expect(salvaged.Has("reply-499")).To(gomega.BeFalse())
+	g.Expect(runFsck([]string{"-histfile", salvagePath})).To(gomega.BeNil())
+}
+
+// TestRunPrune checks that a dry run leaves the history file alone and that pruning
+// removes old threads.
+func TestRunPrune(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	histPath, dir := historyFileOrSkip(t,
+		&arbor.ChatMessage{UUID: "root", Username: "alice", Content: "hello", Timestamp: 100},
+		&arbor.ChatMessage{UUID: "old", Parent: "root", Username: "bob", Content: "hi", Timestamp: 200},
+		&arbor.ChatMessage{UUID: "new", Parent: "root", Username: "carol", Content: "hey", Timestamp: 300},
+	)
+	defer os.RemoveAll(dir)
+	g.Expect(runPrune([]string{"-histfile", histPath})).ToNot(gomega.BeNil())
+
+	g.Expect(runPrune([]string{"-histfile", histPath, "-retain-count", "1", "-dry-run"})).To(gomega.BeNil())
+	history, err := loadHistory(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(history.Has("old")).To(gomega.BeTrue())
+
+	g.Expect(runPrune([]string{"-histfile", histPath, "-retain-count", "1"})).To(gomega.BeNil())
+	history, err = loadHistory(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(history.Has("old")).To(gomega.BeFalse())
+	g.Expect(history.Has("new")).To(gomega.BeTrue())
+	g.Expect(history.Has("root")).To(gomega.BeTrue())
+}
+
+// TestRunRekey checks that the rekey subcommand encrypts a history file, changes its
+// passphrase, and decrypts it.
+func TestRunRekey(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	histPath, dir := historyFileOrSkip(t,
+		&arbor.ChatMessage{UUID: "root", Username: "alice", Content: "hello", Timestamp: 100},
+	)
+	defer os.RemoveAll(dir)
+	defer func(original *bufio.Reader) { stdin = original }(stdin)
+	input := func(lines ...string) {
+		stdin = bufio.NewReader(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	}
+	encrypted := func() bool {
+		history, err := archive.NewManager(histPath)
+		g.Expect(err).To(gomega.BeNil())
+		encrypted, err := history.Encrypted()
+		g.Expect(err).To(gomega.BeNil())
+		return encrypted
+	}
+
+	input("first", "mistyped")
+	g.Expect(runRekey([]string{"-histfile", histPath})).ToNot(gomega.BeNil())
+	g.Expect(encrypted()).To(gomega.BeFalse())
+	input("first", "first")
+	g.Expect(runRekey([]string{"-histfile", histPath})).To(gomega.BeNil())
+	g.Expect(encrypted()).To(gomega.BeTrue())
+
+	input("wrong", "wrong", "wrong")
+	_, err := loadHistory(histPath)
+	g.Expect(err).ToNot(gomega.BeNil())
+	input("wrong", "first", "second", "second")
+	g.Expect(runRekey([]string{"-histfile", histPath})).To(gomega.BeNil())
+	input("second")
+	history, err := loadHistory(histPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(history.Has("root")).To(gomega.BeTrue())
+
+	input("second")
+	g.Expect(runRekey([]string{"-histfile", histPath, "-decrypt"})).To(gomega.BeNil())
+	g.Expect(encrypted()).To(gomega.BeFalse())
+}
@@ -0,0 +1,422 @@
+package tui
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/types"
+)
+
+// CommandPrefix is the character that marks the contents of the editor as a
+// command rather than a message. Typing it twice at the start of the editor
+// sends a message that begins with a single CommandPrefix.
+const CommandPrefix = "/"
+
+// Command is an action that can be invoked by typing "/name args..." into the
+// editor instead of a chat message.
+type Command interface {
+	// Name is the word that must follow the CommandPrefix to invoke the command.
+	Name() string
+	// Usage is a one-line description of the command's arguments and purpose.
+	Usage() string
+	// Run executes the command with the whitespace-separated arguments that
+	// followed its name. It is always invoked from within the gocui event loop.
+	Run(t *TUI, args []string) error
+}
+
+// simpleCommand adapts an ordinary function into a Command.
+type simpleCommand struct {
+	name, usage string
+	run         func(*TUI, []string) error
+}
+
+// NewCommand creates a Command that invokes the provided function when run.
+func NewCommand(name, usage string, run func(*TUI, []string) error) Command {
+	return &simpleCommand{name: name, usage: usage, run: run}
+}
+
+func (s *simpleCommand) Name() string {
+	return s.name
+}
+
+func (s *simpleCommand) Usage() string {
+	return s.usage
+}
+
+func (s *simpleCommand) Run(t *TUI, args []string) error {
+	return s.run(t, args)
+}
+
+// TextCommand is a Command whose argument is free text, such as a message, which must
+// be passed on exactly as it was typed rather than split into words.
+type TextCommand interface {
+	Command
+	// RunText executes the command with the text that followed its name (see
+	// CommandText). It is invoked instead of Run.
+	RunText(t *TUI, text string) error
+}
+
+// textCommand adapts an ordinary function into a TextCommand.
+type textCommand struct {
+	name, usage string
+	run         func(*TUI, string) error
+}
+
+// NewTextCommand creates a TextCommand that invokes the provided function when run.
+func NewTextCommand(name, usage string, run func(*TUI, string) error) TextCommand {
+	return &textCommand{name: name, usage: usage, run: run}
+}
+
+func (c *textCommand) Name() string {
+	return c.name
+}
+
+func (c *textCommand) Usage() string {
+	return c.usage
+}
+
+func (c *textCommand) Run(t *TUI, args []string) error {
+	return c.run(t, strings.Join(args, " "))
+}
+
+func (c *textCommand) RunText(t *TUI, text string) error {
+	return c.run(t, text)
+}
+
+// CommandSet is a collection of Commands indexed by name.
+type CommandSet struct {
+	commands map[string]Command
+}
+
+// NewCommandSet creates an empty CommandSet.
+func NewCommandSet() *CommandSet {
+	return &CommandSet{commands: make(map[string]Command)}
+}
+
+// Register adds a command to the set. It is an error to register a command
+// with an invalid name or with the same name as an existing command.
+func (c *CommandSet) Register(cmd Command) error {
+	if cmd == nil {
+		return fmt.Errorf("Cannot register nil command")
+	}
+	name := cmd.Name()
+	if name == "" || strings.IndexFunc(name, unicode.IsSpace) >= 0 || strings.HasPrefix(name, CommandPrefix) {
+		return fmt.Errorf("Illegal command name: \"%s\"", name)
+	}
+	if _, exists := c.commands[name]; exists {
+		return fmt.Errorf("Command \"%s\" is already registered", name)
+	}
+	c.commands[name] = cmd
+	return nil
+}
+
+// Lookup returns the command with the given name, if there is one.
+func (c *CommandSet) Lookup(name string) (Command, bool) {
+	cmd, ok := c.commands[name]
+	return cmd, ok
+}
+
+// Names returns the names of all registered commands in sorted order.
+func (c *CommandSet) Names() []string {
+	return c.Complete("")
+}
+
+// Complete returns the sorted names of all commands that begin with prefix.
+func (c *CommandSet) Complete(prefix string) []string {
+	matches := make([]string, 0)
+	for name := range c.commands {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// commonPrefix returns the longest string that begins every element of words.
+func commonPrefix(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// ParseCommand splits the contents of the editor into a command name and its
+// arguments. The final return value is false if the input is not a command
+// invocation, in which case it should be sent as a message. Input beginning
+// with a doubled CommandPrefix is never a command.
+func ParseCommand(input string) (name string, args []string, isCommand bool) {
+	if !strings.HasPrefix(input, CommandPrefix) || strings.HasPrefix(input, CommandPrefix+CommandPrefix) {
+		return "", nil, false
+	}
+	fields := strings.Fields(strings.TrimPrefix(input, CommandPrefix))
+	if len(fields) == 0 {
+		return "", nil, true
+	}
+	return fields[0], fields[1:], true
+}
+
+// CommandText returns the text that follows the name of the command in the input,
+// without the single space or newline that separates them. Unlike the arguments
+// returned by ParseCommand, its whitespace is preserved.
+func CommandText(input string) string {
+	rest := strings.TrimLeftFunc(strings.TrimPrefix(input, CommandPrefix), unicode.IsSpace)
+	if end := strings.IndexFunc(rest, unicode.IsSpace); end >= 0 {
+		_, size := utf8.DecodeRuneInString(rest[end:])
+		return rest[end+size:]
+	}
+	return ""
+}
+
+// defaultCommands returns the commands that every TUI supports.
+func defaultCommands() []Command {
+	return []Command{
+		NewCommand("help", "/help - list the available commands", cmdHelp),
+		NewCommand("who", "/who - ask the server who is online and show the user list", cmdWho),
+		NewCommand("query", "/query <id>... - request the messages with the given ids from the server", cmdQuery),
+		NewCommand("goto", "/goto <id> - select the message with the given id (or unique id prefix)", cmdGoto),
+		NewCommand("nick", "/nick <name> - change your username", cmdNick),
+		NewCommand("quit", "/quit - leave the server and exit", cmdQuit),
+		NewCommand("export", "/export <path> - write the chat history to a .json file, or a transcript to a .md, .html, or .txt file", cmdExport),
+		NewCommand("reconnect", "/reconnect - drop the current connection and connect again", cmdReconnect),
+		NewTextCommand("edit", "/edit <text> - replace the text of the selected message, which must be yours", cmdEdit),
+		NewCommand("delete", "/delete - retract the selected message, which must be yours", cmdDelete),
+		NewCommand("react", "/react <emoji or tag> - react to the selected message, or withdraw the same reaction", cmdReact),
+		NewCommand("protect", "/protect - encrypt later replies beneath the selected message and show the key to share", cmdProtect),
+		NewCommand("threadkey", "/threadkey <key> - decrypt a protected thread with a key shared by another participant", cmdThreadKey),
+	}
+}
+
+// cmdHelp lists the names of all known commands.
+func cmdHelp(t *TUI, args []string) error {
+	if len(args) > 0 {
+		cmd, ok := t.commands.Lookup(strings.TrimPrefix(args[0], CommandPrefix))
+		if !ok {
+			return fmt.Errorf("unknown command \"%s\"", args[0])
+		}
+		t.Editor.SetFeedback(cmd.Usage())
+		return nil
+	}
+	t.Editor.SetFeedback("commands: " + CommandPrefix + strings.Join(t.commands.Names(), " "+CommandPrefix))
+	return nil
+}
+
+// cmdWho asks the server for the list of online users and displays it.
+func cmdWho(t *TUI, args []string) error {
+	go t.Client.AskWho()
+	return t.showUserList(t.Gui)
+}
+
+// cmdQuery sends a query for each of its arguments.
+func cmdQuery(t *TUI, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: /query <id>...")
+	}
+	go func() {
+		for _, id := range args {
+			t.Client.Query(id)
+		}
+	}()
+	log.Printf("Manual query for %v\n", args)
+	return nil
+}
+
+// cmdGoto moves the cursor to the requested message.
+func cmdGoto(t *TUI, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /goto <id>")
+	}
+	if err := t.histState.CursorTo(args[0]); err != nil {
+		return err
+	}
+	t.reRender()
+	t.scrollToCursor()
+	return nil
+}
+
+// cmdNick changes the user's name.
+func cmdNick(t *TUI, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /nick <name>")
+	}
+	if err := t.Client.ChangeUsername(args[0]); err != nil {
+		return err
+	}
+	t.Editor.SetFeedback("you are now known as " + t.Client.Username())
+	return nil
+}
+
+// cmdQuit exits the TUI.
+func cmdQuit(t *TUI, args []string) error {
+	return t.quit(t.Gui, nil)
+}
+
+// exporter is implemented by clients that can write transcripts of their history.
+type exporter interface {
+	Export(io.Writer, archive.Format, archive.ExportFilter) error
+}
+
+// historyExtension is the extension of files that /export writes in the same format
+// as the history file.
+const historyExtension = "json"
+
+// cmdExport writes the current contents of the archive to a file. If the file's
+// extension is historyExtension, the history is written in the same format as the
+// history file. Otherwise the extension must name a transcript format. The file is
+// left alone if the extension is unknown.
+func cmdExport(t *TUI, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /export <path>")
+	}
+	extension := strings.TrimPrefix(filepath.Ext(args[0]), ".")
+	write := t.Client.Persist
+	if !strings.EqualFold(extension, historyExtension) {
+		format, err := archive.ParseFormat(extension)
+		if err != nil {
+			return fmt.Errorf("unknown export format: use a .json, .md, .html, or .txt file")
+		}
+		e, canExport := t.Client.(exporter)
+		if !canExport {
+			return fmt.Errorf("transcripts are not supported")
+		}
+		write = func(w io.Writer) error {
+			return e.Export(w, format, archive.ExportFilter{})
+		}
+	}
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := write(file); err != nil {
+		return err
+	}
+	t.Editor.SetFeedback("history exported to " + args[0])
+	return nil
+}
+
+// cmdReconnect closes the current connection. The connection manager will
+// then establish a new one.
+func cmdReconnect(t *TUI, args []string) error {
+	if !t.connected {
+		return fmt.Errorf("not connected")
+	}
+	go func() {
+		if err := t.Client.Disconnect(); err != nil {
+			log.Println("Error disconnecting", err)
+		}
+	}()
+	return nil
+}
+
+// cmdProtect encrypts the thread beneath the selected message and shows its key so
+// that it can be shared with the other participants.
+func cmdProtect(t *TUI, args []string) error {
+	protector, ok := t.Client.(types.ThreadProtector)
+	if !ok {
+		return fmt.Errorf("encryption is not supported")
+	}
+	root := t.histState.Current()
+	if root == "" {
+		return fmt.Errorf("no message selected")
+	}
+	shared, err := protector.ProtectThread(root)
+	if err != nil {
+		return err
+	}
+	t.Editor.SetFeedback("share this key out-of-band: " + shared)
+	return nil
+}
+
+// cmdThreadKey adds a key for a thread protected by another participant.
+func cmdThreadKey(t *TUI, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /threadkey <key>")
+	}
+	protector, ok := t.Client.(types.ThreadProtector)
+	if !ok {
+		return fmt.Errorf("encryption is not supported")
+	}
+	root, err := protector.AddThreadKey(args[0])
+	if err != nil {
+		return err
+	}
+	t.reRender()
+	t.Editor.SetFeedback("added key for the thread beneath " + root)
+	return nil
+}
+
+// cmdEdit replaces the content of the selected message with the text exactly as it
+// was typed.
+func cmdEdit(t *TUI, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("usage: /edit <text>")
+	}
+	reviser, ok := t.Client.(types.Reviser)
+	if !ok {
+		return fmt.Errorf("editing is not supported")
+	}
+	id := t.histState.Current()
+	if id == "" {
+		return fmt.Errorf("no message selected")
+	}
+	if err := reviser.Edit(id, text); err != nil {
+		return err
+	}
+	t.reRender()
+	t.Editor.SetFeedback("edited " + id)
+	return nil
+}
+
+// cmdDelete retracts the selected message.
+func cmdDelete(t *TUI, args []string) error {
+	reviser, ok := t.Client.(types.Reviser)
+	if !ok {
+		return fmt.Errorf("deleting is not supported")
+	}
+	id := t.histState.Current()
+	if id == "" {
+		return fmt.Errorf("no message selected")
+	}
+	if err := reviser.Retract(id); err != nil {
+		return err
+	}
+	t.reRender()
+	t.Editor.SetFeedback("deleted " + id)
+	return nil
+}
+
+// cmdReact reacts to the selected message.
+func cmdReact(t *TUI, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /react <emoji or tag>")
+	}
+	reactor, ok := t.Client.(types.Reactor)
+	if !ok {
+		return fmt.Errorf("reactions are not supported")
+	}
+	id := t.histState.Current()
+	if id == "" {
+		return fmt.Errorf("no message selected")
+	}
+	if err := reactor.React(id, args[0]); err != nil {
+		return err
+	}
+	t.reRender()
+	t.Editor.SetFeedback("toggled your reaction " + args[0])
+	return nil
+}
@@ -0,0 +1,80 @@
+package tui_test
+
+import (
+	"testing"
+
+	"github.com/arborchat/muscadine/tui"
+	"github.com/onsi/gomega"
+)
+
+func noopCommand(name string) tui.Command {
+	return tui.NewCommand(name, "/"+name, func(*tui.TUI, []string) error { return nil })
+}
+
+// TestCommandSetRegister ensures that commands can be registered and looked up, and
+// that invalid or duplicate commands are rejected.
+func TestCommandSetRegister(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	set := tui.NewCommandSet()
+	g.Expect(set.Register(noopCommand("who"))).To(gomega.BeNil())
+	cmd, ok := set.Lookup("who")
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(cmd.Name()).To(gomega.Equal("who"))
+	_, ok = set.Lookup("what")
+	g.Expect(ok).To(gomega.BeFalse())
+
+	g.Expect(set.Register(noopCommand("who"))).ToNot(gomega.BeNil())
+	g.Expect(set.Register(noopCommand(""))).ToNot(gomega.BeNil())
+	g.Expect(set.Register(noopCommand("two words"))).ToNot(gomega.BeNil())
+	g.Expect(set.Register(noopCommand("/slash"))).ToNot(gomega.BeNil())
+	g.Expect(set.Register(nil)).ToNot(gomega.BeNil())
+}
+
+// TestCommandSetComplete ensures that command names are completed from their prefixes
+// in sorted order.
+func TestCommandSetComplete(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	set := tui.NewCommandSet()
+	for _, name := range []string{"quit", "query", "goto"} {
+		if err := set.Register(noopCommand(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.Expect(set.Complete("qu")).To(gomega.Equal([]string{"query", "quit"}))
+	g.Expect(set.Complete("g")).To(gomega.Equal([]string{"goto"}))
+	g.Expect(set.Complete("x")).To(gomega.BeEmpty())
+	g.Expect(set.Names()).To(gomega.Equal([]string{"goto", "query", "quit"}))
+}
+
+// TestParseCommand ensures that editor contents are correctly split into commands
+// and arguments, and that ordinary or escaped messages are not treated as commands.
+func TestParseCommand(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	name, args, isCommand := tui.ParseCommand("/query  abc def")
+	g.Expect(isCommand).To(gomega.BeTrue())
+	g.Expect(name).To(gomega.Equal("query"))
+	g.Expect(args).To(gomega.Equal([]string{"abc", "def"}))
+
+	name, args, isCommand = tui.ParseCommand("/quit")
+	g.Expect(isCommand).To(gomega.BeTrue())
+	g.Expect(name).To(gomega.Equal("quit"))
+	g.Expect(args).To(gomega.BeEmpty())
+
+	name, _, isCommand = tui.ParseCommand("/")
+	g.Expect(isCommand).To(gomega.BeTrue())
+	g.Expect(name).To(gomega.Equal(""))
+
+	_, _, isCommand = tui.ParseCommand("hello /quit")
+	g.Expect(isCommand).To(gomega.BeFalse())
+	_, _, isCommand = tui.ParseCommand("//quit is a command")
+	g.Expect(isCommand).To(gomega.BeFalse())
+}
+
+// TestCommandText checks that the text following a command's name keeps its
+// whitespace.
+func TestCommandText(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	g.Expect(tui.CommandText("/edit  two  spaces\nand a line")).To(gomega.Equal(" two  spaces\nand a line"))
+	g.Expect(tui.CommandText("/edit\nfirst line")).To(gomega.Equal("first line"))
+	g.Expect(tui.CommandText("/edit")).To(gomega.BeEmpty())
+}
@@ -26,12 +26,18 @@ type Editor struct {
 	Title   string
 	ReplyTo *arbor.ChatMessage
 	Content string
+	// Feedback is a short status or error message displayed in the title of the
+	// editor, such as the result of a command.
+	Feedback string
 	// Each of these booleans represents whether or not a state change is requested next time
 	// the Layout method is invoked. This decouples the Editor type from the view that it manages
 	// except for Layout and the Action functions
 	focus, unfocus, clear bool
 	// literalEnter is whether or not the enter key is interpreted literally in the editor.
 	literalEnter bool
+	// OnEdit, if set, is invoked from the event loop after each keystroke typed into
+	// the view.
+	OnEdit func(v *gocui.View)
 }
 
 // NewEditor creates a new controller for an Editor view.
@@ -73,6 +79,23 @@ func (e *Editor) Clear() error {
 	return nil
 }
 
+// SetFeedback displays the provided text in the editor's title until it is replaced
+// or cleared. Pass the empty string to clear it.
+func (e *Editor) SetFeedback(feedback string) {
+	e.Feedback = feedback
+}
+
+// replaceContent substitutes the given text for the current contents of the view and
+// places the cursor at the end of it.
+func replaceContent(v *gocui.View, content string) {
+	v.Clear()
+	v.SetCursor(0, 0)
+	v.SetOrigin(0, 0)
+	for _, r := range content {
+		v.EditWrite(r)
+	}
+}
+
 // ActionInsertNewline adds a newline character into the editor at the current cursor position.
 func (e *Editor) ActionInsertNewline(g *gocui.Gui, v *gocui.View) error {
 	v.EditNewLine()
@@ -116,7 +139,11 @@ func (e *Editor) Layout(g *gocui.Gui) error {
 		}
 		// If we are creating the view for the first time, configure its settings
 		v.Editable = true
-		v.Editor = &EditCore{}
+		v.Editor = &EditCore{onEdit: func(v *gocui.View) {
+			if e.OnEdit != nil {
+				e.OnEdit(v)
+			}
+		}}
 		v.Frame = true
 		v.Wrap = false
 	}
@@ -129,6 +156,9 @@ func (e *Editor) Layout(g *gocui.Gui) error {
 	if e.EnterIsLiteral() {
 		v.Title += " <paste mode>"
 	}
+	if e.Feedback != "" {
+		v.Title += " | " + e.Feedback
+	}
 
 	if e.focus {
 		g.Cursor = true
@@ -145,7 +175,10 @@ func (e *Editor) Layout(g *gocui.Gui) error {
 	return nil
 }
 
+// EditCore handles the keystrokes typed into an editable view.
 type EditCore struct {
+	// onEdit is invoked after each keystroke.
+	onEdit func(v *gocui.View)
 }
 
 // Edit handles a single keypress in the editor
@@ -171,4 +204,7 @@ func (e *EditCore) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifie
 	case key == gocui.KeyArrowRight:
 		v.MoveCursor(1, 0, false)
 	}
+	if e.onEdit != nil {
+		e.onEdit(v)
+	}
 }
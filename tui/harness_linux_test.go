@@ -0,0 +1,484 @@
+package tui_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/muscadine/archive"
+	"github.com/arborchat/muscadine/session"
+	"github.com/arborchat/muscadine/tui"
+	"github.com/arborchat/muscadine/types"
+	"github.com/onsi/gomega"
+	"github.com/whereswaldon/gocui"
+)
+
+// The TUI draws with termbox, which only works on the process's controlling terminal.
+// Each screen test therefore runs itself again in a subprocess whose controlling
+// terminal is a pseudo-terminal of a fixed size. The subprocess types into the TUI
+// through the pseudo-terminal and reads the screen back from termbox's cell buffer.
+
+var update = flag.Bool("update", false, "rewrite the golden screen snapshots in testdata")
+
+// terminalEnv is set in the environment of the subprocess that runs a screen test.
+const terminalEnv = "MUSCADINE_TEST_TERMINAL"
+
+// The size of the simulated screen.
+const screenWidth, screenHeight = 80, 24
+
+// keySequences are the bytes that an xterm sends for special keys.
+var keySequences = map[gocui.Key]string{
+	gocui.KeyArrowUp:    "\x1bOA",
+	gocui.KeyArrowDown:  "\x1bOB",
+	gocui.KeyArrowRight: "\x1bOC",
+	gocui.KeyArrowLeft:  "\x1bOD",
+	gocui.KeyHome:       "\x1bOH",
+	gocui.KeyEnd:        "\x1bOF",
+	gocui.KeyEnter:      "\r",
+	gocui.KeyTab:        "\t",
+	gocui.KeyEsc:        "\x1b",
+	gocui.KeyCtrlC:      "\x03",
+	gocui.KeyCtrlP:      "\x10",
+}
+
+// openTerminal creates a pseudo-terminal of the screen's size. It returns the master
+// end, which controls the terminal, and the slave end, which programs use as their
+// terminal.
+func openTerminal() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var number uint32
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&number)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	size := struct{ rows, cols, x, y uint16 }{screenHeight, screenWidth, 0, 0}
+	if err := ioctl(master, syscall.TIOCSWINSZ, unsafe.Pointer(&size)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// ioctl performs the ioctl request on the file.
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// inTerminal runs the screen test in a subprocess controlled by a pseudo-terminal.
+// Within that subprocess, it starts a TUI and passes it to the test.
+func inTerminal(t *testing.T, test func(*harness)) {
+	if os.Getenv(terminalEnv) == "" {
+		runInTerminal(t)
+		return
+	}
+	h := newHarness(t)
+	defer h.close()
+	test(h)
+}
+
+// runInTerminal runs the current test again in a subprocess controlled by a
+// pseudo-terminal, and fails if it fails.
+func runInTerminal(t *testing.T) {
+	master, slave, err := openTerminal()
+	if err != nil {
+		t.Skip("Unable to open a pseudo-terminal", err)
+	}
+	defer master.Close()
+	args := []string{"-test.run=^" + t.Name() + "$", "-test.v"}
+	if *update {
+		args = append(args, "-update")
+	}
+	output := new(bytes.Buffer)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), terminalEnv+"=1", "TERM=xterm", "TZ=UTC")
+	cmd.Stdin = slave
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// the subprocess types into its terminal through the master end
+	cmd.ExtraFiles = []*os.File{master}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	err = cmd.Run()
+	slave.Close()
+	if err != nil {
+		t.Fatalf("Screen test failed in its terminal: %s\n%s", err, output)
+	} else if !strings.Contains(output.String(), "--- PASS: "+t.Name()) {
+		t.Fatalf("Screen test did not run in its terminal:\n%s", output)
+	}
+}
+
+// harness drives a TUI running on the terminal of the current process.
+type harness struct {
+	*testing.T
+	g      *gomega.GomegaWithT
+	ui     *tui.TUI
+	client *fakeClient
+	// keyboard is the master end of the terminal.
+	keyboard *os.File
+}
+
+// newHarness starts a TUI for a fake client on the terminal of the current process.
+func newHarness(t *testing.T) *harness {
+	log.SetOutput(ioutil.Discard)
+	keyboard := os.NewFile(3, "terminal")
+	// the terminal blocks once its output buffer is full, so discard everything that
+	// the TUI writes to it
+	go io.Copy(ioutil.Discard, keyboard)
+	client := newFakeClient()
+	ui, err := tui.NewTUI(client, 10*time.Minute)
+	if err != nil {
+		t.Fatal("Unable to start TUI", err)
+	}
+	h := &harness{T: t, g: gomega.NewGomegaWithT(t), ui: ui, client: client, keyboard: keyboard}
+	h.waitFor("Chat History")
+	return h
+}
+
+// close quits the TUI and waits for it to exit.
+func (h *harness) close() {
+	h.press(gocui.KeyCtrlC)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		h.ui.AwaitExit()
+	}()
+	h.g.Eventually(exited).Should(gomega.BeClosed())
+}
+
+// press types each of the keys, which may be gocui.Keys, runes, or strings.
+func (h *harness) press(keys ...interface{}) {
+	for _, key := range keys {
+		var input string
+		switch k := key.(type) {
+		case gocui.Key:
+			sequence, ok := keySequences[k]
+			if !ok {
+				h.Fatalf("No input sequence for key %v", k)
+			}
+			input = sequence
+		case rune:
+			input = string(k)
+		case string:
+			input = k
+		default:
+			h.Fatalf("Unable to press %v", key)
+		}
+		if _, err := h.keyboard.WriteString(input); err != nil {
+			h.Fatal("Unable to type into terminal", err)
+		}
+		// give the TUI a chance to handle each key separately, since an escape
+		// followed too closely by another key would be read as an escape sequence
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// screen returns the text currently drawn on the screen, without trailing spaces.
+func (h *harness) screen() string {
+	lines := make(chan []string, 1)
+	h.ui.Update(func(g *gocui.Gui) error {
+		width, height := g.Size()
+		drawn := make([]string, 0, height)
+		for y := 0; y < height; y++ {
+			line := make([]rune, 0, width)
+			for x := 0; x < width; x++ {
+				r, _ := g.Rune(x, y)
+				if r == 0 {
+					r = ' '
+				}
+				line = append(line, r)
+			}
+			drawn = append(drawn, strings.TrimRight(string(line), " "))
+		}
+		lines <- drawn
+		return nil
+	})
+	select {
+	case drawn := <-lines:
+		return strings.TrimRight(strings.Join(drawn, "\n"), "\n") + "\n"
+	case <-time.After(time.Second):
+		return ""
+	}
+}
+
+// waitFor waits until the text is drawn on the screen.
+func (h *harness) waitFor(text string) {
+	h.g.Eventually(h.screen, 2*time.Second).Should(gomega.ContainSubstring(text))
+}
+
+// settle waits until the screen stops changing and returns its contents.
+func (h *harness) settle() string {
+	previous := h.screen()
+	for {
+		time.Sleep(100 * time.Millisecond)
+		current := h.screen()
+		if current == previous {
+			return current
+		}
+		previous = current
+	}
+}
+
+// matchGolden checks that the screen eventually matches the named snapshot in
+// testdata. With -update, the snapshot is rewritten from the screen instead.
+func (h *harness) matchGolden(name string) {
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			h.Fatal(err)
+		}
+		if err := ioutil.WriteFile(golden, []byte(h.settle()), 0644); err != nil {
+			h.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		h.Fatal("Unable to read snapshot (run with -update to create it)", err)
+	}
+	h.g.Eventually(h.screen, 2*time.Second).Should(gomega.Equal(string(expected)), "screen does not match "+golden)
+}
+
+// fakeClient is a types.Client that records what the TUI sends instead of talking to
+// a server.
+type fakeClient struct {
+	*archive.Archive
+	*session.List
+	lock     sync.Mutex
+	username string
+	replies  []*arbor.ChatMessage
+	// refusal is returned by Reply instead of sending the reply, if it is set.
+	refusal error
+	queries []string
+	receive func(*arbor.ChatMessage)
+	revise  func(string)
+	react   func(string)
+	// typists are the users reported as typing, and announced holds the parents of
+	// the replies that the TUI announced the user to be typing.
+	typists   map[string]string
+	announced []string
+	// viewers maps message IDs to the users reported to have seen them, and seen
+	// holds the messages that the TUI announced the user to have seen.
+	viewers map[string][]string
+	seen    []string
+	// notes maps message IDs to their annotations.
+	notes map[string][]string
+}
+
+var _ types.Client = &fakeClient{}
+var _ types.Reviser = &fakeClient{}
+var _ types.Reactor = &fakeClient{}
+var _ types.TypingIndicator = &fakeClient{}
+var _ types.SeenIndicator = &fakeClient{}
+var _ types.Annotator = &fakeClient{}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{Archive: archive.New(), List: session.NewList(), username: "tester"}
+}
+
+// deliver hands the messages to the TUI as though they had arrived from the server.
+func (c *fakeClient) deliver(messages ...*arbor.ChatMessage) {
+	c.lock.Lock()
+	receive := c.receive
+	c.lock.Unlock()
+	for _, message := range messages {
+		receive(message)
+	}
+}
+
+// sent returns the replies that the TUI has sent.
+func (c *fakeClient) sent() []*arbor.ChatMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*arbor.ChatMessage{}, c.replies...)
+}
+
+func (c *fakeClient) Username() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.username
+}
+
+func (c *fakeClient) ChangeUsername(username string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.username = username
+	return nil
+}
+
+// refuse makes Reply fail with the error instead of sending replies.
+func (c *fakeClient) refuse(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.refusal = err
+}
+
+func (c *fakeClient) Reply(parent, content string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.refusal != nil {
+		return c.refusal
+	}
+	c.replies = append(c.replies, &arbor.ChatMessage{Parent: parent, Content: content, Username: c.username})
+	return nil
+}
+
+func (c *fakeClient) Query(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queries = append(c.queries, id)
+}
+
+func (c *fakeClient) AskWho()                {}
+func (c *fakeClient) AnnounceHere(string)    {}
+func (c *fakeClient) AnnounceLeaving(string) {}
+func (c *fakeClient) SessionID() string      { return "session" }
+func (c *fakeClient) Connect() error         { return nil }
+func (c *fakeClient) Disconnect() error      { return nil }
+
+func (c *fakeClient) OnDisconnect(handler func(types.Connection)) {}
+
+func (c *fakeClient) OnReceive(handler func(*arbor.ChatMessage)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.receive = handler
+}
+
+func (c *fakeClient) Edit(id, content string) error {
+	return c.record(id, types.Revision{Content: content, Timestamp: time.Now().UnixNano()})
+}
+
+func (c *fakeClient) Retract(id string) error {
+	return c.record(id, types.Revision{Retracted: true, Timestamp: time.Now().UnixNano()})
+}
+
+// record revises the message and tells the TUI about it.
+func (c *fakeClient) record(id string, revision types.Revision) error {
+	if err := c.Archive.Revise(id, revision); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	revise := c.revise
+	c.lock.Unlock()
+	revise(id)
+	return nil
+}
+
+func (c *fakeClient) OnRevise(handler func(string)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.revise = handler
+}
+
+func (c *fakeClient) React(id, tag string) error {
+	if err := c.Archive.AddReaction(id, c.Username(), tag); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	react := c.react
+	c.lock.Unlock()
+	react(id)
+	return nil
+}
+
+func (c *fakeClient) OnReact(handler func(string)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.react = handler
+}
+
+func (c *fakeClient) AnnounceTyping(parent, sessionID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.announced = append(c.announced, parent)
+}
+
+// typingAnnounced returns the parents of the replies that the TUI announced.
+func (c *fakeClient) typingAnnounced() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.announced...)
+}
+
+// setTyping changes the users reported as typing.
+func (c *fakeClient) setTyping(typists map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.typists = typists
+}
+
+func (c *fakeClient) Typing() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	typing := make(map[string]string, len(c.typists))
+	for username, parent := range c.typists {
+		typing[username] = parent
+	}
+	return typing
+}
+
+func (c *fakeClient) AnnounceSeen(id, sessionID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seen = append(c.seen, id)
+}
+
+// seenAnnounced returns the messages that the TUI announced the user to have seen.
+func (c *fakeClient) seenAnnounced() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.seen...)
+}
+
+// setViewers changes the users reported to have seen each message.
+func (c *fakeClient) setViewers(viewers map[string][]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.viewers = viewers
+}
+
+func (c *fakeClient) SeenBy(id string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.viewers[id]...)
+}
+
+// annotate changes the annotations of each message.
+func (c *fakeClient) annotate(notes map[string][]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.notes = notes
+}
+
+func (c *fakeClient) Annotations(id string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.notes[id]...)
+}
@@ -3,6 +3,7 @@ package tui
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	arbor "github.com/arborchat/arbor-go"
@@ -25,6 +26,15 @@ type HistoryState struct {
 	currentIndex                   int
 	cursorLineStart, cursorLineEnd int
 	changeFuncs                    chan func()
+	// filter is the username whose messages are shown. If it is empty, all
+	// messages are shown.
+	filter string
+	// expanded is the ID of the message whose previous versions are shown.
+	expanded string
+	// seen is the ID of the newest message that the cursor has selected, and
+	// seenTimestamp is its timestamp.
+	seen          string
+	seenTimestamp int64
 }
 
 const (
@@ -56,7 +66,7 @@ func NewHistoryState(a types.Archive) (*HistoryState, error) {
 		Archive:     a,
 		changeFuncs: make(chan func()),
 	}
-	h.History = h.Archive.Last(defaultHistoryCapacity)
+	h.refresh()
 	if len(h.History) > 0 {
 		h.currentIndex = 0
 		h.current = h.History[0].UUID
@@ -123,6 +133,218 @@ func RenderMessage(message *arbor.ChatMessage, width int, colorPre string, color
 	return outputLines
 }
 
+// RenderReactions creates a text format of the reactions to a message, showing how
+// many users reacted with each tag. The result is a single row of output indented by
+// the given number of columns, so that it can be placed beneath the message's content.
+func RenderReactions(reactions []types.Reaction, indent int) []byte {
+	counts := make([]string, 0, len(reactions))
+	for _, reaction := range reactions {
+		counts = append(counts, fmt.Sprintf("[%s ×%d]", reaction.Tag, len(reaction.Usernames)))
+	}
+	return []byte(strings.Repeat(" ", indent) + strings.Join(counts, " ") + "\n")
+}
+
+// RenderTyping creates a text format of the users who are composing replies to a
+// message. The result is a single row of output indented by the given number of
+// columns, so that it can be placed beneath the message's content.
+func RenderTyping(usernames []string, indent int) []byte {
+	return []byte(strings.Repeat(" ", indent) + "✎ " + strings.Join(usernames, ", ") + " replying…\n")
+}
+
+// RenderSeen creates a text format of the users who have viewed a message. The result
+// is a single row of output indented by the given number of columns, so that it can be
+// placed beneath the message's content.
+func RenderSeen(usernames []string, indent int) []byte {
+	return []byte(strings.Repeat(" ", indent) + "seen by " + strings.Join(usernames, ", ") + "\n")
+}
+
+// RenderAnnotations creates a text format of the notes about a message. The result is
+// a row of output for each note, indented by the given number of columns, so that it
+// can be placed beneath the message's content.
+func RenderAnnotations(notes []string, indent int) [][]byte {
+	rows := make([][]byte, 0, len(notes))
+	for _, note := range notes {
+		note = strings.Replace(note, "\n", " ", -1)
+		rows = append(rows, []byte(strings.Repeat(" ", indent)+"» "+note+"\n"))
+	}
+	return rows
+}
+
+// shortIDLength is the number of characters of a message id shown in placeholders.
+const shortIDLength = 8
+
+// RenderPlaceholder creates a text format of a message that is missing from the
+// history. If unavailable is true, the message will never be retrieved; otherwise
+// it is still being requested. The result is a single row of output.
+func RenderPlaceholder(id string, unavailable bool, colorPre string, colorPost string) []byte {
+	if len(id) > shortIDLength {
+		id = id[:shortIDLength]
+	}
+	status := "still fetching"
+	if unavailable {
+		status = "permanently missing"
+	}
+	return []byte(colorPre + "[message " + id + " is " + status + "]" + colorPost + "\n")
+}
+
+// verificationMarks are appended to the usernames of messages to show whether their
+// signatures were verified.
+var verificationMarks = map[types.Verification]string{
+	types.Unverified: " ?",
+	types.Verified:   " ✓",
+	types.Invalid:    " ✗",
+}
+
+// EditedMark is appended to the content of messages that their authors edited.
+const EditedMark = " (edited)"
+
+// RetractedPlaceholder replaces the content of messages that their authors retracted.
+const RetractedPlaceholder = "[deleted by its author]"
+
+// original returns the content of the message as it was sent. If the Archive decrypts
+// messages, the content is decrypted. If it verifies signatures, the signature is
+// removed from the content and the outcome of the verification is returned as well.
+func (h *HistoryState) original(message *arbor.ChatMessage) (string, types.Verification) {
+	shown := *message
+	if decrypter, ok := h.Archive.(types.Decrypter); ok {
+		shown.Content = decrypter.Decrypt(message)
+	}
+	if verifier, ok := h.Archive.(types.Verifier); ok {
+		result, content := verifier.Verify(&shown)
+		return content, result
+	}
+	return shown.Content, types.NotChecked
+}
+
+// revisions returns the changes that the author made to the message, if the Archive
+// keeps track of them.
+func (h *HistoryState) revisions(id string) []types.Revision {
+	if keeper, ok := h.Archive.(types.RevisionKeeper); ok {
+		return keeper.Revisions(id)
+	}
+	return nil
+}
+
+// reactions returns the reactions to the message, if the Archive keeps track of them.
+func (h *HistoryState) reactions(id string) []types.Reaction {
+	if keeper, ok := h.Archive.(types.ReactionKeeper); ok {
+		return keeper.Reactions(id)
+	}
+	return nil
+}
+
+// annotations returns the notes about the message, if the Archive keeps any.
+func (h *HistoryState) annotations(id string) []string {
+	if annotator, ok := h.Archive.(types.Annotator); ok {
+		return annotator.Annotations(id)
+	}
+	return nil
+}
+
+// rewritten returns the content to show in place of the message's original content,
+// if the Archive rewrites any messages. The final return value is false if the message
+// is shown as it was sent.
+func (h *HistoryState) rewritten(id string) (string, bool) {
+	if rewriter, ok := h.Archive.(types.Rewriter); ok {
+		return rewriter.Rewritten(id)
+	}
+	return "", false
+}
+
+// typists returns the users who are composing replies to each message, sorted by
+// name, if the Archive can tell who is typing.
+func (h *HistoryState) typists() map[string][]string {
+	indicator, ok := h.Archive.(types.TypingIndicator)
+	if !ok {
+		return nil
+	}
+	typing := indicator.Typing()
+	byParent := make(map[string][]string)
+	for username, parent := range typing {
+		byParent[parent] = append(byParent[parent], username)
+	}
+	for _, usernames := range byParent {
+		sort.Strings(usernames)
+	}
+	return byParent
+}
+
+// seenBy returns the users who have viewed the message, if the Archive can tell.
+func (h *HistoryState) seenBy(id string) []string {
+	if indicator, ok := h.Archive.(types.SeenIndicator); ok {
+		return indicator.SeenBy(id)
+	}
+	return nil
+}
+
+// revisedContent returns the content that a revision gives its message.
+func revisedContent(revision types.Revision) string {
+	if revision.Retracted {
+		return RetractedPlaceholder
+	}
+	return revision.Content
+}
+
+// content returns the current content of the message, which is that of its latest
+// revision if its author changed it.
+func (h *HistoryState) content(message *arbor.ChatMessage) string {
+	if revisions := h.revisions(message.UUID); len(revisions) > 0 {
+		return revisedContent(revisions[len(revisions)-1])
+	}
+	content, _ := h.original(message)
+	return content
+}
+
+// displayed returns the message as it should be shown. Its content is the original
+// content (see original), or its rewrite if it has one, unless its author revised it,
+// in which case the latest revision is shown instead. The username is marked with the outcome of verifying the
+// original signature. If the previous versions of the message are expanded, they are
+// listed after its content.
+func (h *HistoryState) displayed(message *arbor.ChatMessage) *arbor.ChatMessage {
+	shown := *message
+	content, result := h.original(message)
+	if rewritten, ok := h.rewritten(message.UUID); ok {
+		content = rewritten
+	}
+	shown.Content = content
+	shown.Username += verificationMarks[result]
+	revisions := h.revisions(message.UUID)
+	if len(revisions) == 0 {
+		return &shown
+	}
+	latest := revisions[len(revisions)-1]
+	shown.Content = revisedContent(latest)
+	if !latest.Retracted {
+		shown.Content += EditedMark
+	}
+	if h.expanded == message.UUID {
+		versions := []string{content}
+		for _, revision := range revisions[:len(revisions)-1] {
+			versions = append(versions, revisedContent(revision))
+		}
+		for i, version := range versions {
+			shown.Content += fmt.Sprintf("\n[version %d] %s", i+1, version)
+		}
+	}
+	return &shown
+}
+
+// ToggleVersions shows the previous versions of the currently-selected message
+// beneath it, or hides them if they are already shown. Only one message's versions
+// are shown at a time.
+func (h *HistoryState) ToggleVersions() {
+	done := make(chan error)
+	h.changeFuncs <- func() {
+		defer close(done)
+		if h.expanded == h.current {
+			h.expanded = ""
+		} else {
+			h.expanded = h.current
+		}
+	}
+	<-done
+}
+
 // currentAncestors returns the ancestor ids for the HistoryState's currently-selected
 // message.
 func (h *HistoryState) currentAncestors() []string {
@@ -159,17 +381,45 @@ func (h *HistoryState) currentDescendants() []string {
 // writer. Each time it is invoked, it will render the entire history, so the
 // writer should be empty when it is invoked.
 func (h *HistoryState) Render(target io.Writer) error {
+	done := make(chan error)
+	h.changeFuncs <- func() {
+		done <- h.render(target)
+	}
+	return <-done
+}
+
+// render implements Render. It must only be invoked from within a changeFunc.
+func (h *HistoryState) render(target io.Writer) error {
 	// ensure we're only working with the maximum number of messages to fill the screen
 	//	renderableHist := lastNElems(h.History, h.renderHeight)
 	renderableHist := h.History
 	renderedHistLines := make([][]byte, 0, h.renderHeight) // ensure starting len is zero
 	ancestors := h.currentAncestors()
 	descendants := h.currentDescendants()
+	typists := h.typists()
 	var (
 		colorPre, colorPost string
 	)
+	// missing holds the ids of messages that have been requested but are missing from
+	// the archive, mapped to whether they are unavailable. A placeholder is rendered for
+	// each before its first child.
+	missing := make(map[string]bool)
+	if h.filter == "" {
+		for _, id := range h.Archive.Needed(defaultHistoryCapacity) {
+			if h.Archive.Queried(id) {
+				missing[id] = false
+			}
+		}
+		for _, id := range h.Archive.Unavailable() {
+			missing[id] = true
+		}
+	}
 	// render each message onto however many lines it needs and capture them all.
 	for _, message := range renderableHist {
+		if unavailable, ok := missing[message.Parent]; ok {
+			delete(missing, message.Parent)
+			renderedHistLines = append(renderedHistLines, RenderPlaceholder(message.Parent, unavailable, "", ""))
+		}
 		if message.UUID == h.current {
 			colorPre = CurrentColor
 			colorPost = ClearColor
@@ -193,7 +443,21 @@ func (h *HistoryState) Render(target io.Writer) error {
 				}
 			}
 		}
-		lines := RenderMessage(message, h.renderWidth, colorPre, colorPost)
+		shown := h.displayed(message)
+		lines := RenderMessage(shown, h.renderWidth, colorPre, colorPost)
+		indent := runewidth.StringWidth(shown.Username + ": ")
+		lines = append(lines, RenderAnnotations(h.annotations(message.UUID), indent)...)
+		if reactions := h.reactions(message.UUID); len(reactions) > 0 {
+			lines = append(lines, RenderReactions(reactions, indent))
+		}
+		if usernames := typists[message.UUID]; len(usernames) > 0 {
+			lines = append(lines, RenderTyping(usernames, indent))
+		}
+		if message.UUID == h.current {
+			if viewers := h.seenBy(message.UUID); len(viewers) > 0 {
+				lines = append(lines, RenderSeen(viewers, indent))
+			}
+		}
 		if message.UUID == h.current {
 			h.cursorLineStart = len(renderedHistLines)
 		}
@@ -217,7 +481,14 @@ func (h *HistoryState) Render(target io.Writer) error {
 
 // Height returns the number of lines of text rendered in the last render.
 func (h *HistoryState) Height() int {
-	return h.historyHeight
+	done := make(chan error)
+	var height int
+	h.changeFuncs <- func() {
+		defer close(done)
+		height = h.historyHeight
+	}
+	<-done
+	return height
 }
 
 // CursorLines returns the range of rendered lines that contain the selected message.
@@ -242,20 +513,70 @@ func (h *HistoryState) New(message *arbor.ChatMessage) error {
 	h.changeFuncs <- func() {
 		defer close(done)
 		h.Archive.Add(message)
-		h.History = h.Archive.Last(defaultHistoryCapacity)
 		if h.current == "" {
 			h.current = message.UUID
 		}
-		for index, curMsg := range h.History {
-			if h.current == curMsg.UUID {
-				h.currentIndex = index
-			}
-		}
+		h.refresh()
 	}
 
 	return <-done
 }
 
+// refresh rebuilds the visible history from the archive and the current filter. If
+// the current message is no longer visible, the most recent visible message becomes
+// current instead. It must only be invoked from within a changeFunc.
+func (h *HistoryState) refresh() {
+	recent := h.Archive.Last(defaultHistoryCapacity)
+	detector, detects := h.Archive.(types.RevisionDetector)
+	h.History = make([]*arbor.ChatMessage, 0, len(recent))
+	for _, message := range recent {
+		if h.filter != "" && message.Username != h.filter {
+			continue
+		} else if detects && detector.IsRevision(message) {
+			// edits are shown as part of the messages that they edit
+			continue
+		}
+		h.History = append(h.History, message)
+	}
+	for index, curMsg := range h.History {
+		if h.current == curMsg.UUID {
+			h.currentIndex = index
+			return
+		}
+	}
+	if len(h.History) > 0 {
+		h.currentIndex = len(h.History) - 1
+		h.current = h.History[h.currentIndex].UUID
+	} else {
+		h.currentIndex = 0
+	}
+}
+
+// SetFilter restricts the visible history to messages sent by the given user. Passing
+// the empty string makes all messages visible again.
+func (h *HistoryState) SetFilter(username string) {
+	done := make(chan error)
+	h.changeFuncs <- func() {
+		defer close(done)
+		h.filter = username
+		h.refresh()
+	}
+	<-done
+}
+
+// Filter returns the username whose messages are visible, or the empty string if
+// all messages are visible.
+func (h *HistoryState) Filter() string {
+	done := make(chan error)
+	var filter string
+	h.changeFuncs <- func() {
+		defer close(done)
+		filter = h.filter
+	}
+	<-done
+	return filter
+}
+
 // SetDimensions notifes the HistoryState that the renderable display area has changed
 // so that its next render can avoid rendering offscreen.
 func (h *HistoryState) SetDimensions(height, width int) {
@@ -271,8 +592,41 @@ func (h *HistoryState) SetDimensions(height, width int) {
 // Current returns the id of the currently-selected message, if there is one. The first message
 // added to a HistoryState is marked as current automatically. After that, Current can only
 // be changed by scrolling.
-func (h HistoryState) Current() string {
-	return h.current
+func (h *HistoryState) Current() string {
+	done := make(chan error)
+	var current string
+	h.changeFuncs <- func() {
+		defer close(done)
+		current = h.current
+	}
+	<-done
+	return current
+}
+
+// markSeen records that the current message has been viewed, if it is newer than any
+// message viewed before. It must only be invoked from within a changeFunc.
+func (h *HistoryState) markSeen() {
+	if len(h.History) == 0 {
+		return
+	}
+	current := h.History[h.currentIndex]
+	if h.seen == "" || current.Timestamp > h.seenTimestamp {
+		h.seen = current.UUID
+		h.seenTimestamp = current.Timestamp
+	}
+}
+
+// Seen returns the id of the newest message that the cursor has selected, or the empty
+// string if the cursor hasn't moved yet.
+func (h *HistoryState) Seen() string {
+	done := make(chan error)
+	var seen string
+	h.changeFuncs <- func() {
+		defer close(done)
+		seen = h.seen
+	}
+	<-done
+	return seen
 }
 
 // CursorDown moves the current message downward within the history, if it is possible to do
@@ -292,6 +646,7 @@ func (h *HistoryState) CursorDown() {
 		}
 		h.current = h.History[h.currentIndex+1].UUID
 		h.currentIndex++
+		h.markSeen()
 	}
 	<-done
 }
@@ -307,6 +662,7 @@ func (h *HistoryState) CursorEnd() {
 		}
 		h.current = h.History[len(h.History)-1].UUID
 		h.currentIndex = len(h.History) - 1
+		h.markSeen()
 	}
 	<-done
 }
@@ -328,6 +684,7 @@ func (h *HistoryState) CursorUp() {
 		}
 		h.current = h.History[h.currentIndex-1].UUID
 		h.currentIndex--
+		h.markSeen()
 	}
 	<-done
 }
@@ -343,6 +700,48 @@ func (h *HistoryState) CursorBeginning() {
 		}
 		h.current = h.History[0].UUID
 		h.currentIndex = 0
+		h.markSeen()
 	}
 	<-done
 }
+
+// CursorTo moves the current message to the message with the given id. If no message
+// has exactly that id, the message whose id begins with it is chosen instead. It is
+// an error if no message matches or if more than one message matches the prefix.
+func (h *HistoryState) CursorTo(id string) error {
+	done := make(chan error)
+	h.changeFuncs <- func() {
+		defer close(done)
+		if id == "" {
+			done <- fmt.Errorf("Cannot select message with empty id")
+			return
+		}
+		match := -1
+		// an exact match wins over any number of messages that merely share the prefix
+		for index, message := range h.History {
+			if message.UUID == id {
+				match = index
+				break
+			}
+		}
+		for index := 0; match < 0 && index < len(h.History); index++ {
+			if strings.HasPrefix(h.History[index].UUID, id) {
+				for _, other := range h.History[index+1:] {
+					if strings.HasPrefix(other.UUID, id) {
+						done <- fmt.Errorf("Message id prefix \"%s\" is ambiguous", id)
+						return
+					}
+				}
+				match = index
+			}
+		}
+		if match < 0 {
+			done <- fmt.Errorf("No known message with id \"%s\"", id)
+			return
+		}
+		h.current = h.History[match].UUID
+		h.currentIndex = match
+		h.markSeen()
+	}
+	return <-done
+}
@@ -27,13 +27,24 @@ func (t *TUI) Keybindings() []Binding {
 		{historyView, 'i', gocui.ModNone, t.composeReply, "composeReply"},
 		{historyView, 'r', gocui.ModNone, t.composeReply, "composeReply"},
 		{historyView, 'n', gocui.ModNone, t.composeReplyToRoot, "composeReplyToRoot"},
+		{historyView, 'e', gocui.ModNone, t.composeEdit, "composeEdit"},
+		{historyView, 'v', gocui.ModNone, t.toggleVersions, "toggleVersions"},
+		{historyView, '+', gocui.ModNone, t.composeReaction, "composeReaction"},
 		{historyView, gocui.KeyHome, gocui.ModNone, t.scrollTop, "scrollTop"},
 		{historyView, 'g', gocui.ModNone, t.scrollTop, "scrollTop"},
 		{historyView, gocui.KeyEnd, gocui.ModNone, t.scrollBottom, "scrollBottom"},
 		{historyView, 'G', gocui.ModNone, t.scrollBottom, "scrollBottom"},
 		{historyView, 'q', gocui.ModNone, t.queryNeeded, "queryNeeded"},
 		{historyView, 'w', gocui.ModNone, t.toggleUserList, "toggleUserList"},
-		{editView, gocui.KeyTab, gocui.ModNone, t.Editor.ActionInsertTab, "InsertTab"},
+		{userListView, gocui.KeyArrowDown, gocui.ModNone, t.userListDown, "userListDown"},
+		{userListView, 'j', gocui.ModNone, t.userListDown, "userListDown"},
+		{userListView, gocui.KeyArrowUp, gocui.ModNone, t.userListUp, "userListUp"},
+		{userListView, 'k', gocui.ModNone, t.userListUp, "userListUp"},
+		{userListView, gocui.KeyEnter, gocui.ModNone, t.filterSelectedUser, "filterSelectedUser"},
+		{userListView, 'a', gocui.ModNone, t.clearUserFilter, "clearUserFilter"},
+		{userListView, 'w', gocui.ModNone, t.toggleUserList, "toggleUserList"},
+		{userListView, gocui.KeyEsc, gocui.ModNone, t.toggleUserList, "toggleUserList"},
+		{editView, gocui.KeyTab, gocui.ModNone, t.handleTab, "handleTab"},
 		{editView, gocui.KeyEnter, gocui.ModNone, t.handleEnter, "handleEnter"},
 		{editView, gocui.KeyEsc, gocui.ModNone, t.cancelReply, "cancelReply"},
 		{editView, gocui.KeyCtrlP, gocui.ModNone, t.Editor.ActionTogglePasteMode, "TogglePasteMode"},
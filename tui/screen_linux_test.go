@@ -0,0 +1,236 @@
+package tui_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+	"github.com/whereswaldon/gocui"
+)
+
+// conversation returns a short thread of messages with fixed timestamps.
+func conversation(length int) []*arbor.ChatMessage {
+	messages := make([]*arbor.ChatMessage, 0, length)
+	parent := ""
+	for i := 0; i < length; i++ {
+		message := &arbor.ChatMessage{
+			UUID:      fmt.Sprintf("message-%d", i),
+			Parent:    parent,
+			Username:  []string{"alice", "bob"}[i%2],
+			Content:   fmt.Sprintf("message number %d", i),
+			Timestamp: int64(1546300800 + i*60),
+		}
+		messages = append(messages, message)
+		parent = message.UUID
+	}
+	return messages
+}
+
+// TestScreenHistory checks how received messages are drawn.
+func TestScreenHistory(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(3)...)
+		h.waitFor("message number 2")
+		h.matchGolden("history")
+	})
+}
+
+// TestScreenReply checks that a reply composed in the editor is sent to the selected
+// message, that the TUI returns to the history afterward, and that a reply that can't
+// be sent is kept in the editor.
+func TestScreenReply(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(3)...)
+		h.waitFor("message number 2")
+		h.press(gocui.KeyArrowDown, 'r')
+		h.waitFor("Type your reply")
+		h.press("hello there")
+		h.matchGolden("reply-composing")
+		h.press(gocui.KeyEnter)
+		h.waitFor("Arrows to select")
+		h.g.Eventually(h.client.sent).Should(gomega.HaveLen(1))
+		sent := h.client.sent()[0]
+		h.g.Expect(sent.Parent).To(gomega.Equal("message-1"))
+		h.g.Expect(sent.Content).To(gomega.Equal("hello there"))
+
+		// an abandoned reply is not sent
+		h.press('r', "never mind", gocui.KeyEsc)
+		h.waitFor("Arrows to select")
+		h.g.Consistently(h.client.sent).Should(gomega.HaveLen(1))
+
+		// a reply that can't be sent stays in the editor
+		h.client.refuse(errors.New("Reply was dropped"))
+		h.press('r', "dropped", gocui.KeyEnter)
+		h.waitFor("error: Reply was")
+		h.client.refuse(nil)
+		h.press(" again", gocui.KeyEnter)
+		h.waitFor("Arrows to select")
+		h.g.Eventually(h.client.sent).Should(gomega.HaveLen(2))
+		h.g.Expect(h.client.sent()[1].Content).To(gomega.HaveSuffix("dropped again"))
+	})
+}
+
+// TestScreenCommand checks that commands typed into the editor run instead of being
+// sent, and that their feedback is shown.
+func TestScreenCommand(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(1)...)
+		h.waitFor("message number 0")
+		h.press('r', "/ni", gocui.KeyTab)
+		h.waitFor("/nick <name>")
+		h.press("newname", gocui.KeyEnter)
+		h.waitFor("you are now known as newname")
+		h.g.Expect(h.client.Username()).To(gomega.Equal("newname"))
+		h.g.Expect(h.client.sent()).To(gomega.BeEmpty())
+	})
+}
+
+// TestScreenExport checks that /export writes history to .json files and refuses to
+// touch files whose extension names no format.
+func TestScreenExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(1)...)
+		h.waitFor("message number 0")
+		h.press('r', "/export "+filepath.Join(dir, "history.json"), gocui.KeyEnter)
+		h.waitFor("history exported")
+		h.g.Expect(filepath.Join(dir, "history.json")).To(gomega.BeAnExistingFile())
+
+		unknown := filepath.Join(dir, "notes.doc")
+		h.press('r', "/export "+unknown, gocui.KeyEnter)
+		h.waitFor("error: unknown expo")
+		_, err := os.Stat(unknown)
+		h.g.Expect(os.IsNotExist(err)).To(gomega.BeTrue())
+	})
+}
+
+// TestScreenUserList checks that the user list can be shown and hidden.
+func TestScreenUserList(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(1)...)
+		h.waitFor("message number 0")
+		h.press('w')
+		h.matchGolden("userlist")
+		h.press(gocui.KeyEsc)
+		h.matchGolden("userlist-hidden")
+	})
+}
+
+// TestScreenScroll checks that moving the cursor scrolls the history to keep the
+// selected message visible.
+func TestScreenScroll(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(40)...)
+		h.waitFor("message number 18")
+		h.press('G')
+		h.matchGolden("scroll-bottom")
+		h.press(gocui.KeyHome)
+		h.matchGolden("scroll-top")
+		for i := 0; i < 25; i++ {
+			h.press('j')
+		}
+		h.matchGolden("scroll-down")
+	})
+}
+
+// TestScreenRevisions checks that edited and deleted messages are marked, and that the
+// previous versions of a message can be shown.
+func TestScreenRevisions(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(3)...)
+		h.waitFor("message number 2")
+		h.press('e')
+		h.waitFor("/edit message number 0")
+		h.press(" again", gocui.KeyEnter)
+		h.waitFor("message number 0 again (edited)")
+		h.press('v')
+		h.waitFor("[version 1] message number 0")
+		h.press(gocui.KeyArrowDown, 'r', "/delete", gocui.KeyEnter)
+		h.waitFor("[deleted by its author]")
+		h.matchGolden("revisions")
+		h.press(gocui.KeyArrowUp, 'v')
+		h.g.Eventually(h.screen).ShouldNot(gomega.ContainSubstring("[version 1]"))
+	})
+}
+
+// TestScreenReactions checks that the reactions to a message are counted beneath it.
+func TestScreenReactions(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		messages := conversation(2)
+		h.client.deliver(messages...)
+		h.waitFor("message number 1")
+		h.g.Expect(h.client.AddReaction(messages[0].UUID, "carol", "🎉")).To(gomega.Succeed())
+		h.press('+')
+		h.waitFor("/react")
+		h.press("+1", gocui.KeyEnter)
+		h.waitFor("[+1 ×1]")
+		h.press('+', "🎉", gocui.KeyEnter)
+		h.waitFor("[🎉 ×2] [+1 ×1]")
+		h.matchGolden("reactions")
+	})
+}
+
+// TestScreenTyping checks that users composing replies are shown, and that composing a
+// reply is announced without repeating the announcement for every keystroke.
+func TestScreenTyping(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(2)...)
+		h.waitFor("message number 1")
+		h.client.setTyping(map[string]string{"bob": "message-0", "carol": "message-0"})
+		h.waitFor("bob, carol typing")
+		h.matchGolden("typing")
+		h.client.setTyping(nil)
+		h.g.Eventually(h.screen, 2*time.Second).ShouldNot(gomega.ContainSubstring("replying"))
+
+		h.press('r', "hello")
+		h.g.Eventually(h.client.typingAnnounced).Should(gomega.Equal([]string{"message-0"}))
+		h.press(gocui.KeyEnter)
+		h.waitFor("Arrows to select")
+		// commands aren't announced
+		h.press(gocui.KeyArrowDown, 'r', "/who")
+		h.g.Consistently(h.client.typingAnnounced, 100*time.Millisecond).Should(gomega.HaveLen(1))
+	})
+}
+
+// TestScreenSeen checks that the newest message that the user selected is announced as
+// seen, and that the users who have seen the selected message are shown beneath it.
+func TestScreenSeen(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.deliver(conversation(3)...)
+		h.waitFor("message number 2")
+		h.client.setViewers(map[string][]string{"message-1": {"bob", "carol"}})
+		h.press(gocui.KeyArrowDown)
+		h.waitFor("seen by bob, carol")
+		h.matchGolden("seen")
+		h.g.Eventually(h.client.seenAnnounced, 2*time.Second).Should(gomega.Equal([]string{"message-1"}))
+
+		// moving back to older messages announces nothing
+		h.press(gocui.KeyArrowUp)
+		h.g.Eventually(h.screen).ShouldNot(gomega.ContainSubstring("seen by"))
+		h.g.Consistently(h.client.seenAnnounced, 1500*time.Millisecond).Should(gomega.HaveLen(1))
+	})
+}
+
+// TestScreenAnnotations checks that the notes that hooks made about messages are shown
+// beneath them.
+func TestScreenAnnotations(t *testing.T) {
+	inTerminal(t, func(h *harness) {
+		h.client.annotate(map[string][]string{
+			"message-1": {"ticket ARB-12: https://tickets.example.com/ARB-12", "from a bot"},
+		})
+		h.client.deliver(conversation(3)...)
+		h.waitFor("message number 2")
+		h.waitFor("» from a bot")
+		h.matchGolden("annotations")
+	})
+}
@@ -3,12 +3,13 @@ package tui
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	arbor "github.com/arborchat/arbor-go"
 	"github.com/arborchat/muscadine/types"
-	"github.com/pkg/errors"
 	"github.com/whereswaldon/gocui"
 )
 
@@ -19,6 +20,10 @@ const userListView = "userlist"
 const histViewTitlePrefix = "Chat History"
 const updateInterval = 1 * time.Second
 
+// typingInterval is how often the user is announced to be typing while they compose a
+// reply to the same message.
+const typingInterval = 3 * time.Second
+
 // TUI is the default terminal user interface implementation for this client
 type TUI struct {
 	*gocui.Gui
@@ -26,16 +31,29 @@ type TUI struct {
 	messages chan *arbor.ChatMessage
 	types.Client
 	*Editor
-	histState      *HistoryState
-	init           sync.Once
-	editMode       bool
+	histState *HistoryState
+	commands  *CommandSet
+	init      sync.Once
+	editMode  bool
+	// connected must only be accessed from the event loop
 	connected      bool
 	lastKnownWidth int
+	// sessionTTL is how recently a session must have been seen to be listed as online.
+	sessionTTL time.Duration
+	// shownUsers are the users most recently rendered in the user list, and
+	// userIndex is the index of the selected one.
+	shownUsers []types.UserSummary
+	userIndex  int
+	// typingParent is the message that the user was last announced to be replying
+	// to, and typingAt is when. They must only be accessed from the event loop.
+	typingParent string
+	typingAt     time.Time
 }
 
 // NewTUI creates a new terminal user interface. The provided channel will be
-// used to relay any protocol messages initiated by the TUI.
-func NewTUI(client types.Client) (*TUI, error) {
+// used to relay any protocol messages initiated by the TUI. Users are listed as
+// online if one of their sessions was active within the sessionTTL.
+func NewTUI(client types.Client, sessionTTL time.Duration) (*TUI, error) {
 	gui, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
 		return nil, err
@@ -47,13 +65,31 @@ func NewTUI(client types.Client) (*TUI, error) {
 	}
 
 	t := &TUI{
-		Gui:       gui,
-		messages:  make(chan *arbor.ChatMessage),
-		histState: hs,
-		Client:    client,
-		Editor:    NewEditor(),
+		Gui:        gui,
+		messages:   make(chan *arbor.ChatMessage),
+		histState:  hs,
+		Client:     client,
+		Editor:     NewEditor(),
+		commands:   NewCommandSet(),
+		sessionTTL: sessionTTL,
+	}
+	for _, cmd := range defaultCommands() {
+		if err := t.RegisterCommand(cmd); err != nil {
+			return nil, err
+		}
 	}
+	t.Editor.OnEdit = t.announceTyping
 	client.OnReceive(t.Display)
+	if reviser, ok := client.(types.Reviser); ok {
+		reviser.OnRevise(func(string) {
+			t.reRender()
+		})
+	}
+	if reactor, ok := client.(types.Reactor); ok {
+		reactor.OnReact(func(string) {
+			t.reRender()
+		})
+	}
 	t.done = t.mainLoop()
 	go t.manageConnection(client)
 
@@ -84,18 +120,27 @@ func (t *TUI) manageConnection(c types.Connection) {
 			}()
 			break
 		}
-		t.connected = true
-		t.reRender()
+		t.setConnected(true)
 		<-disconnected
 		log.Println("Disconnected from server")
-		t.connected = false
-		t.reRender()
+		t.setConnected(false)
 		// if we get here, we've been disconnected and will now loop around to a
 		// connection attempt
 		log.Println("Retrying server connection")
 	}
 }
 
+// setConnected records whether the client is connected and redraws the history to
+// show it. The change is made from the event loop, which is the only place that
+// reads it.
+func (t *TUI) setConnected(connected bool) {
+	t.Update(func(*gocui.Gui) error {
+		t.connected = connected
+		return nil
+	})
+	t.reRender()
+}
+
 // mainLoop sets up the TUI and runs its event loop in a goroutine
 // until it tries to exit. The channel that it returns will close
 // when the TUI event loop ends, which can be used to block until
@@ -130,9 +175,22 @@ func (t *TUI) AwaitExit() {
 	<-t.done
 }
 
+// backfillProgress reports the progress of the client's search for missing messages.
+// The final return value is false if the client does not search for them on its own.
+func (t *TUI) backfillProgress() (types.BackfillProgress, bool) {
+	reporter, ok := t.Client.(types.BackfillReporter)
+	if !ok {
+		return types.BackfillProgress{}, false
+	}
+	return reporter.BackfillProgress(), true
+}
+
 // update listens for new messages to display and redraws the screen.
 func (t *TUI) update() {
 	ticker := time.NewTicker(updateInterval)
+	lastProgress, _ := t.backfillProgress()
+	lastTyping := t.typing()
+	lastSeen := ""
 	for {
 		select {
 		case message := <-t.messages:
@@ -142,6 +200,25 @@ func (t *TUI) update() {
 			}
 			t.reRender()
 		case <-ticker.C:
+			if seen := t.histState.Seen(); seen != lastSeen {
+				// announce at most one view per tick, however fast the cursor moves
+				lastSeen = seen
+				if indicator, ok := t.Client.(types.SeenIndicator); ok {
+					go indicator.AnnounceSeen(seen, t.Client.SessionID())
+				}
+			}
+			if progress, _ := t.backfillProgress(); progress != lastProgress {
+				// refresh the title with the latest progress
+				lastProgress = progress
+				t.reRender()
+				continue
+			}
+			if typing := t.typing(); !sameTyping(typing, lastTyping) {
+				// show who started or stopped typing
+				lastTyping = typing
+				t.reRender()
+				continue
+			}
 			// redraw
 			t.Update(func(*gocui.Gui) error { return nil })
 		case <-t.done:
@@ -150,6 +227,55 @@ func (t *TUI) update() {
 	}
 }
 
+// typing returns the other users who are composing replies, mapped to the messages
+// that they are replying to. It is nil if the client can't tell who is typing.
+func (t *TUI) typing() map[string]string {
+	indicator, ok := t.Client.(types.TypingIndicator)
+	if !ok {
+		return nil
+	}
+	return indicator.Typing()
+}
+
+// sortedKeys returns the keys of the map in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sameTyping returns whether the same users are replying to the same messages in both.
+func sameTyping(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for username, parent := range a {
+		if other, ok := b[username]; !ok || other != parent {
+			return false
+		}
+	}
+	return true
+}
+
+// announceTyping tells others that the user is composing a reply, unless they were
+// told recently. Commands typed into the editor aren't announced.
+func (t *TUI) announceTyping(v *gocui.View) {
+	indicator, ok := t.Client.(types.TypingIndicator)
+	if !ok || t.Editor.ReplyTo == nil || strings.HasPrefix(v.Buffer(), CommandPrefix) {
+		return
+	}
+	parent := t.Editor.ReplyTo.UUID
+	if parent == t.typingParent && time.Since(t.typingAt) < typingInterval {
+		return
+	}
+	t.typingParent = parent
+	t.typingAt = time.Now()
+	go indicator.AnnounceTyping(parent, t.Client.SessionID())
+}
+
 // Display adds the provided message to the visible interface.
 func (t *TUI) Display(message *arbor.ChatMessage) {
 	t.messages <- message
@@ -191,6 +317,25 @@ func (t *TUI) cursorUp(c *gocui.Gui, v *gocui.View) error {
 	return nil
 }
 
+// scrollToCursor scrolls the history view so that the selected message is visible.
+// It waits until after any pending render so that the position of the cursor is
+// accurate.
+func (t *TUI) scrollToCursor() {
+	t.Update(func(g *gocui.Gui) error {
+		v, err := g.View(historyView)
+		if err != nil {
+			return err
+		}
+		cursorStart, cursorEnd := t.histState.CursorLines()
+		currentX, currentY := v.Origin()
+		_, viewHeight := v.Size()
+		if cursorStart < currentY || cursorEnd >= currentY+viewHeight {
+			return v.SetOrigin(currentX, cursorStart)
+		}
+		return nil
+	})
+}
+
 // scrollDown attempts to move the view downwards through the history.
 func (t *TUI) scrollDown(c *gocui.Gui, v *gocui.View) error {
 	currentX, currentY := v.Origin()
@@ -258,14 +403,29 @@ func (t *TUI) reRender() {
 		} else {
 			suffix += "Connected, "
 		}
-		if len(needed) == 0 {
+		progress, backfilling := t.backfillProgress()
+		if backfilling && progress.Missing > 0 {
+			suffix += fmt.Sprintf("fetching history: %d missing, %d requested, %d fetched", progress.Missing, progress.InFlight, progress.Fetched)
+		} else if len(needed) == 0 {
 			suffix += "all known threads complete"
 		} else {
 			suffix += fmt.Sprintf("%d+ broken threads, q to query", len(needed))
 		}
+		if unavailable := len(t.histState.Unavailable()); unavailable > 0 {
+			suffix += fmt.Sprintf(", %d permanently missing", unavailable)
+		}
+		if filter := t.histState.Filter(); filter != "" {
+			suffix += " | only showing " + filter + ", w to change"
+		}
+
 		if msg := t.histState.Get(t.histState.Current()); msg != nil {
 			timestamp := time.Unix(msg.Timestamp, 0).Local().Format(time.UnixDate)
-			v.Title = histViewTitlePrefix + " | Selected: " + timestamp + " | " + suffix
+			prefix := histViewTitlePrefix
+			if typists := sortedKeys(t.typing()); len(typists) > 0 {
+				// shown first so that it isn't cut off
+				prefix += " | " + strings.Join(typists, ", ") + " typing"
+			}
+			v.Title = prefix + " | Selected: " + timestamp + " | " + suffix
 		}
 		return t.histState.Render(v)
 	})
@@ -307,11 +467,101 @@ func (t *TUI) composeReplyToRoot(c *gocui.Gui, v *gocui.View) error {
 	return t.composeMode(rootMsg)
 }
 
+// composeEdit starts editing the current message by filling the editor with an edit
+// command containing the message's content.
+func (t *TUI) composeEdit(c *gocui.Gui, v *gocui.View) error {
+	msg := t.histState.Get(t.histState.Current())
+	if msg == nil {
+		return nil
+	}
+	if err := t.composeMode(msg); err != nil {
+		return err
+	}
+	editor, err := c.View(editView)
+	if err != nil {
+		return err
+	}
+	replaceContent(editor, CommandPrefix+"edit "+t.histState.content(msg))
+	return nil
+}
+
+// composeReaction starts reacting to the current message by filling the editor with
+// a react command.
+func (t *TUI) composeReaction(c *gocui.Gui, v *gocui.View) error {
+	msg := t.histState.Get(t.histState.Current())
+	if msg == nil {
+		return nil
+	}
+	if err := t.composeMode(msg); err != nil {
+		return err
+	}
+	editor, err := c.View(editView)
+	if err != nil {
+		return err
+	}
+	replaceContent(editor, CommandPrefix+"react ")
+	return nil
+}
+
+// toggleVersions shows or hides the previous versions of the current message.
+func (t *TUI) toggleVersions(c *gocui.Gui, v *gocui.View) error {
+	t.histState.ToggleVersions()
+	t.reRender()
+	return nil
+}
+
 // cancelReply exits compose mode and returns to history mode.
 func (t *TUI) cancelReply(c *gocui.Gui, v *gocui.View) error {
+	t.Editor.SetFeedback("")
 	return t.historyMode()
 }
 
+// RegisterCommand makes a new command available from the editor. Commands should be
+// registered before the user has a chance to type them.
+func (t *TUI) RegisterCommand(cmd Command) error {
+	return t.commands.Register(cmd)
+}
+
+// runCommand executes the named command with the provided arguments, or with the text
+// that followed its name in the input if it is a TextCommand.
+func (t *TUI) runCommand(name string, args []string, input string) error {
+	if name == "" {
+		return fmt.Errorf("missing command name, try %shelp", CommandPrefix)
+	}
+	cmd, ok := t.commands.Lookup(name)
+	if !ok {
+		return fmt.Errorf("unknown command \"%s%s\", try %shelp", CommandPrefix, name, CommandPrefix)
+	}
+	if textCmd, ok := cmd.(TextCommand); ok {
+		return textCmd.RunText(t, CommandText(input))
+	}
+	return cmd.Run(t, args)
+}
+
+// handleTab is intended to be used *only* for handling the "Tab" keypress. If the editor
+// contains a partial command name, it is completed. Otherwise the Editor inserts a tab.
+func (t *TUI) handleTab(c *gocui.Gui, v *gocui.View) error {
+	content := strings.TrimSuffix(v.Buffer(), "\n")
+	if !strings.HasPrefix(content, CommandPrefix) || strings.ContainsAny(content, " \t\n") {
+		return t.Editor.ActionInsertTab(c, v)
+	}
+	partial := strings.TrimPrefix(content, CommandPrefix)
+	matches := t.commands.Complete(partial)
+	switch len(matches) {
+	case 0:
+		t.Editor.SetFeedback("no command matches " + content)
+	case 1:
+		replaceContent(v, CommandPrefix+matches[0]+" ")
+		if cmd, ok := t.commands.Lookup(matches[0]); ok {
+			t.Editor.SetFeedback(cmd.Usage())
+		}
+	default:
+		replaceContent(v, CommandPrefix+commonPrefix(matches))
+		t.Editor.SetFeedback("matches: " + CommandPrefix + strings.Join(matches, " "+CommandPrefix))
+	}
+	return nil
+}
+
 // handleEnter is intended to be used *only* for handling the "Enter" keypress. It allows the Editor
 // to dictate whether or not the keypress should be interpreted literally. The results of that
 // decision must be handled by the TUI as a whole, since only the TUI can actually perform the
@@ -337,26 +587,31 @@ func (t *TUI) sendReply(c *gocui.Gui, v *gocui.View) error {
 	if content[len(content)-1] == '\n' {
 		content = content[:len(content)-1]
 	}
-	t.Client.Reply(t.Editor.ReplyTo.UUID, content)
-	return t.historyMode()
-}
-
-// toggleUserList toggles the visibility of the list of online users
-func (t *TUI) toggleUserList(c *gocui.Gui, v *gocui.View) error {
-	x, y, _, _, err := c.ViewPosition(userListView)
-	if err != nil {
-		return errors.Wrapf(err, "toggleUserList view position")
+	if name, args, isCommand := ParseCommand(content); isCommand {
+		err := t.runCommand(name, args, content)
+		if err == gocui.ErrQuit {
+			return err
+		} else if err != nil {
+			// leave the command in the editor so that it can be corrected
+			replaceContent(v, content)
+			t.Editor.SetFeedback("error: " + err.Error())
+			return nil
+		}
+		return t.historyMode()
 	}
-	topView, err := c.ViewByPosition(x+1, y+1)
-	if err != nil {
-		return errors.Wrapf(err, "toggleUserList view by position")
+	draft := content
+	// a doubled prefix escapes a message that would otherwise be a command
+	if strings.HasPrefix(content, CommandPrefix+CommandPrefix) {
+		content = strings.TrimPrefix(content, CommandPrefix)
 	}
-	if topView.Name() == userListView {
-		_, err = c.SetViewOnBottom(userListView)
-		return errors.Wrapf(err, "toggleUserList set on bottom")
+	t.Editor.SetFeedback("")
+	if err := t.Client.Reply(t.Editor.ReplyTo.UUID, content); err != nil {
+		// leave the reply in the editor so that it isn't lost
+		replaceContent(v, draft)
+		t.Editor.SetFeedback("error: " + err.Error())
+		return nil
 	}
-	_, err = c.SetViewOnTop(userListView)
-	return errors.Wrapf(err, "toggleUserList set on top")
+	return t.historyMode()
 }
 
 // layout places views in the UI.
@@ -376,21 +631,14 @@ func (t *TUI) layout(gui *gocui.Gui) error {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
-		userList.Title = "Online users"
+		userList.Title = userListTitle
 		userList.Wrap = true
 		gui.SetViewOnBottom(userListView)
 		log.Printf("%v", userList)
 	}
 	// repopulate the user list
-	sessions := t.Client.ActiveSessions()
-	userText := ""
-	for user, lastSeen := range sessions {
-		since := time.Since(lastSeen)
-		userText += fmt.Sprintf("%s seen %02dm%02ds ago\n", user, int(since.Minutes()), int(since.Seconds()))
-	}
 	userList.Clear()
-	_, err = userList.Write([]byte(userText))
-	if err != nil {
+	if err := t.renderUserList(userList); err != nil {
 		log.Println("error writing user list", err)
 	}
 	// update view dimensions or create for the first time
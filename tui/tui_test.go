@@ -6,10 +6,12 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	arbor "github.com/arborchat/arbor-go"
 	"github.com/arborchat/muscadine/archive"
 	"github.com/arborchat/muscadine/tui"
+	"github.com/arborchat/muscadine/types"
 	runewidth "github.com/mattn/go-runewidth"
 )
 
@@ -279,3 +281,264 @@ func TestMessageSort(t *testing.T) {
 		t.Errorf("Messages not rendered in timestamp order, 0 at %d, 1 at %d, 2 at %d, 3 at %d", zeroIndex, oneIndex, twoIndex, threeIndex)
 	}
 }
+
+// TestCursorTo checks that the current message can be selected by its id or by a
+// unique prefix of its id.
+func TestCursorTo(t *testing.T) {
+	hist := historyStateOrSkip(t)
+	message := testMsg
+	message.UUID = "abc-first"
+	newOrSkip(t, hist, &message)
+	second := testMsg
+	second.UUID = "abd-second"
+	newOrSkip(t, hist, &second)
+	if err := hist.CursorTo(second.UUID); err != nil {
+		t.Errorf("Should be able to select message by full id: %v", err)
+	} else if id := hist.Current(); id != second.UUID {
+		t.Errorf("History current message should have id \"%s\", not \"%s\"", second.UUID, id)
+	}
+	if err := hist.CursorTo("abc"); err != nil {
+		t.Errorf("Should be able to select message by unique prefix: %v", err)
+	} else if id := hist.Current(); id != message.UUID {
+		t.Errorf("History current message should have id \"%s\", not \"%s\"", message.UUID, id)
+	}
+	if err := hist.CursorTo("ab"); err == nil {
+		t.Error("Selecting by an ambiguous prefix should fail")
+	}
+	if err := hist.CursorTo("zzz"); err == nil {
+		t.Error("Selecting a nonexistent message should fail")
+	}
+	if id := hist.Current(); id != message.UUID {
+		t.Errorf("Failed selection should not change current message, got \"%s\"", id)
+	}
+	// an id that is also a prefix of other ids still selects its own message
+	exact := testMsg
+	exact.UUID = "ab"
+	newOrSkip(t, hist, &exact)
+	if err := hist.CursorTo("ab"); err != nil {
+		t.Errorf("Should be able to select message by full id shared as a prefix: %v", err)
+	} else if id := hist.Current(); id != exact.UUID {
+		t.Errorf("History current message should have id \"%s\", not \"%s\"", exact.UUID, id)
+	}
+}
+
+// TestSetFilter checks that filtering the history by username hides messages from
+// other users and that clearing the filter shows them again.
+func TestSetFilter(t *testing.T) {
+	hist := historyStateOrSkip(t)
+	message := testMsg
+	message.UUID = "from-test"
+	message.Content = "first"
+	newOrSkip(t, hist, &message)
+	other := testMsg
+	other.UUID = "from-other"
+	other.Username = "other"
+	other.Content = "second"
+	other.Timestamp++
+	newOrSkip(t, hist, &other)
+
+	hist.SetFilter(other.Username)
+	if filter := hist.Filter(); filter != other.Username {
+		t.Errorf("Expected filter \"%s\", got \"%s\"", other.Username, filter)
+	}
+	b := new(bytes.Buffer)
+	if err := hist.Render(b); err != nil {
+		t.Error("Failed to render filtered history", err)
+	}
+	if strings.Contains(b.String(), message.Content) || !strings.Contains(b.String(), other.Content) {
+		t.Errorf("Filtered history should only contain messages from %s, got %s", other.Username, b.String())
+	}
+	if id := hist.Current(); id != other.UUID {
+		t.Errorf("Current message should move to a visible message, expected \"%s\", got \"%s\"", other.UUID, id)
+	}
+
+	hist.SetFilter("")
+	b = new(bytes.Buffer)
+	if err := hist.Render(b); err != nil {
+		t.Error("Failed to render unfiltered history", err)
+	}
+	if !strings.Contains(b.String(), message.Content) || !strings.Contains(b.String(), other.Content) {
+		t.Errorf("Unfiltered history should contain all messages, got %s", b.String())
+	}
+}
+
+// TestRenderPlaceholder checks that a placeholder is rendered in place of a requested
+// parent that is missing, and that it shows whether the parent is still being fetched.
+func TestRenderPlaceholder(t *testing.T) {
+	a := archive.New()
+	hist, err := tui.NewHistoryState(a)
+	if err != nil {
+		t.Skip("Should have been able to construct HistoryState with valid params", err)
+	}
+	hist.SetDimensions(24, 80)
+	for _, id := range []string{"child1", "child2"} {
+		orphan := testMsg
+		orphan.UUID = id
+		orphan.Parent = "missing-parent"
+		newOrSkip(t, hist, &orphan)
+	}
+	render := func() string {
+		b := new(bytes.Buffer)
+		if err := hist.Render(b); err != nil {
+			t.Error("Failed to render history", err)
+		}
+		return b.String()
+	}
+	if out := render(); strings.Contains(out, "missing-") {
+		t.Errorf("Rendered placeholder for parent that was never requested: %s", out)
+	}
+	a.SetGiveUp(2, 0)
+	a.RecordQuery("missing-parent", time.Now())
+	if out := render(); strings.Count(out, "[message missing- is still fetching]") != 1 {
+		t.Errorf("Expected a single placeholder for a parent being fetched, got: %s", out)
+	}
+	a.RecordQuery("missing-parent", time.Now())
+	if out := render(); strings.Count(out, "[message missing- is permanently missing]") != 1 {
+		t.Errorf("Expected a single placeholder for an unavailable parent, got: %s", out)
+	}
+}
+
+// verifyingArchive is an Archive that verifies messages whose content is "good" and
+// considers all others invalid.
+type verifyingArchive struct {
+	*archive.Archive
+}
+
+func (v verifyingArchive) Verify(message *arbor.ChatMessage) (types.Verification, string) {
+	if message.Content == "good" {
+		return types.Verified, "good"
+	}
+	return types.Invalid, "stripped"
+}
+
+// TestRenderVerification checks that usernames are marked with the outcome of
+// verifying their messages, and that the content is shown without its signature.
+func TestRenderVerification(t *testing.T) {
+	hist, err := tui.NewHistoryState(verifyingArchive{archive.New()})
+	if err != nil {
+		t.Skip("Should have been able to construct HistoryState with valid params", err)
+	}
+	hist.SetDimensions(24, 80)
+	good, bad := testMsg, testMsg
+	good.UUID, good.Content = "good", "good"
+	bad.UUID, bad.Content = "bad", "signed"
+	newOrSkip(t, hist, &good)
+	newOrSkip(t, hist, &bad)
+	b := new(bytes.Buffer)
+	if err := hist.Render(b); err != nil {
+		t.Error("Failed to render history", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "test ✓: ") || !strings.Contains(out, "test ✗: ") {
+		t.Errorf("Expected usernames to be marked with verification results, got: %s", out)
+	}
+	if strings.Contains(out, "signed") || !strings.Contains(out, "stripped") {
+		t.Errorf("Expected content to be shown without its signature, got: %s", out)
+	}
+}
+
+// decryptingArchive is an Archive that can decrypt only some messages.
+type decryptingArchive struct {
+	*archive.Archive
+}
+
+func (d decryptingArchive) Decrypt(message *arbor.ChatMessage) string {
+	if message.Content == "ciphertext" {
+		return "plaintext"
+	}
+	return "[encrypted, no key]"
+}
+
+// TestRenderDecrypted checks that encrypted messages are shown decrypted, or as a
+// placeholder when they can't be.
+func TestRenderDecrypted(t *testing.T) {
+	hist, err := tui.NewHistoryState(decryptingArchive{archive.New()})
+	if err != nil {
+		t.Skip("Should have been able to construct HistoryState with valid params", err)
+	}
+	hist.SetDimensions(24, 80)
+	readable, unreadable := testMsg, testMsg
+	readable.UUID, readable.Content = "readable", "ciphertext"
+	unreadable.UUID, unreadable.Content = "unreadable", "other ciphertext"
+	newOrSkip(t, hist, &readable)
+	newOrSkip(t, hist, &unreadable)
+	b := new(bytes.Buffer)
+	if err := hist.Render(b); err != nil {
+		t.Error("Failed to render history", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "plaintext") || !strings.Contains(out, "[encrypted, no key]") {
+		t.Errorf("Expected decrypted content and placeholders, got: %s", out)
+	}
+	if strings.Contains(out, "ciphertext") {
+		t.Errorf("Expected ciphertext to be hidden, got: %s", out)
+	}
+}
+
+// rewritingArchive is an Archive that shows the message with the ID "rewritten"
+// differently.
+type rewritingArchive struct {
+	*archive.Archive
+}
+
+func (r rewritingArchive) Rewritten(id string) (string, bool) {
+	return "shown instead", id == "rewritten"
+}
+
+// TestRenderRewritten checks that rewritten messages are shown with their new content
+// instead of the content they were sent with.
+func TestRenderRewritten(t *testing.T) {
+	hist, err := tui.NewHistoryState(rewritingArchive{archive.New()})
+	if err != nil {
+		t.Skip("Should have been able to construct HistoryState with valid params", err)
+	}
+	hist.SetDimensions(24, 80)
+	rewritten, plain := testMsg, testMsg
+	rewritten.UUID, rewritten.Content = "rewritten", "as sent"
+	plain.UUID, plain.Content = "plain", "left alone"
+	newOrSkip(t, hist, &rewritten)
+	newOrSkip(t, hist, &plain)
+	b := new(bytes.Buffer)
+	if err := hist.Render(b); err != nil {
+		t.Error("Failed to render history", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "shown instead") || !strings.Contains(out, "left alone") {
+		t.Errorf("Expected rewritten content and unchanged content, got: %s", out)
+	}
+	if strings.Contains(out, "as sent") {
+		t.Errorf("Expected original content to be hidden, got: %s", out)
+	}
+}
+
+// revisingArchive is an Archive in which the message with the ID "edit" edits another
+// message.
+type revisingArchive struct {
+	*archive.Archive
+}
+
+func (r revisingArchive) IsRevision(message *arbor.ChatMessage) bool {
+	return message.UUID == "edit"
+}
+
+// TestRenderHidesRevisions checks that edits aren't shown as messages of their own.
+func TestRenderHidesRevisions(t *testing.T) {
+	hist, err := tui.NewHistoryState(revisingArchive{archive.New()})
+	if err != nil {
+		t.Skip("Should have been able to construct HistoryState with valid params", err)
+	}
+	hist.SetDimensions(24, 80)
+	original, edit := testMsg, testMsg
+	original.UUID, original.Content = "original", "helo"
+	edit.UUID, edit.Parent, edit.Content = "edit", "original", "hello"
+	newOrSkip(t, hist, &original)
+	newOrSkip(t, hist, &edit)
+	b := new(bytes.Buffer)
+	if err := hist.Render(b); err != nil {
+		t.Error("Failed to render history", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "helo") || strings.Contains(out, "hello") {
+		t.Errorf("Expected only the original message, got: %s", out)
+	}
+}
@@ -0,0 +1,160 @@
+package tui
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/whereswaldon/gocui"
+)
+
+const userListTitle = "Online users | j/k to select, enter to filter history, a to show all, w to close"
+
+// maxShownEvents is the number of recent arrivals and departures displayed beneath
+// the list of online users.
+const maxShownEvents = 5
+
+// formatSince renders a duration as hours, minutes, and seconds.
+func formatSince(since time.Duration) string {
+	since = since.Round(time.Second)
+	hours := int(since.Hours())
+	minutes := int(since.Minutes()) % 60
+	seconds := int(since.Seconds()) % 60
+	if hours > 0 {
+		return fmt.Sprintf("%dh%02dm%02ds", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%02dm%02ds", minutes, seconds)
+}
+
+// renderUserList writes the online users, most recently active first, followed by
+// the most recent arrivals and departures. It must be invoked from within the gocui
+// event loop.
+func (t *TUI) renderUserList(target io.Writer) error {
+	now := time.Now()
+	t.shownUsers = t.Client.Users(now.Add(-t.sessionTTL))
+	if t.userIndex >= len(t.shownUsers) {
+		t.userIndex = len(t.shownUsers) - 1
+	}
+	if t.userIndex < 0 {
+		t.userIndex = 0
+	}
+	filter := t.histState.Filter()
+	text := fmt.Sprintf("%d users active in the last %s\n", len(t.shownUsers), t.sessionTTL)
+	for i, user := range t.shownUsers {
+		colorPre, colorPost := "", ""
+		if i == t.userIndex {
+			colorPre, colorPost = CurrentColor, ClearColor
+		}
+		sessions := ""
+		if user.Sessions > 1 {
+			sessions = fmt.Sprintf(" (%d sessions)", user.Sessions)
+		}
+		filtered := ""
+		if user.Username == filter {
+			filtered = " [filtering history]"
+		}
+		text += fmt.Sprintf("%s%s%s seen %s ago%s%s\n", colorPre, user.Username, sessions, formatSince(now.Sub(user.LastSeen)), filtered, colorPost)
+	}
+	events := t.Client.Events()
+	if len(events) > maxShownEvents {
+		events = events[len(events)-maxShownEvents:]
+	}
+	if len(events) > 0 {
+		text += "\nRecent activity:\n"
+	}
+	for _, event := range events {
+		action := "left"
+		if event.Joined {
+			action = "joined"
+		}
+		text += fmt.Sprintf("%s %s %s\n", event.Time.Local().Format("15:04:05"), event.Username, action)
+	}
+	_, err := target.Write([]byte(text))
+	return err
+}
+
+// userListVisible returns whether the user list is currently drawn on top of the history.
+func (t *TUI) userListVisible(c *gocui.Gui) (bool, error) {
+	x, y, _, _, err := c.ViewPosition(userListView)
+	if err != nil {
+		return false, errors.Wrapf(err, "userListVisible view position")
+	}
+	topView, err := c.ViewByPosition(x+1, y+1)
+	if err != nil {
+		return false, errors.Wrapf(err, "userListVisible view by position")
+	}
+	return topView.Name() == userListView, nil
+}
+
+// showUserList draws the list of online users over the history and focuses it.
+func (t *TUI) showUserList(c *gocui.Gui) error {
+	if _, err := c.SetViewOnTop(userListView); err != nil {
+		return errors.Wrapf(err, "showUserList set on top")
+	}
+	_, err := c.SetCurrentView(userListView)
+	return errors.Wrapf(err, "showUserList set current view")
+}
+
+// hideUserList hides the list of online users and returns focus to the history.
+func (t *TUI) hideUserList(c *gocui.Gui) error {
+	if _, err := c.SetViewOnBottom(userListView); err != nil {
+		return errors.Wrapf(err, "hideUserList set on bottom")
+	}
+	if current := c.CurrentView(); current != nil && current.Name() != userListView {
+		// don't steal focus from the editor
+		return nil
+	}
+	_, err := c.SetCurrentView(historyView)
+	return errors.Wrapf(err, "hideUserList set current view")
+}
+
+// toggleUserList toggles the visibility of the list of online users
+func (t *TUI) toggleUserList(c *gocui.Gui, v *gocui.View) error {
+	visible, err := t.userListVisible(c)
+	if err != nil {
+		return err
+	}
+	if visible {
+		return t.hideUserList(c)
+	}
+	return t.showUserList(c)
+}
+
+// userListDown selects the next user in the list of online users.
+func (t *TUI) userListDown(c *gocui.Gui, v *gocui.View) error {
+	if t.userIndex+1 < len(t.shownUsers) {
+		t.userIndex++
+	}
+	return nil
+}
+
+// userListUp selects the previous user in the list of online users.
+func (t *TUI) userListUp(c *gocui.Gui, v *gocui.View) error {
+	if t.userIndex > 0 {
+		t.userIndex--
+	}
+	return nil
+}
+
+// filterSelectedUser restricts the history to messages from the selected user. If the
+// history is already restricted to that user, all messages are shown again.
+func (t *TUI) filterSelectedUser(c *gocui.Gui, v *gocui.View) error {
+	if t.userIndex >= len(t.shownUsers) {
+		return nil
+	}
+	username := t.shownUsers[t.userIndex].Username
+	if t.histState.Filter() == username {
+		username = ""
+	}
+	t.histState.SetFilter(username)
+	t.reRender()
+	return t.hideUserList(c)
+}
+
+// clearUserFilter makes messages from all users visible in the history again.
+func (t *TUI) clearUserFilter(c *gocui.Gui, v *gocui.View) error {
+	t.histState.SetFilter("")
+	t.reRender()
+	return t.hideUserList(c)
+}
@@ -19,17 +19,198 @@ type UI interface {
 	AwaitExit()                 // blocks until UI exit
 }
 
+// BackfillReporter is implemented by Clients that automatically request messages
+// missing from their history.
+type BackfillReporter interface {
+	BackfillProgress() BackfillProgress
+}
+
+// BackfillProgress summarizes the search for messages missing from the history.
+type BackfillProgress struct {
+	// Missing is the number of messages still being sought.
+	Missing int
+	// InFlight is the number of queries awaiting an answer.
+	InFlight int
+	// Fetched is the number of messages that arrived after being requested.
+	Fetched int
+	// Unavailable is the number of messages that the server never provided.
+	Unavailable int
+}
+
+// Verification is the outcome of checking the signature of a message.
+type Verification int
+
+const (
+	// NotChecked messages were not checked, because verification is disabled.
+	NotChecked Verification = iota
+	// Unverified messages are not signed.
+	Unverified
+	// Verified messages were signed by the key trusted for their username.
+	Verified
+	// Invalid messages have a signature that doesn't match, or that was made by a key
+	// other than the one trusted for their username.
+	Invalid
+)
+
+// Verifier is implemented by Clients that check the signatures of messages.
+type Verifier interface {
+	// Verify returns the outcome of checking the message's signature, along with the
+	// content of the message without its signature. It only reports the outcome, so
+	// it is safe to call while rendering.
+	Verify(message *arbor.ChatMessage) (Verification, string)
+}
+
+// Decrypter is implemented by Clients that can decrypt the content of messages.
+type Decrypter interface {
+	// Decrypt returns the content of the message, decrypted if possible. If the
+	// message is encrypted and can't be decrypted, a placeholder is returned instead.
+	Decrypt(message *arbor.ChatMessage) string
+}
+
+// ThreadProtector is implemented by Clients that can encrypt threads.
+type ThreadProtector interface {
+	// ProtectThread encrypts every later reply beneath the root message, returning
+	// the key to share with other participants.
+	ProtectThread(root string) (string, error)
+	// AddThreadKey adds a key shared by another participant, returning the ID of the
+	// root of the thread that it protects.
+	AddThreadKey(shared string) (string, error)
+}
+
+// Revision is a change that the author of a message made to it after sending it.
+type Revision struct {
+	// Content replaces the content of the message. It is empty if the message was
+	// retracted.
+	Content string `json:"content,omitempty"`
+	// Retracted is true if the author withdrew the message.
+	Retracted bool `json:"retracted,omitempty"`
+	// Timestamp is when the author made the change, in seconds since the epoch.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// RevisionKeeper is implemented by Archives that track the revisions of messages.
+type RevisionKeeper interface {
+	// Revisions returns the changes made to the message, oldest first.
+	Revisions(id string) []Revision
+}
+
+// RevisionDetector is implemented by Archives whose messages may include edits of other
+// messages, which are shown as part of the messages that they edit instead of on their
+// own.
+type RevisionDetector interface {
+	// IsRevision returns whether the message edits another message.
+	IsRevision(message *arbor.ChatMessage) bool
+}
+
+// Reviser is implemented by Clients that can revise the messages sent by their user.
+type Reviser interface {
+	// Edit replaces the content of the message.
+	Edit(id, content string) error
+	// Retract withdraws the message.
+	Retract(id string) error
+	// OnRevise sets the handler for when a message is revised by its author.
+	OnRevise(handler func(id string))
+}
+
+// Reaction summarizes the users who reacted to a message in the same way.
+type Reaction struct {
+	// Tag is the emoji or short word that the users reacted with.
+	Tag string
+	// Usernames holds the users who reacted, sorted by name.
+	Usernames []string
+}
+
+// ReactionKeeper is implemented by Archives that track reactions to messages.
+type ReactionKeeper interface {
+	// Reactions returns the reactions to the message, most popular first.
+	Reactions(id string) []Reaction
+}
+
+// Reactor is implemented by Clients that can react to messages.
+type Reactor interface {
+	// React adds the user's reaction to the message, or removes it if the user
+	// already reacted to the message with the same tag.
+	React(id, tag string) error
+	// OnReact sets the handler for when the reactions to a message change.
+	OnReact(handler func(id string))
+}
+
+// TypingIndicator is implemented by Clients that can tell who is composing replies.
+type TypingIndicator interface {
+	// AnnounceTyping tells others that the user's session is composing a reply to the
+	// parent.
+	AnnounceTyping(parent, sessionID string)
+	// Typing returns the other users who are composing replies, mapped to the ID of the
+	// message that each is replying to.
+	Typing() map[string]string
+}
+
+// SeenIndicator is implemented by Clients that can tell who has viewed messages.
+type SeenIndicator interface {
+	// AnnounceSeen tells others that the user's session has viewed the message, if
+	// the user chose to share that.
+	AnnounceSeen(id, sessionID string)
+	// SeenBy returns the other users who have viewed the message, sorted by name.
+	SeenBy(id string) []string
+}
+
+// Annotator is implemented by Clients that keep notes about messages, such as those
+// made by hooks.
+type Annotator interface {
+	// Annotations returns the notes about the message, in the order they were made.
+	Annotations(id string) []string
+}
+
+// Rewriter is implemented by Clients that show some messages with different content
+// than they were sent with, such as at the request of hooks.
+type Rewriter interface {
+	// Rewritten returns the content to show in place of the message's content. The
+	// final return value is false if the message is shown as it was sent.
+	Rewritten(id string) (string, bool)
+}
+
+// Saver persists the state of something, such as an Archive, to durable storage.
+type Saver interface {
+	Save() error
+}
+
 // Client manages the connection between a TUI and a specific server
 type Client interface {
+	Identity
 	Composer
 	Archive
 	Connection
 	SessionList
 }
 
+// Identity controls the name under which a client participates in chat
+type Identity interface {
+	Username() string
+	ChangeUsername(string) error
+}
+
 // SessionList tracks the sessions of other users.
 type SessionList interface {
 	ActiveSessions() map[string]time.Time
+	Users(seenSince time.Time) []UserSummary
+	Events() []PresenceEvent
+}
+
+// UserSummary describes the known sessions of a single user.
+type UserSummary struct {
+	Username string
+	// Sessions is the number of sessions that the user has.
+	Sessions int
+	// LastSeen is the most recent time that any of the user's sessions was active.
+	LastSeen time.Time
+}
+
+// PresenceEvent records a user arriving on or departing from the server.
+type PresenceEvent struct {
+	Username string
+	// Joined is true if the user arrived, and false if the user left.
+	Joined bool
+	Time   time.Time
 }
 
 // Composer writes and sends protocol messages
@@ -55,6 +236,9 @@ type Archive interface {
 	Last(n int) []*arbor.ChatMessage
 	Needed(n int) []string
 	Has(id string) bool
+	Queried(id string) bool
+	IsUnavailable(id string) bool
+	Unavailable() []string
 	Get(id string) *arbor.ChatMessage
 	Root() (string, error)
 	ChildrenOf(string) []string